@@ -3,11 +3,16 @@ package api
 import (
 	"fmt"
 	"github.com/MohammedShetaya/kayakdb/types"
+	"io"
 	"net"
 
 	"go.uber.org/zap"
 )
 
+// maxRedirects bounds how many times a request follows a redirect, so a cluster in the middle of an election
+// does not bounce it around forever
+const maxRedirects = 3
+
 // Client encapsulates the logic for sending requests.
 type Client struct {
 	Hostname string
@@ -24,27 +29,66 @@ func NewClient(hostname, port string, logger *zap.Logger) *Client {
 	}
 }
 
-// SendRequest sends a serialized payload to the server.
-func (c *Client) SendRequest(payload types.Payload) error {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", c.Hostname, c.Port))
+// SendRequest sends a serialized payload to the server and returns its response. Requests that reach a follower
+// are redirected to the leader.
+func (c *Client) SendRequest(payload types.Payload) (*types.Payload, error) {
+	addr := net.JoinHostPort(c.Hostname, c.Port)
+	for redirects := 0; ; redirects++ {
+		resp, err := c.roundTrip(addr, payload)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Headers.Redirect == "" {
+			if resp.Headers.Error != "" {
+				return resp, fmt.Errorf("request failed: %v", resp.Headers.Error)
+			}
+			return resp, nil
+		}
+		if redirects == maxRedirects {
+			return resp, fmt.Errorf("too many redirects, last one to %v", resp.Headers.Redirect)
+		}
+		c.Logger.Debug("Following redirect", zap.String("to", resp.Headers.Redirect.String()))
+		addr = resp.Headers.Redirect.String()
+	}
+}
+
+func (c *Client) roundTrip(addr string, payload types.Payload) (*types.Payload, error) {
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		c.Logger.Error("Failed to connect to server", zap.Error(err))
-		return err
+		return nil, err
 	}
 	defer conn.Close()
 
 	data, err := payload.Serialize()
 	if err != nil {
 		c.Logger.Error("Failed to serialize payload", zap.Error(err))
-		return err
+		return nil, err
 	}
 
 	_, err = conn.Write(data)
 	if err != nil {
 		c.Logger.Error("Failed to send data to server", zap.Error(err))
-		return err
+		return nil, err
+	}
+
+	// Signal to the server that we have finished sending the request so it can start processing
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	}
+
+	resBuffer, err := io.ReadAll(conn)
+	if err != nil {
+		c.Logger.Error("Failed to read response from server", zap.Error(err))
+		return nil, err
+	}
+
+	var resp types.Payload
+	if err = resp.Deserialize(resBuffer); err != nil {
+		c.Logger.Error("Failed to deserialize response", zap.Error(err))
+		return nil, err
 	}
 
 	c.Logger.Info("Request sent successfully")
-	return nil
+	return &resp, nil
 }
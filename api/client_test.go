@@ -0,0 +1,97 @@
+package api
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"go.uber.org/zap"
+)
+
+// listen returns a listener whose connections are answered by respond, it is closed at the end of the test.
+func listen(t *testing.T, respond func() types.Payload) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.ReadAll(conn)
+			response := respond()
+			if data, err := response.Serialize(); err == nil {
+				_, _ = conn.Write(data)
+			}
+			_ = conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// send sends a read of the key k to the server listening on addr.
+func send(t *testing.T, addr string) (*types.Payload, error) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("Failed to split %v: %v", addr, err)
+	}
+	client := NewClient(host, port, zap.NewNop())
+	return client.SendRequest(types.Payload{Headers: types.Headers{Path: "/get"}, Data: []types.Type{types.String("k")}})
+}
+
+func TestClientRedirects(t *testing.T) {
+	types.RegisterDataTypes()
+
+	t.Run("a request sent to a follower is redirected to the leader", func(t *testing.T) {
+		leader := listen(t, func() types.Payload {
+			return types.Payload{Data: []types.Type{types.String("v")}}
+		})
+		follower := listen(t, func() types.Payload {
+			return *ErrorResponse(&raft.NotLeaderError{LeaderId: "leader", LeaderAddr: leader})
+		})
+
+		resp, err := send(t, follower)
+		if err != nil {
+			t.Fatalf("Failed to send the request: %v", err)
+		}
+		if len(resp.Data) != 1 || resp.Data[0].String() != "v" {
+			t.Errorf("Expected the response of the leader, got %v", resp)
+		}
+	})
+
+	t.Run("a request fails while the leader is unknown", func(t *testing.T) {
+		follower := listen(t, func() types.Payload {
+			return *ErrorResponse(&raft.NotLeaderError{})
+		})
+
+		resp, err := send(t, follower)
+		if err == nil || resp.Headers.Redirect != "" {
+			t.Errorf("Expected the request to fail without a redirect, got %v and %v", resp, err)
+		}
+	})
+
+	t.Run("the redirects are given up after a few", func(t *testing.T) {
+		// a server that believes another one leads, which believes the first one does
+		var first, second string
+		first = listen(t, func() types.Payload {
+			return *ErrorResponse(&raft.NotLeaderError{LeaderAddr: second})
+		})
+		second = listen(t, func() types.Payload {
+			return *ErrorResponse(&raft.NotLeaderError{LeaderAddr: first})
+		})
+
+		if _, err := send(t, first); err == nil || !strings.Contains(err.Error(), "too many redirects") {
+			t.Errorf("Expected the request to give up after %d redirects, got %v", maxRedirects, err)
+		}
+	})
+}
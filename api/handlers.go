@@ -2,17 +2,44 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/MohammedShetaya/kayakdb/raft"
 	"github.com/MohammedShetaya/kayakdb/types"
 	"go.uber.org/zap"
+	"slices"
+	"time"
+)
+
+const (
+	// readTimeout bounds how long a read waits for the leader to confirm its leadership and catch up
+	readTimeout = 5 * time.Second
+	// writeTimeout bounds how long a write waits for its entries to be committed
+	writeTimeout = 5 * time.Second
+	// transferTimeout bounds how long the leader tries to bring the target of a leadership transfer up to date
+	transferTimeout = 10 * time.Second
+	// membershipTimeout bounds how long a membership change waits for the previous one and for its own to be committed
+	membershipTimeout = 10 * time.Second
 )
 
 type HandlersController struct {
 	handlers map[string]RequestHandler
 	raft     *raft.Raft
-	ctx      *context.Context
-	logger   *zap.Logger
+	// set when the keyspace is sharded, raft is nil then
+	router Router
+	ctx    *context.Context
+	logger *zap.Logger
+}
+
+// Router maps a key to the raft group of the range that owns it, see shard.Store.
+type Router interface {
+	Route(key types.Type) (*raft.Raft, error)
+}
+
+// keyedPaths are the paths whose requests are served by the raft group that owns their keys.
+var keyedPaths = map[string]bool{
+	"/get": true,
+	"/put": true,
 }
 
 // RequestHandler return a pointer to a Payload that represents the response and an error if any occurred while
@@ -34,6 +61,14 @@ func NewHandlerController(ctx *context.Context, raft *raft.Raft, logger *zap.Log
 	return controller
 }
 
+// NewRoutingHandlerController creates a controller for a sharded keyspace. The requests for keys are served by the
+// raft group the router picks for them, and are redirected to the leader of that group.
+func NewRoutingHandlerController(ctx *context.Context, router Router, logger *zap.Logger) *HandlersController {
+	controller := NewHandlerController(ctx, nil, logger)
+	controller.router = router
+	return controller
+}
+
 func (c *HandlersController) RegisterHandler(path string, handler RequestHandler) {
 	c.handlers[path] = handler
 }
@@ -41,10 +76,15 @@ func (c *HandlersController) RegisterHandler(path string, handler RequestHandler
 func (c *HandlersController) HandleRequest(payload *types.Payload) (*types.Payload, error) {
 	handler, exist := c.handlers[payload.Headers.Path.String()]
 	if !exist {
-		c.logger.Fatal("No Handler for the request path", zap.String("path", payload.Headers.Path.String()))
+		c.logger.Error("No Handler for the request path", zap.String("path", payload.Headers.Path.String()))
+		return nil, fmt.Errorf("no handler for the request path: %v", payload.Headers.Path.String())
 	}
 
-	resp, err := handler(c.raft, c.logger, payload)
+	r, err := c.route(payload)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := handler(r, c.logger, payload)
 	if err != nil {
 		c.logger.Error("Unable to handle Request", zap.Error(err))
 		return nil, err
@@ -53,9 +93,70 @@ func (c *HandlersController) HandleRequest(payload *types.Payload) (*types.Paylo
 	return resp, nil
 }
 
+// route returns the raft group that serves the request. Without a router every request is served by the same group.
+// With one, all the keys of a request have to belong to the same range, so that they are still written together.
+func (c *HandlersController) route(payload *types.Payload) (*raft.Raft, error) {
+	path := payload.Headers.Path.String()
+	if c.router == nil {
+		return c.raft, nil
+	}
+	if !keyedPaths[path] {
+		return nil, fmt.Errorf("%v is not supported when the keyspace is sharded", path)
+	}
+
+	var keys []types.Type
+	for _, data := range payload.Data {
+		if pair, ok := data.(types.KeyValue); ok {
+			keys = append(keys, pair.Key)
+		} else {
+			keys = append(keys, data)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%v requires at least one key in payload data", path)
+	}
+	if path == "/get" {
+		// only the first key is read
+		keys = keys[:1]
+	}
+
+	var group *raft.Raft
+	for _, key := range keys {
+		r, err := c.router.Route(key)
+		if err != nil {
+			return nil, err
+		}
+		if group != nil && r != group {
+			return nil, fmt.Errorf("the keys %v and %v belong to different ranges, write them separately", keys[0], key)
+		}
+		group = r
+	}
+	return group, nil
+}
+
+// ErrorResponse builds the response to a request that failed. Requests that only the leader can serve are redirected
+// to it when it is known.
+func ErrorResponse(err error) *types.Payload {
+	resp := &types.Payload{
+		Headers: types.Headers{Error: types.String(err.Error())},
+	}
+	var notLeader *raft.NotLeaderError
+	if errors.As(err, &notLeader) && notLeader.LeaderAddr != "" {
+		resp.Headers.Redirect = types.String(notLeader.LeaderAddr)
+	}
+	return resp
+}
+
 func (c *HandlersController) RegisterHandlers() error {
 	c.RegisterHandler("/get", GetHandler)
 	c.RegisterHandler("/put", PutHandler)
+	c.RegisterHandler("/cluster/add", AddServerHandler)
+	c.RegisterHandler("/cluster/add-learner", AddLearnerHandler)
+	c.RegisterHandler("/cluster/add-witness", AddWitnessHandler)
+	c.RegisterHandler("/cluster/promote", PromoteLearnerHandler)
+	c.RegisterHandler("/cluster/remove", RemoveServerHandler)
+	c.RegisterHandler("/cluster/members", MembersHandler)
+	c.RegisterHandler("/cluster/transfer-leader", TransferLeaderHandler)
 	return nil
 }
 
@@ -66,8 +167,16 @@ func GetHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*type
 		return nil, fmt.Errorf("get handler requires exactly one key in payload data")
 	}
 
+	consistency, err := raft.ParseReadConsistency(payload.Headers.Consistency.String())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+	defer cancel()
+
 	key := payload.Data[0]
-	value, err := r.Get(key)
+	value, err := r.Get(ctx, key, consistency)
 	if err != nil {
 		return nil, err
 	}
@@ -96,18 +205,146 @@ func GetHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*type
 func PutHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*types.Payload, error) {
 	logger.Debug("Handling request", zap.String("path", payload.Headers.Path.String()))
 
-	// Append the entries to the Raft log
-	entries := r.Put(payload.Data)
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
 
-	// Convert the committed log entries into a response payload that contains only the data field.
-	var data []types.Type
-	for _, entry := range entries {
-		data = append(data, entry.Pair)
+	// Append the pairs to the Raft log as one command and wait until it is committed. A write that timed out or whose leader
+	// stepped down might still be committed
+	if err := r.Put(ctx, payload.Data); err != nil {
+		return nil, fmt.Errorf("write failed: %w", err)
 	}
 
+	// Respond with the committed key-value pairs
 	resp := &types.Payload{
-		Data: data,
+		Data: payload.Data,
 	}
 
 	return resp, nil
 }
+
+// AddServerHandler adds the raft address given in the payload to the cluster and responds with the new membership.
+func AddServerHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*types.Payload, error) {
+	logger.Debug("Handling request", zap.String("path", payload.Headers.Path.String()))
+
+	if len(payload.Data) != 1 {
+		return nil, fmt.Errorf("add server handler requires exactly one address in payload data")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), membershipTimeout)
+	defer cancel()
+
+	if err := r.AddServer(ctx, payload.Data[0].String()); err != nil {
+		return nil, err
+	}
+	return membersPayload(r), nil
+}
+
+// AddLearnerHandler adds the raft address given in the payload to the cluster as a non-voting learner and responds with
+// the new membership.
+func AddLearnerHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*types.Payload, error) {
+	logger.Debug("Handling request", zap.String("path", payload.Headers.Path.String()))
+
+	if len(payload.Data) != 1 {
+		return nil, fmt.Errorf("add learner handler requires exactly one address in payload data")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), membershipTimeout)
+	defer cancel()
+
+	if err := r.AddLearner(ctx, payload.Data[0].String()); err != nil {
+		return nil, err
+	}
+	return membersPayload(r), nil
+}
+
+// AddWitnessHandler adds the raft address given in the payload to the cluster as a witness, which votes but does not
+// store the commands, and responds with the new membership.
+func AddWitnessHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*types.Payload, error) {
+	logger.Debug("Handling request", zap.String("path", payload.Headers.Path.String()))
+
+	if len(payload.Data) != 1 {
+		return nil, fmt.Errorf("add witness handler requires exactly one address in payload data")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), membershipTimeout)
+	defer cancel()
+
+	if err := r.AddWitness(ctx, payload.Data[0].String()); err != nil {
+		return nil, err
+	}
+	return membersPayload(r), nil
+}
+
+// PromoteLearnerHandler makes the learner with the raft address given in the payload a voter and responds with the new
+// membership.
+func PromoteLearnerHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*types.Payload, error) {
+	logger.Debug("Handling request", zap.String("path", payload.Headers.Path.String()))
+
+	if len(payload.Data) != 1 {
+		return nil, fmt.Errorf("promote handler requires exactly one address in payload data")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), membershipTimeout)
+	defer cancel()
+
+	if err := r.PromoteLearner(ctx, payload.Data[0].String()); err != nil {
+		return nil, err
+	}
+	return membersPayload(r), nil
+}
+
+// RemoveServerHandler removes the raft address given in the payload from the cluster and responds with the new membership.
+func RemoveServerHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*types.Payload, error) {
+	logger.Debug("Handling request", zap.String("path", payload.Headers.Path.String()))
+
+	if len(payload.Data) != 1 {
+		return nil, fmt.Errorf("remove server handler requires exactly one address in payload data")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), membershipTimeout)
+	defer cancel()
+
+	if err := r.RemoveServer(ctx, payload.Data[0].String()); err != nil {
+		return nil, err
+	}
+	return membersPayload(r), nil
+}
+
+func MembersHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*types.Payload, error) {
+	logger.Debug("Handling request", zap.String("path", payload.Headers.Path.String()))
+	return membersPayload(r), nil
+}
+
+// TransferLeaderHandler hands the leadership over to the server whose id or raft address is given in the payload and
+// responds with it once it took over.
+func TransferLeaderHandler(r *raft.Raft, logger *zap.Logger, payload *types.Payload) (*types.Payload, error) {
+	logger.Debug("Handling request", zap.String("path", payload.Headers.Path.String()))
+
+	if len(payload.Data) != 1 {
+		return nil, fmt.Errorf("transfer leader handler requires exactly one server id or address in payload data")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+
+	if err := r.TransferLeadership(ctx, payload.Data[0].String()); err != nil {
+		return nil, err
+	}
+	return &types.Payload{Data: []types.Type{payload.Data[0]}}, nil
+}
+
+// membersPayload responds with a pair of raft address and role for every member of the cluster.
+func membersPayload(r *raft.Raft) *types.Payload {
+	learners, witnesses := r.Learners(), r.Witnesses()
+	var data []types.Type
+	for _, member := range r.Members() {
+		role := types.String("voter")
+		if slices.Contains(learners, member) {
+			role = "learner"
+		} else if slices.Contains(witnesses, member) {
+			role = "witness"
+		}
+		data = append(data, types.KeyValue{Key: types.String(member), Value: role})
+	}
+	return &types.Payload{Data: data}
+}
@@ -2,53 +2,120 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/MohammedShetaya/kayakdb/config"
 	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/shard"
 	"github.com/MohammedShetaya/kayakdb/types"
 	"go.uber.org/zap"
 	"io"
 	"net"
+	"sync"
 )
 
 type Server struct {
 	handlersController *HandlersController
 	logger             *zap.Logger
 	config             *config.Configuration
+	raft               *raft.Raft
+	// hosts the ranges when the keyspace is sharded, raft is nil then
+	store *shard.Store
+
+	mutex    sync.Mutex
+	listener net.Listener
+	// the connections whose requests are being served
+	conns    map[net.Conn]struct{}
+	inFlight sync.WaitGroup
+	cancel   context.CancelFunc
+	closed   bool
 }
 
+// ErrServerClosed is returned by Start once the server was shut down.
+var ErrServerClosed = errors.New("the server was shut down")
+
 func NewServer(config *config.Configuration, logger *zap.Logger) *Server {
 	server := new(Server)
 	server.logger = logger
 	server.config = config
+	server.conns = make(map[net.Conn]struct{})
 	return server
 }
 
-func (s *Server) Start() {
+// NewServerWithRaft creates a server that serves the clients of the given raft server instead of creating one from
+// the configuration. The raft server is started and shut down along with the server.
+func NewServerWithRaft(config *config.Configuration, logger *zap.Logger, raft *raft.Raft) *Server {
+	server := NewServer(config, logger)
+	server.raft = raft
+	return server
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer func() {
-		s.logger.Error("Server is Down")
-		// if this function fails then close the whole context
-		cancel()
-	}()
+// NewServerWithStore creates a server that routes the requests of the clients to the ranges of the given store. The
+// store is started and shut down along with the server.
+func NewServerWithStore(config *config.Configuration, logger *zap.Logger, store *shard.Store) *Server {
+	server := NewServer(config, logger)
+	server.store = store
+	return server
+}
+
+// Start serves the clients and starts the raft server. It blocks until the server is shut down and then returns
+// ErrServerClosed, or returns the error that prevented it from serving.
+func (s *Server) Start() error {
 	// initialize the protocol types
 	types.RegisterDataTypes()
 
 	s.logger.Info("Server is starting")
 	listener, err := net.Listen("tcp", ":"+s.config.KayakPort)
 	if err != nil {
-		s.logger.Fatal("Failed to start server", zap.Error(err))
+		return fmt.Errorf("failed to start server: %w", err)
 	}
 
-	defer func() {
-		_ = listener.Close()
-	}()
+	raftLib, store := s.Raft(), s.Store()
+	switch {
+	case s.config.Sharding && store == nil:
+		store, err = shard.NewStore(s.config, s.logger, shard.StoreOptions{})
+		if err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("failed to initialize the ranges: %w", err)
+		}
+	case store == nil && raftLib == nil:
+		raftLib, err = raft.NewRaft(s.config, s.logger)
+		if err != nil {
+			_ = listener.Close()
+			return fmt.Errorf("failed to initialize raft: %w", err)
+		}
+	}
 
-	raftLib := raft.NewRaft(s.config, s.logger)
-	go raftLib.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		cancel()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.raft = raftLib
+	s.store = store
+	s.cancel = cancel
+	s.mutex.Unlock()
 
-	s.handlersController = NewHandlerController(&ctx, raftLib, s.logger)
+	if store != nil {
+		go func() {
+			if err := store.Start(); err != nil {
+				s.logger.Error("Ranges stopped serving", zap.Error(err))
+			}
+		}()
+		s.handlersController = NewRoutingHandlerController(&ctx, store, s.logger)
+	} else {
+		go s.logLeadership(ctx, raftLib.LeaderCh())
+		go func() {
+			if err := raftLib.Start(); err != nil {
+				s.logger.Error("Raft stopped serving", zap.Error(err))
+			}
+		}()
+		s.handlersController = NewHandlerController(&ctx, raftLib, s.logger)
+	}
 
 	s.logger.Info("Server is Listening on",
 		zap.String("port", s.config.KayakPort),
@@ -58,14 +125,139 @@ func (s *Server) Start() {
 
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			s.logger.Error("Unable to Accept connection", zap.Error(err))
+			continue
 		}
 
+		if !s.track(conn) {
+			_ = conn.Close()
+			return ErrServerClosed
+		}
 		// handle connection
-		go s.handleConnection(&ctx, s.logger, conn)
+		go func() {
+			defer s.untrack(conn)
+			s.handleConnection(&ctx, s.logger, conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for the requests that are in flight to be answered, the connections
+// that are still open when the context is done are closed. Then it shuts the raft server, or the ranges, down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	listener, raftLib, store, cancel := s.listener, s.raft, s.store, s.cancel
+	s.mutex.Unlock()
+	s.logger.Info("Server is shutting down")
+
+	var errs []error
+	if listener != nil {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to close the listener: %w", err))
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.closeConnections()
+		errs = append(errs, fmt.Errorf("the requests in flight were not answered: %w", ctx.Err()))
+	}
+	if cancel != nil {
+		cancel()
+	}
+
+	if raftLib != nil {
+		if err := raftLib.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("unable to shut down raft: %w", err))
+		}
+	}
+	if store != nil {
+		if err := store.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("unable to shut down the ranges: %w", err))
+		}
+	}
+	s.logger.Info("Server is Down")
+	return errors.Join(errs...)
+}
+
+// logLeadership logs when this server becomes the leader and when it stops being the leader, until the server is
+// shut down.
+func (s *Server) logLeadership(ctx context.Context, leadership <-chan bool) {
+	for {
+		select {
+		case isLeader := <-leadership:
+			if isLeader {
+				s.logger.Info("This server is now the leader, it serves the writes of the cluster")
+			} else {
+				s.logger.Info("This server is no longer the leader, writes are redirected to the new one")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Raft returns the raft server whose clients this server serves, it is nil until the server started if it was not
+// given one, and when the keyspace is sharded.
+func (s *Server) Raft() *raft.Raft {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.raft
+}
+
+// Store returns the store whose ranges this server serves, it is nil unless the keyspace is sharded.
+func (s *Server) Store() *shard.Store {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store
+}
+
+// track registers a connection that is being served, it reports false if the server was shut down meanwhile.
+func (s *Server) track(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.inFlight.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	s.mutex.Unlock()
+	s.inFlight.Done()
+}
+
+func (s *Server) closeConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
 	}
 }
 
+func (s *Server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
 func (s *Server) handleConnection(ctx *context.Context, logger *zap.Logger, conn net.Conn) {
 	// TODO: connection heartbeats and timeout
 	defer func() {
@@ -86,14 +278,18 @@ func (s *Server) handleConnection(ctx *context.Context, logger *zap.Logger, conn
 		n, err := conn.Read(buffer)
 		if err != nil {
 			if err != io.EOF {
-				logger.Fatal("Error occurred while reading payload types", zap.Error(err))
+				logger.Error("Error occurred while reading payload types", zap.Error(err))
+				return
 			}
 			break
 		}
 		data = append(data, buffer[:n]...)
 
 		if uint32(len(data)*8) > types.MaxPayloadSize {
-			logger.Fatal(fmt.Sprintf("Exceeded maximum payload size of %v", types.MaxPayloadSize))
+			err := fmt.Errorf("exceeded maximum payload size of %v", types.MaxPayloadSize)
+			logger.Error("Rejected request", zap.Error(err))
+			s.respond(logger, conn, ErrorResponse(err))
+			return
 		}
 	}
 
@@ -101,24 +297,31 @@ func (s *Server) handleConnection(ctx *context.Context, logger *zap.Logger, conn
 	err := payload.Deserialize(data)
 
 	if err != nil {
-		logger.Fatal("Failed to deserialize payload", zap.Error(err))
+		logger.Error("Failed to deserialize payload", zap.Error(err))
+		s.respond(logger, conn, ErrorResponse(fmt.Errorf("failed to deserialize payload: %w", err)))
+		return
 	}
 
 	logger.Info("Received Request", zap.String("from", conn.RemoteAddr().String()), zap.String("payload", payload.String()))
 
 	// Handle request > build a response > send it back
-	if resp, e := s.handlersController.HandleRequest(&payload); e != nil {
+	resp, e := s.handlersController.HandleRequest(&payload)
+	if e != nil {
 		logger.Error("Failed to handle client request", zap.Error(e))
-	} else {
-		if resp != nil {
-			b, ee := resp.Serialize()
-			if ee != nil {
-				logger.Error("Failed to serialize response", zap.Error(ee))
-			} else {
-				if _, eee := conn.Write(b); err != nil {
-					logger.Error("Failed to write response to client", zap.Error(eee))
-				}
-			}
-		}
+		resp = ErrorResponse(e)
+	}
+	if resp != nil {
+		s.respond(logger, conn, resp)
+	}
+}
+
+func (s *Server) respond(logger *zap.Logger, conn net.Conn, resp *types.Payload) {
+	b, err := resp.Serialize()
+	if err != nil {
+		logger.Error("Failed to serialize response", zap.Error(err))
+		return
+	}
+	if _, err := conn.Write(b); err != nil {
+		logger.Error("Failed to write response to client", zap.Error(err))
 	}
 }
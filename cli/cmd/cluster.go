@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/cli/ui"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"github.com/spf13/cobra"
+)
+
+// clusterCmd groups the commands that manage the members of the cluster
+var clusterCmd = &cobra.Command{
+	Use:   "cluster",
+	Short: "Manage the members and the leadership of the cluster",
+	Long: `Inspect and change the members of the cluster without restarting it.
+
+Servers are identified by their raft address (host:raft_port). Membership
+changes have to be sent to the current leader and are applied one server
+at a time. For example:
+
+  kayakctl cluster add 10.0.0.4:9090
+  kayakctl cluster remove 10.0.0.2:9090
+  kayakctl cluster members
+
+A new server can first join as a learner, which receives the log but does
+not vote, and be promoted to a voter once it has caught up:
+
+  kayakctl cluster add-learner 10.0.0.5:9090
+  kayakctl cluster promote 10.0.0.5:9090
+
+A witness votes and counts towards the majority but is not sent the
+values, it breaks the tie between two datacenters at little cost:
+
+  kayakctl cluster add-witness 10.0.0.6:9090
+
+Before restarting the leader, move the leadership to another member,
+given by its server id or by its raft address:
+
+  kayakctl cluster transfer-leader 5f0c2a8e-93d4-4c1b-a6f2-0e7d1b9c4a31
+  kayakctl cluster transfer-leader 10.0.0.3:9090`,
+}
+
+var clusterAddCmd = &cobra.Command{
+	Use:   "add <raft address>",
+	Short: "Add a server to the cluster",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		sendClusterRequest("/cluster/add", types.String(args[0]))
+	},
+}
+
+var clusterAddLearnerCmd = &cobra.Command{
+	Use:   "add-learner <raft address>",
+	Short: "Add a server to the cluster as a non-voting learner",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		sendClusterRequest("/cluster/add-learner", types.String(args[0]))
+	},
+}
+
+var clusterAddWitnessCmd = &cobra.Command{
+	Use:   "add-witness <raft address>",
+	Short: "Add a server to the cluster as a witness that votes but stores no values",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		sendClusterRequest("/cluster/add-witness", types.String(args[0]))
+	},
+}
+
+var clusterPromoteCmd = &cobra.Command{
+	Use:   "promote <raft address>",
+	Short: "Promote a learner that has caught up to a voter",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		sendClusterRequest("/cluster/promote", types.String(args[0]))
+	},
+}
+
+var clusterRemoveCmd = &cobra.Command{
+	Use:   "remove <raft address>",
+	Short: "Remove a server from the cluster",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		sendClusterRequest("/cluster/remove", types.String(args[0]))
+	},
+}
+
+var clusterMembersCmd = &cobra.Command{
+	Use:   "members",
+	Short: "List the members of the cluster",
+	Args:  cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		sendClusterRequest("/cluster/members")
+	},
+}
+
+var clusterTransferLeaderCmd = &cobra.Command{
+	Use:   "transfer-leader <server id | raft address>",
+	Short: "Hand the leadership over to another member of the cluster",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		payload := types.Payload{
+			Headers: types.Headers{
+				Path: types.String("/cluster/transfer-leader"),
+			},
+			Data: []types.Type{types.String(args[0])},
+		}
+
+		SendRequest(hostname, port, payload)
+		ui.Success(fmt.Sprintf("Leadership was transferred to %s", args[0])).Print()
+	},
+}
+
+func init() {
+	clusterCmd.AddCommand(clusterAddCmd, clusterAddLearnerCmd, clusterAddWitnessCmd, clusterPromoteCmd, clusterRemoveCmd, clusterMembersCmd, clusterTransferLeaderCmd)
+	rootCmd.AddCommand(clusterCmd)
+}
+
+// sendClusterRequest sends a membership request and prints the members the server responded with.
+func sendClusterRequest(path string, data ...types.Type) {
+	payload := types.Payload{
+		Headers: types.Headers{
+			Path: types.String(path),
+		},
+		Data: data,
+	}
+
+	res := SendRequest(hostname, port, payload)
+
+	var rows [][]string
+	for _, member := range res.Data {
+		kv := member.(types.KeyValue)
+		rows = append(rows, []string{kv.Key.String(), kv.Value.String()})
+	}
+	ui.PrintSimpleTable([]string{"member", "role"}, rows)
+}
@@ -18,6 +18,11 @@ argument. For example:
 
   kayakctl get myKey
 
+By default the read is linearizable. Use --consistency to pick another level:
+  linearizable  The leader confirms its leadership with a majority first
+  lease         The leader serves the read while its lease holds
+  stale         Any server serves the read from its local state
+
 You can also specify the server hostname and port using the global flags:
   -d, --hostname  Set the server hostname (default: "localhost")
   -p, --port      Set the server port (default: "6323")`,
@@ -25,8 +30,11 @@ You can also specify the server hostname and port using the global flags:
 	Run:  commandHandler,
 }
 
+var consistency string
+
 func init() {
 	rootCmd.AddCommand(getCmd)
+	getCmd.Flags().StringVarP(&consistency, "consistency", "c", "linearizable", "Consistency level of the read (linearizable, lease, stale)")
 }
 
 func commandHandler(_ *cobra.Command, args []string) {
@@ -37,7 +45,8 @@ func commandHandler(_ *cobra.Command, args []string) {
 
 	payload := types.Payload{
 		Headers: types.Headers{
-			Path: types.String("/get"),
+			Path:        types.String("/get"),
+			Consistency: types.String(consistency),
 		},
 		Data: []types.Type{
 			key,
@@ -3,18 +3,24 @@ package cmd
 import (
 	"encoding/binary"
 	"fmt"
+	"github.com/MohammedShetaya/kayakdb/api"
 	"github.com/MohammedShetaya/kayakdb/cli/ui"
 	"github.com/MohammedShetaya/kayakdb/types"
-	"io"
+	"go.uber.org/zap"
 	"net"
 	"strconv"
 	"strings"
 )
 
+// SendRequest sends the payload through an api.Client and returns the response. The client follows the redirects to
+// the leader, and the requests that failed are reported as errors.
 func SendRequest(hostname string, port string, payload types.Payload) types.Payload {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", hostname, port))
-	if err != nil {
-		ui.Error("Connection Error", fmt.Sprintf("Failed to connect to server at %s:%s", hostname, port)).
+	res, err := api.NewClient(hostname, port, zap.NewNop()).SendRequest(payload)
+	switch {
+	case err == nil:
+		return *res
+	case res == nil:
+		ui.Error("Connection Error", fmt.Sprintf("Failed to reach the server at %s", net.JoinHostPort(hostname, port))).
 			WithDetails(
 				err.Error(),
 				"Possible solutions:",
@@ -22,53 +28,16 @@ func SendRequest(hostname string, port string, payload types.Payload) types.Payl
 				"  • Verify hostname and port are correct",
 				"  • Check network connectivity",
 			).PrintAndExit()
-	}
-
-	data, err := payload.Serialize()
-	if err != nil {
-		ui.Error("Serialization Error", "Failed to serialize request payload").
-			WithDetails(err.Error()).
+	case res.Headers.Redirect != "":
+		ui.Error("Redirect Error", "The servers did not agree on a leader").
+			WithDetails(err.Error(), "Retry once the cluster elected a leader").
 			PrintAndExit()
-	}
-
-	_, err = conn.Write(data)
-	if err != nil {
-		ui.Error("Network Error", "Failed to send data to server").
-			WithDetails(err.Error()).
+	default:
+		ui.Error("Server Error", "The server failed to handle the request").
+			WithDetails(res.Headers.Error.String()).
 			PrintAndExit()
 	}
-
-	// Signal to the server that we have finished sending the request so it can start processing
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		_ = tcpConn.CloseWrite()
-	}
-
-	var resBuffer []byte
-	buffer := make([]byte, 1024)
-
-	for {
-		n, e := conn.Read(buffer)
-
-		if e != nil {
-			if e != io.EOF {
-				ui.Error("Buffer Error", "Error occurred while reading payload").WithDetails(err.Error()).PrintAndExit()
-			}
-			break
-		}
-		resBuffer = append(resBuffer, buffer[:n]...)
-	}
-
-	var res types.Payload
-	err = res.Deserialize(resBuffer)
-	if err != nil {
-		ui.Error("Deserialization Error", "Failed to deserialize payload").
-			WithDetails(err.Error()).
-			PrintAndExit()
-	}
-
-	_ = conn.Close()
-
-	return res
+	return types.Payload{}
 }
 
 // FormatDataTypeError is a helper function to handle data type conversion errors consistently
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/MohammedShetaya/kayakdb/api"
 	"github.com/MohammedShetaya/kayakdb/config"
 	"github.com/MohammedShetaya/kayakdb/utils"
+	"go.uber.org/zap"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// shutdownTimeout bounds how long the server drains its requests and hands its leadership over once it was told to
+// stop
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	// load configurations
 	c := &config.Configuration{}
@@ -22,6 +32,40 @@ func main() {
 		_ = logger.Sync()
 	}()
 
+	if err := run(c, logger); err != nil {
+		logger.Error("Server stopped with an error", zap.Error(err))
+		_ = logger.Sync()
+		os.Exit(1)
+	}
+}
+
+// run serves until SIGINT or SIGTERM is received, or the server fails, and then shuts the server down.
+func run(c *config.Configuration, logger *zap.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	server := api.NewServer(c, logger)
-	server.Start()
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.Start()
+	}()
+
+	var errs []error
+	select {
+	case err := <-failed:
+		if !errors.Is(err, api.ErrServerClosed) {
+			errs = append(errs, err)
+		}
+	case <-ctx.Done():
+		logger.Info("Received a signal to stop")
+	}
+	// a second signal kills the process
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
 }
@@ -1,13 +1,68 @@
 package config
 
+import "fmt"
+
 type Configuration struct {
-	KayakPort      string   `json:"kayak_port" env:"KAYAK_PORT" default:"8080"`
-	RaftPort       string   `json:"raft_port" env:"RAFT_PORT" default:"9090"`
-	LogLevel       string   `json:"log_level" env:"LOG_LEVEL" default:"info"`
-	MaxLogBatch    uint     `json:"max_log_batch" env:"MAX_LOG_BATCH" default:"50"`
-	WorkerPoolSize uint     `json:"worker_pool_size" env:"WORKER_POOL_SIZE" default:"4"`
-	WaitQueueSize  uint     `json:"wait_queue_size" env:"WAIT_QUEUE_SIZE" default:"1000"`
-	PeerDiscovery  bool     `json:"peer_discovery" env:"PEER_DISCOVERY" default:"false"`
-	ServiceName    string   `json:"service_name" env:"SERVICE_NAME" default:"kayakdb"`
-	SeedPeers      []string `json:"seed_peers"`
+	KayakPort              string   `json:"kayak_port" env:"KAYAK_PORT" default:"8080"`
+	RaftPort               string   `json:"raft_port" env:"RAFT_PORT" default:"9090"`
+	LogLevel               string   `json:"log_level" env:"LOG_LEVEL" default:"info"`
+	MaxLogBatch            uint     `json:"max_log_batch" env:"MAX_LOG_BATCH" default:"50"`
+	MaxLogBatchBytes       uint     `json:"max_log_batch_bytes" env:"MAX_LOG_BATCH_BYTES" default:"1048576"`
+	MaxInflightAppends     uint     `json:"max_inflight_appends" env:"MAX_INFLIGHT_APPENDS" default:"4"`
+	WorkerPoolSize         uint     `json:"worker_pool_size" env:"WORKER_POOL_SIZE" default:"4"`
+	WaitQueueSize          uint     `json:"wait_queue_size" env:"WAIT_QUEUE_SIZE" default:"1000"`
+	PeerDiscovery          bool     `json:"peer_discovery" env:"PEER_DISCOVERY" default:"false"`
+	ServiceName            string   `json:"service_name" env:"SERVICE_NAME" default:"kayakdb"`
+	SeedPeers              []string `json:"seed_peers"`
+	Witnesses              []string `json:"witnesses"`
+	ClusterId              string   `json:"cluster_id" env:"CLUSTER_ID" default:""`
+	AdvertiseHost          string   `json:"advertise_host" env:"ADVERTISE_HOST" default:"127.0.0.1"`
+	StorageDriver          string   `json:"storage_driver" env:"STORAGE_DRIVER" default:"memory"`
+	DataDir                string   `json:"data_dir" env:"DATA_DIR" default:"data"`
+	WalSegmentSize         uint     `json:"wal_segment_size" env:"WAL_SEGMENT_SIZE" default:"67108864"`
+	SnapshotThreshold      uint     `json:"snapshot_threshold" env:"SNAPSHOT_THRESHOLD" default:"10000"`
+	SnapshotThresholdBytes uint     `json:"snapshot_threshold_bytes" env:"SNAPSHOT_THRESHOLD_BYTES" default:"0"`
+	SnapshotChunkSize      uint     `json:"snapshot_chunk_size" env:"SNAPSHOT_CHUNK_SIZE" default:"1048576"`
+	LeaseReads             bool     `json:"lease_reads" env:"LEASE_READS" default:"false"`
+	MaxClockDriftPercent   uint     `json:"max_clock_drift_percent" env:"MAX_CLOCK_DRIFT_PERCENT" default:"10"`
+	PreVote                bool     `json:"pre_vote" env:"PRE_VOTE" default:"true"`
+	CheckQuorum            bool     `json:"check_quorum" env:"CHECK_QUORUM" default:"true"`
+	ElectionTimeoutMin     uint     `json:"election_timeout_min" env:"ELECTION_TIMEOUT_MIN" default:"150"`
+	ElectionTimeoutMax     uint     `json:"election_timeout_max" env:"ELECTION_TIMEOUT_MAX" default:"300"`
+	HeartbeatInterval      uint     `json:"heartbeat_interval" env:"HEARTBEAT_INTERVAL" default:"50"`
+	Sharding               bool     `json:"sharding" env:"SHARDING" default:"false"`
+	RangeSplitBytes        uint     `json:"range_split_bytes" env:"RANGE_SPLIT_BYTES" default:"67108864"`
+	RangeMergeBytes        uint     `json:"range_merge_bytes" env:"RANGE_MERGE_BYTES" default:"16777216"`
+	RangeCheckInterval     uint     `json:"range_check_interval" env:"RANGE_CHECK_INTERVAL" default:"1000"`
+}
+
+// Validate reports the settings that cannot work together.
+func (c *Configuration) Validate() error {
+	if c.ElectionTimeoutMin == 0 {
+		return fmt.Errorf("election_timeout_min must be larger than zero")
+	}
+	if c.ElectionTimeoutMax <= c.ElectionTimeoutMin {
+		return fmt.Errorf("election_timeout_max (%d) must be larger than election_timeout_min (%d)", c.ElectionTimeoutMax, c.ElectionTimeoutMin)
+	}
+	if c.HeartbeatInterval == 0 {
+		return fmt.Errorf("heartbeat_interval must be larger than zero")
+	}
+	// a follower has to miss a few heartbeats in a row before it starts an election
+	if c.HeartbeatInterval*3 > c.ElectionTimeoutMin {
+		return fmt.Errorf("heartbeat_interval (%d) must be at most a third of election_timeout_min (%d)", c.HeartbeatInterval, c.ElectionTimeoutMin)
+	}
+	if c.Sharding {
+		// the splits and merges of the ranges are commands, a witness would never apply them
+		if len(c.Witnesses) > 0 {
+			return fmt.Errorf("witnesses are not supported with sharding")
+		}
+		if c.RangeCheckInterval == 0 {
+			return fmt.Errorf("range_check_interval must be larger than zero")
+		}
+		// two ranges that were merged must not be split again right away
+		if c.RangeMergeBytes*2 >= c.RangeSplitBytes {
+			return fmt.Errorf("range_merge_bytes (%d) must be less than half of range_split_bytes (%d)", c.RangeMergeBytes, c.RangeSplitBytes)
+		}
+	}
+	return nil
 }
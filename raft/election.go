@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/config"
+	"go.uber.org/zap"
+	"time"
+)
+
+// used for the settings a configuration leaves at zero
+const (
+	defaultElectionTimeoutMin = 150 * time.Millisecond
+	defaultElectionTimeoutMax = 300 * time.Millisecond
+	defaultHeartbeatInterval  = 50 * time.Millisecond
+)
+
+type timing struct {
+	// the shortest time a follower waits for the leader before starting an election
+	electionTimeoutMin time.Duration
+	// the longest time a follower waits for the leader before starting an election
+	electionTimeoutMax time.Duration
+	// how often the leader sends the followers the entries they miss, or a heartbeat
+	heartbeatInterval time.Duration
+}
+
+func newTiming(config *config.Configuration) timing {
+	t := timing{
+		electionTimeoutMin: time.Duration(config.ElectionTimeoutMin) * time.Millisecond,
+		electionTimeoutMax: time.Duration(config.ElectionTimeoutMax) * time.Millisecond,
+		heartbeatInterval:  time.Duration(config.HeartbeatInterval) * time.Millisecond,
+	}
+	if t.electionTimeoutMin == 0 {
+		t.electionTimeoutMin = defaultElectionTimeoutMin
+	}
+	if t.electionTimeoutMax == 0 {
+		t.electionTimeoutMax = max(defaultElectionTimeoutMax, t.electionTimeoutMin)
+	}
+	if t.heartbeatInterval == 0 {
+		t.heartbeatInterval = defaultHeartbeatInterval
+	}
+	return t
+}
+
+// electionTimeout returns a random timeout between the minimum and the maximum election timeout.
+func (r *Raft) electionTimeout() time.Duration {
+	timing := r.State.timing
+	if timing.electionTimeoutMax <= timing.electionTimeoutMin {
+		return timing.electionTimeoutMin
+	}
+	r.randomMutex.Lock()
+	defer r.randomMutex.Unlock()
+	return timing.electionTimeoutMin + time.Duration(r.random.Int63n(int64(timing.electionTimeoutMax-timing.electionTimeoutMin)))
+}
+
+// preVote asks the peers whether they would vote for this server in the next term, without incrementing the term.
+// A server that cannot win an election, for example because it was partitioned away from a healthy leader, does
+// not disrupt the cluster with a higher term (section 9.6 of the Raft dissertation).
+func (r *Raft) preVote() bool {
+	lastLogIndex := r.State.Persistent.LastIndex()
+	request := VoteRequest{
+		Term:         r.State.Persistent.GetCurrentTerm() + 1,
+		LastLogIndex: lastLogIndex,
+		LastLogTerm:  r.State.termOfIndex(lastLogIndex),
+		CandidateId:  r.State.ServerId,
+		ClusterId:    r.State.candidateClusterId(),
+	}
+
+	peers := r.State.Voters()
+	signal := make(chan bool, len(peers))
+	for _, p := range peers {
+		go func(peer *Peer) {
+			response := new(VoteResponse)
+			err := r.sendRPC(peer, rpcPreVote, request, response)
+			if err != nil {
+				r.logger.Debug(fmt.Sprintf("PreVote RPC to follower: %v has failed", peer.addr), zap.Error(err))
+			} else if !response.VoteGranted {
+				r.logger.Debug(fmt.Sprintf("PreVote RPC to follower: %v was not granted", peer.addr))
+			}
+			signal <- err == nil && response.VoteGranted
+		}(p)
+	}
+
+	// vote for itself
+	votes := 1
+	timer := r.State.clock.NewTimer(r.State.timing.electionTimeoutMin)
+	defer timer.Stop()
+	for answers := 0; votes < r.State.GetMajority(); answers++ {
+		if answers == len(peers) {
+			return false
+		}
+		select {
+		case granted := <-signal:
+			if granted {
+				votes++
+			}
+		case <-timer.C():
+			return false
+		}
+	}
+	return true
+}
+
+// hasQuorum reports whether the leader heard from a majority of the cluster, itself included, within the maximum
+// election timeout. A leader that did not is likely partitioned away and steps down when CheckQuorum is enabled.
+func (r *Raft) hasQuorum() bool {
+	active := 0
+	if r.State.isVoter(r.State.self) {
+		active++
+	}
+	for _, peer := range r.State.Voters() {
+		if r.State.clock.Now().Sub(time.Unix(0, peer.lastContact.Load())) < r.State.timing.electionTimeoutMax {
+			active++
+		}
+	}
+	return active >= r.State.GetMajority()
+}
@@ -0,0 +1,97 @@
+package raft
+
+import (
+	"context"
+	"github.com/MohammedShetaya/kayakdb/config"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"testing"
+	"time"
+)
+
+func TestElectionTimeout(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ElectionTimeoutMin, cfg.ElectionTimeoutMax, cfg.HeartbeatInterval = 500, 600, 100
+
+	node := newNode(t, cfg, NewInMemoryNetwork().Transport("127.0.0.1:9001"))
+	if interval := node.State.timing.heartbeatInterval; interval != 100*time.Millisecond {
+		t.Errorf("Expected a heartbeat interval of 100ms, got %v", interval)
+	}
+	for i := 0; i < 100; i++ {
+		if timeout := node.electionTimeout(); timeout < 500*time.Millisecond || timeout >= 600*time.Millisecond {
+			t.Fatalf("Expected an election timeout between 500ms and 600ms, got %v", timeout)
+		}
+	}
+
+	// a configuration that was not loaded falls back to the defaults
+	timing := newTiming(&config.Configuration{})
+	if timing.electionTimeoutMin != defaultElectionTimeoutMin || timing.electionTimeoutMax != defaultElectionTimeoutMax ||
+		timing.heartbeatInterval != defaultHeartbeatInterval {
+		t.Errorf("Expected the default timing, got %+v", timing)
+	}
+}
+
+func TestCampaignRunsAPreVote(t *testing.T) {
+	network := NewInMemoryNetwork()
+	// the peer holds an entry of a term this server never saw, it would not vote for it
+	peer, _ := newServingNode(t, network, "9002")
+	for _, term := range []uint{1, 2} {
+		if _, err := peer.State.Persistent.Append(storage.LogEntry{Term: term}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if err := peer.State.Persistent.SetCurrentTerm(2); err != nil {
+		t.Fatalf("Failed to set term: %v", err)
+	}
+	node, _ := newServingNode(t, network, "9001")
+	node.State.setMembership(configuration{members: []string{node.State.self, "127.0.0.1:9002"}}, 0)
+
+	node.campaign()
+	if role, term := node.State.Role(); role != Follower || term != 0 || node.State.Persistent.GetCurrentTerm() != 0 {
+		t.Errorf("Expected a server that cannot win to stay a follower of its term, got a %v of term %d", role, term)
+	}
+
+	node.config.PreVote = false
+	node.campaign()
+	if role, term := node.State.Role(); role != Candidate || term != 1 {
+		t.Errorf("Expected the server to start an election without the pre-vote, got a %v of term %d", role, term)
+	}
+}
+
+func TestCheckQuorum(t *testing.T) {
+	t.Run("a leader has a quorum while a majority was heard from within an election timeout", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		leader := newLeader(t, network, "127.0.0.1:9002")
+		peer := leader.State.peer("127.0.0.1:9002")
+
+		peer.lastContact.Store(leader.State.clock.Now().UnixNano())
+		if !leader.hasQuorum() {
+			t.Errorf("Expected the leader to have a quorum")
+		}
+		peer.lastContact.Store(leader.State.clock.Now().Add(-leader.State.timing.electionTimeoutMax).UnixNano())
+		if leader.hasQuorum() {
+			t.Errorf("Expected the leader to have lost its quorum")
+		}
+	})
+
+	t.Run("a leader cut off from the majority steps down", func(t *testing.T) {
+		leader, servers := startCluster(t, 3)
+		for _, server := range servers {
+			if server == leader {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := server.Shutdown(ctx); err != nil {
+				t.Fatalf("Failed to shut down %v: %v", server.State.ServerId, err)
+			}
+			cancel()
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for leader.State.IsLeader() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if leader.State.IsLeader() {
+			t.Errorf("Expected the leader to step down once it no longer hears from a majority")
+		}
+	})
+}
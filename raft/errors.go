@@ -0,0 +1,48 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotLeader                  = errors.New("this server is not the leader")
+	ErrMembershipChangeInProgress = errors.New("another membership change is not committed yet")
+	// ErrLearnerNotCaughtUp is returned when promoting a learner that does not hold every committed entry yet
+	ErrLearnerNotCaughtUp = errors.New("the learner has not caught up with the leader yet")
+	// ErrWitness is returned for the reads sent to a witness, it does not hold the values of the keys
+	ErrWitness = errors.New("this server is a witness and does not serve reads")
+	// ErrShutdown is returned by the operations that are called while or after the server shuts down
+	ErrShutdown = errors.New("the server is shutting down")
+	// ErrClusterIdMismatch is returned when a server receives a message from a server of another cluster
+	ErrClusterIdMismatch = errors.New("the cluster ids do not match")
+	// ErrLeadershipLost is returned for proposals whose leader stepped down before they were committed. The next
+	// leader might still commit them
+	ErrLeadershipLost = errors.New("leadership was lost before the entries were committed")
+	// ErrCommitTimeout is returned for proposals that were not committed before the deadline. They might still be
+	// committed later
+	ErrCommitTimeout = errors.New("the entries were not committed before the deadline")
+)
+
+// NotLeaderError is returned by the operations that only the leader can serve. It points to the current leader
+// if this server knows it, LeaderAddr is the address clients should retry at.
+type NotLeaderError struct {
+	LeaderId   string
+	LeaderAddr string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderAddr == "" {
+		return fmt.Sprintf("%v, the current leader is unknown", ErrNotLeader)
+	}
+	return fmt.Sprintf("%v, try the leader at %v", ErrNotLeader, e.LeaderAddr)
+}
+
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+func (r *Raft) notLeaderError() error {
+	id, addr := r.State.Leader()
+	return &NotLeaderError{LeaderId: id, LeaderAddr: addr}
+}
@@ -0,0 +1,124 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"sync"
+)
+
+// FSM is the state machine the log is replicated for. Every server applies the same committed entries in the same
+// order, so a deterministic FSM ends up in the same state on all of them.
+type FSM interface {
+	// Apply applies a committed command entry. Configuration entries are handled by the raft server itself. An error
+	// refuses the command, the proposal of the entry fails with it on the leader. Refusals have to be deterministic:
+	// every server refuses the same entries and leaves its state as it was
+	Apply(entry storage.LogEntry) error
+	// Snapshot serializes the current state, it is stored along with the index of the last applied entry
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with the content of a snapshot, an empty snapshot is the initial state
+	Restore(data []byte) error
+}
+
+// KeyValueReader is implemented by the FSMs Raft.Get can read keys from.
+type KeyValueReader interface {
+	Get(key types.Type) (types.Type, error)
+}
+
+// KVOp is the operation of a key-value command.
+type KVOp uint8
+
+const (
+	// KVPut sets the values of the pairs
+	KVPut KVOp = iota
+	// KVDelete removes the keys of the pairs, their values are ignored
+	KVDelete
+)
+
+// KVCommand is the payload of the command entries applied to the KVStore. All of its pairs are applied together.
+type KVCommand struct {
+	Op    KVOp
+	Pairs []types.KeyValue
+}
+
+// EncodeKVCommand serializes the command into the data of a log entry.
+func EncodeKVCommand(command KVCommand) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(command); err != nil {
+		return nil, fmt.Errorf("unable to encode command: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// DecodeKVCommand deserializes the data of a log entry written by EncodeKVCommand.
+func DecodeKVCommand(data []byte) (KVCommand, error) {
+	var command KVCommand
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&command); err != nil {
+		return command, fmt.Errorf("unable to decode command: %w", err)
+	}
+	return command, nil
+}
+
+// KVStore is the default FSM, a map of the key-value pairs of the command entries.
+// TODO: use swap and disk (lru based)
+type KVStore struct {
+	mutex sync.RWMutex
+	state map[string]types.Type
+}
+
+func NewKVStore() *KVStore {
+	return &KVStore{state: make(map[string]types.Type)}
+}
+
+// Apply applies a KVCommand. Entries that do not carry one were not proposed for this store and are skipped.
+func (kv *KVStore) Apply(entry storage.LogEntry) error {
+	command, err := DecodeKVCommand(entry.Data)
+	if err != nil {
+		return nil
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	for _, pair := range command.Pairs {
+		key := string(pair.Key.Bytes())
+		switch command.Op {
+		case KVPut:
+			kv.state[key] = pair.Value
+		case KVDelete:
+			delete(kv.state, key)
+		}
+	}
+	return nil
+}
+
+// Get returns the value of the key, or nil if it was never written.
+func (kv *KVStore) Get(key types.Type) (types.Type, error) {
+	// TODO: after implementing swapping make sure to retrieve cold values
+	kv.mutex.RLock()
+	defer kv.mutex.RUnlock()
+	return kv.state[string(key.Bytes())], nil
+}
+
+func (kv *KVStore) Snapshot() ([]byte, error) {
+	kv.mutex.RLock()
+	defer kv.mutex.RUnlock()
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(kv.state); err != nil {
+		return nil, fmt.Errorf("unable to encode state: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (kv *KVStore) Restore(data []byte) error {
+	state := make(map[string]types.Type)
+	if len(data) > 0 {
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+			return fmt.Errorf("unable to decode state: %w", err)
+		}
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.state = state
+	return nil
+}
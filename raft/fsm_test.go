@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+)
+
+// counter is an FSM that counts the command entries applied to it.
+type counter struct {
+	applied int
+}
+
+func (c *counter) Apply(storage.LogEntry) error {
+	c.applied++
+	return nil
+}
+
+func (c *counter) Snapshot() ([]byte, error) {
+	return []byte(strconv.Itoa(c.applied)), nil
+}
+
+func (c *counter) Restore(data []byte) error {
+	if len(data) == 0 {
+		c.applied = 0
+		return nil
+	}
+	applied, err := strconv.Atoi(string(data))
+	c.applied = applied
+	return err
+}
+
+func TestFSM(t *testing.T) {
+	types.RegisterDataTypes()
+	put, err := EncodeKVCommand(KVCommand{Op: KVPut, Pairs: []types.KeyValue{{Key: types.String("key"), Value: types.String("value")}}})
+	if err != nil {
+		t.Fatalf("Failed to encode command: %v", err)
+	}
+	command := storage.LogEntry{Term: 1, Data: put}
+
+	t.Run("a restarting server restores the snapshot and applies the commands that follow it once committed", func(t *testing.T) {
+		driver := storage.NewInMemoryDriver()
+		for i := 0; i < 3; i++ {
+			if _, err := driver.Append(command); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		if _, err := driver.Append(storage.LogEntry{Term: 1, Type: storage.EntryConfiguration, Members: []string{"a"}}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		if err := driver.SaveSnapshot(&storage.Snapshot{LastIncludedIndex: 2, LastIncludedTerm: 1, Data: []byte("2")}); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+
+		fsm := &counter{}
+		state, err := NewState(driver, fsm)
+		if err != nil {
+			t.Fatalf("Failed to create state: %v", err)
+		}
+		// the entries after the snapshot might be replaced by the next leader, they are not applied yet
+		if fsm.applied != 2 || state.LastApplied() != 2 {
+			t.Errorf("Expected the snapshot of 2 commands only, got %d commands applied up to %d", fsm.applied, state.LastApplied())
+		}
+
+		state.commitUpTo(4)
+		state.ApplyNewEntries()
+		if fsm.applied != 3 {
+			t.Errorf("Expected 3 applied commands, got %d", fsm.applied)
+		}
+		if state.LastApplied() != 4 {
+			t.Errorf("Expected the last applied index to be 4, got %d", state.LastApplied())
+		}
+	})
+
+	t.Run("the membership outlives the configuration entry the snapshot compacted", func(t *testing.T) {
+		driver := storage.NewInMemoryDriver()
+		if _, err := driver.Append(storage.LogEntry{Term: 1, Type: storage.EntryConfiguration, Members: []string{"a", "b"}}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		if _, err := driver.Append(command); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		state, err := NewState(driver, &counter{})
+		if err != nil {
+			t.Fatalf("Failed to create state: %v", err)
+		}
+		state.commitUpTo(2)
+		state.ApplyNewEntries()
+		if err = state.TakeSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+
+		if c, index := state.membershipAt(driver.LastIndex()); len(c.members) != 2 || index != 2 {
+			t.Errorf("Expected the members of the snapshot at index 2, got %v at %d", c.members, index)
+		}
+	})
+
+	t.Run("the key-value store applies puts and deletes", func(t *testing.T) {
+		remove, err := EncodeKVCommand(KVCommand{Op: KVDelete, Pairs: []types.KeyValue{{Key: types.String("key")}}})
+		if err != nil {
+			t.Fatalf("Failed to encode command: %v", err)
+		}
+		store := NewKVStore()
+		store.Apply(command)
+		if value, _ := store.Get(types.String("key")); value == nil || value.String() != "value" {
+			t.Errorf("Expected the value to be put, got %v", value)
+		}
+		store.Apply(storage.LogEntry{Term: 1, Data: remove})
+		if value, _ := store.Get(types.String("key")); value != nil {
+			t.Errorf("Expected the key to be deleted, got %v", value)
+		}
+	})
+
+	t.Run("the key-value store is restored from its snapshot", func(t *testing.T) {
+		store := NewKVStore()
+		store.Apply(command)
+		data, err := store.Snapshot()
+		if err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+
+		restored := NewKVStore()
+		if err = restored.Restore(data); err != nil {
+			t.Fatalf("Failed to restore snapshot: %v", err)
+		}
+		if value, _ := restored.Get(types.String("key")); value == nil || value.String() != "value" {
+			t.Errorf("Expected the restored value, got %v", value)
+		}
+		if err = restored.Restore(nil); err != nil {
+			t.Fatalf("Failed to restore an empty snapshot: %v", err)
+		}
+		if value, _ := restored.Get(types.String("key")); value != nil {
+			t.Errorf("Expected an empty snapshot to clear the store, got %v", value)
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/config"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"github.com/MohammedShetaya/kayakdb/utils"
+	"go.uber.org/zap"
+)
+
+// testConfig returns the default configuration, the tests change it before creating their servers with it.
+func testConfig(tb testing.TB) *config.Configuration {
+	tb.Helper()
+	result, err := utils.LoadConfigurations(&config.Configuration{})
+	if err != nil {
+		tb.Fatalf("Failed to load configurations: %v", err)
+	}
+	return result.(*config.Configuration)
+}
+
+// newNode creates a server that sends its RPCs through transport, without starting it.
+func newNode(tb testing.TB, cfg *config.Configuration, transport Transport) *Raft {
+	tb.Helper()
+	node, err := NewRaftWithOptions(cfg, zap.NewNop(), Options{Transport: transport})
+	if err != nil {
+		tb.Fatalf("Failed to create node: %v", err)
+	}
+	return node
+}
+
+// serve answers the RPCs the transport receives with the node until the end of the test, the election timer of the
+// node is not started.
+func serve(tb testing.TB, node *Raft, transport Transport) *Raft {
+	go func() {
+		_ = transport.Serve(NewRpcController(node, zap.NewNop()))
+	}()
+	tb.Cleanup(func() {
+		_ = transport.Close()
+	})
+	return node
+}
+
+// newServingNode creates a server on the network that answers RPCs but does not start its election timer.
+func newServingNode(t *testing.T, network *InMemoryNetwork, port string) (*Raft, *InMemoryTransport) {
+	cfg := testConfig(t)
+	cfg.RaftPort = port
+	transport := network.Transport("127.0.0.1:" + port)
+	return serve(t, newNode(t, cfg, transport), transport), transport
+}
+
+// newFollower creates a server whose log holds entries of the given terms, without starting it.
+func newFollower(t *testing.T, terms ...uint) *Raft {
+	node := newNode(t, testConfig(t), NewInMemoryNetwork().Transport("127.0.0.1:9001"))
+	for _, term := range terms {
+		if _, err := node.State.Persistent.Append(storage.LogEntry{Term: term}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if err := node.State.Persistent.SetCurrentTerm(terms[len(terms)-1]); err != nil {
+		t.Fatalf("Failed to set term: %v", err)
+	}
+	return node
+}
+
+// newLeader makes a server on the network the leader of term 1 of a cluster it forms with the server listening on
+// peer, without starting it. Its log holds one committed entry of the term.
+func newLeader(t *testing.T, network *InMemoryNetwork, peer string) *Raft {
+	types.RegisterDataTypes()
+	leader, _ := newServingNode(t, network, "9001")
+	leader.config.LeaseReads = true
+	leader.State.setMembership(configuration{members: []string{leader.State.self, peer}}, 0)
+	if _, err := leader.State.Persistent.Append(storage.LogEntry{Term: 1}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if err := leader.State.Persistent.SetCurrentTerm(1); err != nil {
+		t.Fatalf("Failed to set term: %v", err)
+	}
+	leader.State.commitUpTo(1)
+	leader.State.ApplyNewEntries()
+	leader.State.setRole(Leader, 1)
+	leader.State.setLeader(leader.State.ServerId, "")
+	return leader
+}
+
+// startCluster starts size servers on an in-memory network and returns the one that was elected leader, along with
+// all the servers.
+func startCluster(tb testing.TB, size int) (*Raft, []*Raft) {
+	types.RegisterDataTypes()
+	network := NewInMemoryNetwork()
+
+	var addrs []string
+	for i := 0; i < size; i++ {
+		addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", 9001+i))
+	}
+	var servers []*Raft
+	for i, addr := range addrs {
+		cfg := testConfig(tb)
+		cfg.RaftPort = fmt.Sprint(9001 + i)
+		for _, peer := range addrs {
+			if peer != addr {
+				cfg.SeedPeers = append(cfg.SeedPeers, peer)
+			}
+		}
+
+		server := newNode(tb, cfg, network.Transport(addr))
+		servers = append(servers, server)
+		go server.Start()
+		tb.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				tb.Errorf("Failed to shut down %v: %v", addr, err)
+			}
+		})
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, server := range servers {
+			if isLeader, _ := server.State.Leadership(); isLeader && followedBy(server, servers) {
+				return server, servers
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tb.Fatalf("No leader was elected")
+	return nil, nil
+}
+
+// followedBy reports whether every server knows leader as the current leader, the elections that all the servers
+// start when they boot are over by then.
+func followedBy(leader *Raft, servers []*Raft) bool {
+	for _, server := range servers {
+		if id, _ := server.State.Leader(); id != leader.State.ServerId {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package raft
+
+import (
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	guuid "github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Every server keeps the id it got on its first boot, so that its votes and its log still belong to it after a
+// restart. It also keeps the id of the cluster it belongs to and rejects the messages of servers from another
+// cluster, two clusters never merge because one of them was given the address of the other by mistake.
+// The cluster id is either configured, or generated by the first leader of the cluster. The leader writes it to the
+// log with a configuration entry and the servers adopt it once that entry is committed, so a leader that crashes
+// before its id was committed does not leave the cluster with two ids. A server that does not know it yet joins the
+// cluster of the first leader it hears from. Once a server belongs to a cluster it refuses the vote requests that do
+// not carry its id, so a server that lost its identity cannot be elected by it. The identity is kept by the storage
+// driver: with the memory driver a restarted server is a new server that joins the cluster again.
+
+// loadIdentity reads the identity of the server from its storage, and persists a new one on the first boot.
+// clusterId is the configured cluster id, it has to match the one the server was created with.
+func (s *State) loadIdentity(clusterId string) error {
+	identity := s.Persistent.GetIdentity()
+	if clusterId != "" && identity.ClusterId != "" && clusterId != identity.ClusterId {
+		return fmt.Errorf("%w: the data belongs to cluster %v but cluster %v is configured", ErrClusterIdMismatch, identity.ClusterId, clusterId)
+	}
+
+	changed := false
+	if identity.ServerId == "" {
+		identity.ServerId = guuid.NewString()
+		changed = true
+	}
+	if identity.ClusterId == "" && clusterId != "" {
+		identity.ClusterId = clusterId
+		changed = true
+	}
+	if changed {
+		if err := s.Persistent.SetIdentity(identity); err != nil {
+			return fmt.Errorf("unable to persist the identity of the server: %w", err)
+		}
+	}
+
+	s.ServerId = identity.ServerId
+	s.clusterId = identity.ClusterId
+	return nil
+}
+
+// nameCluster proposes a configuration entry that holds a new cluster id and the current members. Only the first
+// of these entries to be committed names the cluster, the servers that already belong to a cluster ignore the others.
+// A proposal that fails is proposed again by the next leader whose cluster is not named yet.
+func (r *Raft) nameCluster() {
+	c, _ := r.State.membership()
+	entry := storage.LogEntry{
+		Type:      storage.EntryConfiguration,
+		Members:   c.members,
+		Learners:  c.learners,
+		Witnesses: c.witnesses,
+		ClusterId: guuid.NewString(),
+	}
+	r.logger.Info("Naming the cluster", zap.String("cluster_id", entry.ClusterId))
+	proposal := r.propose([]storage.LogEntry{entry})
+	r.spawn(func() {
+		select {
+		case <-proposal.Done():
+			if err := proposal.Err(); err != nil {
+				r.logger.Warn("Unable to name the cluster, retrying once this server leads again", zap.Error(err))
+			}
+		case <-r.done:
+		}
+	})
+}
+
+// ClusterId returns the id of the cluster this server belongs to, it is empty until the server joined one.
+func (s *State) ClusterId() string {
+	s.identityMutex.RLock()
+	defer s.identityMutex.RUnlock()
+	return s.clusterId
+}
+
+// candidateClusterId returns the cluster id the vote requests of this server carry: its own, or the one of the first
+// entry of its log that names a cluster while it does not know that entry is committed yet. The entry that named the
+// cluster precedes the other naming entries in the log of every server that holds it, so such a candidate is not
+// refused by the servers that already adopted the id.
+func (s *State) candidateClusterId() string {
+	if id := s.ClusterId(); id != "" {
+		return id
+	}
+	for idx := s.LastApplied() + 1; idx <= s.Persistent.LastIndex(); idx++ {
+		if entry := s.Persistent.GetEntryOfIndex(idx); entry != nil && entry.Type == storage.EntryConfiguration && entry.ClusterId != "" {
+			return entry.ClusterId
+		}
+	}
+	return ""
+}
+
+// checkCluster rejects a message sent by a server of another cluster. When join is set the message is sent by a
+// leader: a server that does not belong to a cluster yet persists clusterId as its own and reports that it joined
+// it. A leader without an id is accepted, it was elected with the votes of the servers of the cluster and waits for
+// the entry that named it to be committed. Any other message without an id is rejected by a server that belongs to
+// a cluster.
+func (s *State) checkCluster(clusterId string, join bool) (bool, error) {
+	s.identityMutex.Lock()
+	defer s.identityMutex.Unlock()
+	if clusterId == s.clusterId || (clusterId == "" && join) {
+		return false, nil
+	}
+	if clusterId == "" {
+		return false, fmt.Errorf("%w: the message is from a server of no cluster but this server belongs to cluster %v", ErrClusterIdMismatch, s.clusterId)
+	}
+	if s.clusterId != "" {
+		return false, fmt.Errorf("%w: the message is from cluster %v but this server belongs to cluster %v", ErrClusterIdMismatch, clusterId, s.clusterId)
+	}
+	if !join {
+		return false, nil
+	}
+	err := s.Persistent.SetIdentity(storage.Identity{ServerId: s.ServerId, ClusterId: clusterId})
+	if err != nil {
+		return false, fmt.Errorf("unable to persist the cluster id: %w", err)
+	}
+	s.clusterId = clusterId
+	return true, nil
+}
+
+// checkCluster rejects a message sent by a server of another cluster. A message of the leader makes a server that
+// does not belong to a cluster yet join the one of the leader.
+func (c *RpcController) checkCluster(clusterId string, fromLeader bool) error {
+	joined, err := c.raft.State.checkCluster(clusterId, fromLeader)
+	if joined {
+		c.logger.Info("Joined the cluster of the leader", zap.String("cluster_id", clusterId))
+	}
+	return err
+}
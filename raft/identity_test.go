@@ -0,0 +1,136 @@
+package raft
+
+import (
+	"errors"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestIdentitySurvivesRestart(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ClusterId = "cluster-a"
+	driver := storage.NewInMemoryDriver()
+	network := NewInMemoryNetwork()
+
+	first, err := NewRaftWithOptions(cfg, zap.NewNop(), Options{Transport: network.Transport("127.0.0.1:9001"), Driver: driver})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	second, err := NewRaftWithOptions(cfg, zap.NewNop(), Options{Transport: network.Transport("127.0.0.1:9002"), Driver: driver})
+	if err != nil {
+		t.Fatalf("Failed to restart server: %v", err)
+	}
+	if first.State.ServerId == "" || first.State.ServerId != second.State.ServerId {
+		t.Errorf("Expected the server id to survive a restart, got %q and %q", first.State.ServerId, second.State.ServerId)
+	}
+	if id := second.State.ClusterId(); id != "cluster-a" {
+		t.Errorf("Expected cluster id cluster-a, got %q", id)
+	}
+
+	cfg.ClusterId = "cluster-b"
+	_, err = NewRaftWithOptions(cfg, zap.NewNop(), Options{Transport: network.Transport("127.0.0.1:9003"), Driver: driver})
+	if !errors.Is(err, ErrClusterIdMismatch) {
+		t.Errorf("Expected a server of another cluster to fail with %v, got %v", ErrClusterIdMismatch, err)
+	}
+}
+
+func TestRejectMessagesOfAnotherCluster(t *testing.T) {
+	node := newFollower(t, 1)
+	controller := NewRpcController(node, zap.NewNop())
+
+	// a server that does not belong to a cluster yet does not join the one of a candidate
+	vote := VoteRequest{Term: 2, LastLogIndex: 1, LastLogTerm: 1, CandidateId: "a", ClusterId: "cluster-a"}
+	response := new(VoteResponse)
+	if err := controller.PreVote(vote, response); err != nil || !response.VoteGranted {
+		t.Fatalf("Expected the pre-vote to be granted, got %+v and %v", *response, err)
+	}
+	if id := node.State.ClusterId(); id != "" {
+		t.Fatalf("Expected no cluster id after a vote request, got %q", id)
+	}
+
+	// but it joins the one of the leader
+	request := AppendRequest{Term: 2, LeaderId: "a", PrevLogIndex: 1, PreLogTerm: 1, ClusterId: "cluster-a"}
+	if err := controller.Append(request, new(AppendResponse)); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if id := node.State.ClusterId(); id != "cluster-a" {
+		t.Fatalf("Expected to join cluster-a, got %q", id)
+	}
+	if id := node.State.Persistent.GetIdentity().ClusterId; id != "cluster-a" {
+		t.Errorf("Expected the cluster id to be persisted, got %q", id)
+	}
+
+	request.Term, request.ClusterId = 3, "cluster-b"
+	if err := controller.Append(request, new(AppendResponse)); !errors.Is(err, ErrClusterIdMismatch) {
+		t.Errorf("Expected an append of another cluster to fail with %v, got %v", ErrClusterIdMismatch, err)
+	}
+	vote.Term, vote.ClusterId = 3, "cluster-b"
+	if err := controller.Vote(vote, new(VoteResponse)); !errors.Is(err, ErrClusterIdMismatch) {
+		t.Errorf("Expected a vote of another cluster to fail with %v, got %v", ErrClusterIdMismatch, err)
+	}
+	if term := node.State.Persistent.GetCurrentTerm(); term != 2 {
+		t.Errorf("Expected the term of another cluster to be ignored, got term %v", term)
+	}
+
+	// a server that lost its identity is not elected by the servers of the cluster
+	vote.ClusterId = ""
+	if err := controller.PreVote(vote, new(VoteResponse)); !errors.Is(err, ErrClusterIdMismatch) {
+		t.Errorf("Expected a pre-vote without a cluster id to fail with %v, got %v", ErrClusterIdMismatch, err)
+	}
+	if err := controller.Vote(vote, new(VoteResponse)); !errors.Is(err, ErrClusterIdMismatch) {
+		t.Errorf("Expected a vote without a cluster id to fail with %v, got %v", ErrClusterIdMismatch, err)
+	}
+	// but a leader that does not know yet that the entry naming the cluster is committed is followed
+	request.Term, request.ClusterId = 2, ""
+	if err := controller.Append(request, new(AppendResponse)); err != nil {
+		t.Errorf("Expected an append of a leader without a cluster id to be accepted, got %v", err)
+	}
+}
+
+func TestCandidateClusterId(t *testing.T) {
+	node := newFollower(t, 1)
+	if id := node.State.candidateClusterId(); id != "" {
+		t.Errorf("Expected no cluster id, got %q", id)
+	}
+
+	// the entry that names the cluster is not known to be committed
+	entries := []storage.LogEntry{
+		{Term: 1, Type: storage.EntryConfiguration, ClusterId: "cluster-a"},
+		{Term: 1, Type: storage.EntryConfiguration, ClusterId: "cluster-b"},
+	}
+	for _, entry := range entries {
+		if _, err := node.State.Persistent.Append(entry); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	if id := node.State.candidateClusterId(); id != "cluster-a" {
+		t.Errorf("Expected the vote requests to carry the id of the first naming entry, got %q", id)
+	}
+	if id := node.State.ClusterId(); id != "" {
+		t.Errorf("Expected the id not to be adopted before its entry is committed, got %q", id)
+	}
+}
+
+func TestFirstLeaderNamesTheCluster(t *testing.T) {
+	leader, servers := startCluster(t, 3)
+
+	// the id is adopted once the entry holding it is committed
+	deadline := time.Now().Add(5 * time.Second)
+	for leader.State.ClusterId() == "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the leader to name the cluster")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	id := leader.State.ClusterId()
+	for _, server := range servers {
+		for server.State.ClusterId() != id {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %v to join cluster %v, got %q", server.State.self, id, server.State.ClusterId())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
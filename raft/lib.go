@@ -1,17 +1,19 @@
 package raft
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/MohammedShetaya/kayakdb/config"
 	"github.com/MohammedShetaya/kayakdb/raft/storage"
 	"github.com/MohammedShetaya/kayakdb/types"
 	"github.com/MohammedShetaya/kayakdb/utils"
-	guuid "github.com/google/uuid"
 	"go.uber.org/zap"
 	"math/rand"
-	"net"
 	"net/rpc"
 	"reflect"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -21,16 +23,112 @@ type Raft struct {
 	config     *config.Configuration
 	State      *State
 	workerPool utils.WorkerPool
+	transport  Transport
+	// the address clients reach this server at
+	apiAddr string
+	// serializes membership changes on the leader
+	membershipMutex sync.Mutex
+	// lets the leader serve lease reads without a heartbeat round
+	lease lease
+	// set on the leader while it hands the leadership over, proposals are rejected meanwhile
+	transferring atomic.Bool
+	// the proposals waiting to be committed on the leader
+	proposals proposals
+	// serializes applying committed entries to the state machine
+	applyMutex sync.Mutex
+	// notified whenever entries were applied to the state machine
+	applied signal
+	// serializes advancing the commit index on the leader
+	commitMutex sync.Mutex
+	// serializes the append requests received from the leader
+	appendMutex sync.Mutex
+	// wakes the event loop up when a newer term was seen or a leader was heard from
+	events chan struct{}
+	// asks the event loop to start an election right away, on request of the leader whose id it receives
+	timeoutNow chan string
+	// asks the event loop of the leader to step down
+	stepDown chan struct{}
+	// set by the event loop to the id of the leader that asked for the next election to transfer its leadership
+	transferFrom string
+	// randomizes the election timeouts
+	random      *rand.Rand
+	randomMutex sync.Mutex
+
+	// set once Shutdown was called, proposals are rejected from then on
+	stopping atomic.Bool
+	// closed when the background goroutines have to return
+	done chan struct{}
+	// the background goroutines Shutdown waits for, none is started once routinesClosed is set
+	routines       sync.WaitGroup
+	routinesMutex  sync.RWMutex
+	routinesClosed bool
+	// the RPC handlers hold it for reading, no handler runs once rpcClosed is set
+	rpcGate   sync.RWMutex
+	rpcClosed bool
 }
 
-func NewRaft(config *config.Configuration, logger *zap.Logger) *Raft {
+// Options replaces the dependencies NewRaft builds from the configuration, the zero value of a field keeps the default.
+type Options struct {
+	// Transport defaults to TCP on the raft port
+	Transport Transport
+	// Driver defaults to the storage driver selected in the configuration
+	Driver storage.Driver
+	// Clock defaults to the system clock
+	Clock Clock
+	// Seed seeds the randomized election timeouts, 0 picks a random seed
+	Seed int64
+	// FSM defaults to a key-value store of the command entries
+	FSM FSM
+}
+
+// NewRaft creates a server that talks to its peers over TCP on the raft port.
+func NewRaft(config *config.Configuration, logger *zap.Logger) (*Raft, error) {
+	return NewRaftWithOptions(config, logger, Options{})
+}
+
+// NewRaftWithOptions creates a server with some of its dependencies replaced, for example to run a cluster inside
+// a single process.
+func NewRaftWithOptions(config *config.Configuration, logger *zap.Logger, options Options) (*Raft, error) {
+	if options.Transport == nil {
+		options.Transport = NewTCPTransport(":"+config.RaftPort, logger)
+	}
+	if options.Seed == 0 {
+		options.Seed = time.Now().UnixNano()
+	}
+	if options.FSM == nil {
+		options.FSM = NewKVStore()
+	}
+	transport := options.Transport
+
 	raft := Raft{
 		logger:     logger,
 		config:     config,
 		workerPool: utils.NewWorkerPool(config.WorkerPoolSize, config.WaitQueueSize),
+		transport:  transport,
+		random:     rand.New(rand.NewSource(options.Seed)),
+		done:       make(chan struct{}),
+		events:     make(chan struct{}, 1),
+		timeoutNow: make(chan string, 1),
+		stepDown:   make(chan struct{}, 1),
 	}
 
-	raft.State = NewState(storage.NewInMemoryDriver())
+	var err error
+	driver := options.Driver
+	if driver == nil {
+		driver, err = newStorageDriver(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	raft.State, err = NewState(driver, options.FSM)
+	if err != nil {
+		_ = driver.Close()
+		return nil, err
+	}
+	if options.Clock != nil {
+		raft.State.clock = options.Clock
+	}
+	raft.State.timing = newTiming(config)
 
 	var p []string
 	if raft.config.PeerDiscovery {
@@ -38,270 +136,384 @@ func NewRaft(config *config.Configuration, logger *zap.Logger) *Raft {
 	} else {
 		p = raft.config.SeedPeers
 	}
-	raft.State.peers = make([]Peer, len(p))
-	for i, addr := range p {
-		raft.State.peers[i] = Peer{
-			addr: addr,
+	// until a configuration entry is written the cluster is made of this server and the seed peers
+	raft.State.self = fmt.Sprintf("%v:%v", raft.config.AdvertiseHost, raft.config.RaftPort)
+	raft.apiAddr = fmt.Sprintf("%v:%v", raft.config.AdvertiseHost, raft.config.KayakPort)
+	raft.State.transport = transport
+	bootstrap := configuration{members: []string{raft.State.self}}
+	for _, addr := range p {
+		if !slices.Contains(bootstrap.members, addr) {
+			bootstrap.members = append(bootstrap.members, addr)
+		}
+	}
+	// the witnesses are picked among this server and the seed peers, the same list is given to every server
+	for _, addr := range raft.config.Witnesses {
+		if slices.Contains(bootstrap.members, addr) && !slices.Contains(bootstrap.witnesses, addr) {
+			bootstrap.witnesses = append(bootstrap.witnesses, addr)
 		}
 	}
+	if bootstrap.electable() == 0 {
+		_ = driver.Close()
+		return nil, fmt.Errorf("every server of the cluster is a witness, none of them can become the leader")
+	}
+	raft.State.bootstrap = bootstrap
+	raft.State.reloadMembership()
 
-	raft.State.ServerId = guuid.NewString()
-	raft.State.FollowerTimer = time.NewTimer(time.Duration(rand.Intn(150)+150) * time.Millisecond)
-	return &raft
+	if err = raft.State.loadIdentity(config.ClusterId); err != nil {
+		_ = driver.Close()
+		return nil, err
+	}
+	raft.State.FollowerTimer = raft.State.clock.NewTimer(raft.electionTimeout())
+	return &raft, nil
 }
 
-func (r *Raft) Start() {
-	listener, err := net.Listen("tcp", ":"+r.config.RaftPort)
-	defer listener.Close()
-
-	if err != nil {
-		r.logger.Fatal("Failed to start background server", zap.Error(err))
+// newStorageDriver creates the storage driver selected in the configuration.
+func newStorageDriver(config *config.Configuration) (storage.Driver, error) {
+	switch config.StorageDriver {
+	case "", "memory":
+		return storage.NewInMemoryDriver(), nil
+	case "file":
+		driver, err := storage.NewFileDriver(config.DataDir, config.WalSegmentSize)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open storage in %s: %w", config.DataDir, err)
+		}
+		return driver, nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %v", config.StorageDriver)
 	}
+}
 
-	r.logger.Info(fmt.Sprintf("Raft Server is listening on port: %v", r.config.RaftPort))
-
+// Start serves the RPCs of the other servers and takes part in the elections. It blocks until the server is shut
+// down, or returns the error that prevented it from serving.
+func (r *Raft) Start() error {
+	if r.stopping.Load() {
+		return ErrShutdown
+	}
+	r.logger.Info("Starting raft", zap.String("server_id", r.State.ServerId), zap.String("cluster_id", r.State.ClusterId()))
 	r.workerPool.Start()
 
 	r.logger.Info("Worker Pool has started")
 
 	rpcController := NewRpcController(r, r.logger)
-	err = rpc.Register(rpcController)
-	if err != nil {
-		r.logger.Info("Failed to register rpc controller", zap.Error(err))
-		return
-	}
 
-	go r.registerNode()
+	r.spawn(r.run)
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			r.logger.Warn("Error accept connection from remote server", zap.Error(err))
-			continue
-		}
-		go rpc.ServeConn(conn)
+	if err := r.transport.Serve(rpcController); err != nil {
+		return fmt.Errorf("unable to serve the raft rpcs: %w", err)
 	}
+	return nil
 }
 
-func (r *Raft) registerNode() {
+// run is the event loop of the server. It owns the role of the server: the elections are run and the role changes
+// are made from it only, the other goroutines wake it up when they saw a newer term.
+func (r *Raft) run() {
+	// if the server just started try to start an election instead of looking who is the current leader.
+	// a server that is not part of the configuration waits to be added by the leader instead, a learner waits to be
+	// promoted and a witness never stands for election.
+	r.State.FollowerTimer.Reset(r.electionTimeout())
+	if r.State.isElectable(r.State.self) {
+		r.campaign()
+	}
 
-	r.State.peers = make([]Peer, len(r.config.SeedPeers))
-	for i, addr := range r.config.SeedPeers {
-		r.State.peers[i] = Peer{
-			addr: addr,
+	for r.running() {
+		switch role, term := r.State.Role(); role {
+		case Follower:
+			r.runFollower()
+		case Candidate:
+			r.runCandidate()
+		case Leader:
+			r.runLeader(term)
 		}
 	}
+}
 
-	// if the server just started try to start an election instead of looking who is the current leader
-	// TODO: change this after implementing cluster membership change
-	r.startElection()
-
-	nodeTimeout := time.Duration(rand.Intn(150)+150) * time.Millisecond // 150-300 ms
-	r.State.FollowerTimer.Reset(nodeTimeout)
-
-	for {
-		if r.State.IsLeader {
-			// this periodically updates the followers to make sure they are in sync with the leader.
-			// it shouldn't be frequently sending updates since new entries are populated upon receiving them by the leader
-			// it will mostly be effective when leadership change happens or a new server joins the cluster.
-			for i := 0; i < len(r.State.peers); i++ {
-				go func(peerIdx int) {
-					// check if the follower log is not up to date.
-					if r.State.peers[peerIdx].matchIndex != r.State.CommitIndex {
-						// then send log updates.
-						diff := r.State.CommitIndex - r.State.peers[peerIdx].nextIndex
-
-						// this will be nil if diff>0. In that case no logs are expected to be sent, just
-						var logsToSend []storage.LogEntry
-						if diff > 0 {
-							batchSize := min(diff, r.config.MaxLogBatch)
-							logsToSend = r.State.GetLogsRange(r.State.peers[peerIdx].nextIndex, r.State.peers[peerIdx].nextIndex+batchSize)
-						}
-
-						request := AppendRequest{
-							Term:         r.State.Persistent.GetCurrentTerm(),
-							LeaderId:     r.State.ServerId,
-							PrevLogIndex: r.State.peers[peerIdx].nextIndex - 1,
-							LeaderCommit: r.State.CommitIndex,
-							Entries:      logsToSend,
-						}
-
-						response := new(AppendResponse)
-						job, err := utils.NewJob(
-							// the main job to execute
-							sendRPC,
-							[]any{
-								&r.State.peers[peerIdx],
-								"RpcController.Append",
-								request,
-								response,
-							},
-							// post exec function
-							func(
-								peer uint,
-								raft *Raft,
-								response *AppendResponse,
-								// the return values of the main job that will be appended upon job execution
-								jobReturns ...any,
-							) {
-								// update the matchIndex of that peer after a successful replication.
-								if jobReturns[0] == nil {
-									raft.logger.Debug(fmt.Sprintf("Append message has been sent to follower: %v", raft.State.peers[peer].addr))
-									raft.State.peers[peer].matchIndex = response.CommitIndex
-									raft.State.peers[peer].nextIndex = response.CommitIndex + 1
-								} else {
-									raft.logger.Error(fmt.Sprintf("Append RPC to followr: %v has failed", raft.State.peers[peer].addr), zap.Error(jobReturns[0].(error)))
-									raft.State.peers[peer].nextIndex = raft.State.peers[peer].nextIndex - 1 // try older logs to find a matching point
-								}
-							}, []any{peerIdx, r, response})
-
-						if err != nil {
-							r.logger.Error("Failed to create append job", zap.Error(err))
-						}
-
-						err = r.workerPool.Enqueue(job)
-						if err != nil {
-							r.logger.Debug("Failed to enqueue append job", zap.Error(err))
-						}
-
-					} else { // otherwise, just ping the follower
-						request := PingRequest{Term: r.State.Persistent.GetCurrentTerm()}
-						response := new(PingResponse)
-
-						job, err := utils.NewJob(
-							sendRPC,
-							[]any{
-								&r.State.peers[peerIdx],
-								"RpcController.Ping",
-								request,
-								response,
-							},
-							nil, nil)
-
-						if err != nil {
-							r.logger.Error("Failed to create ping job", zap.Error(err))
-						}
-
-						err = r.workerPool.Enqueue(job)
-						if err != nil {
-							r.logger.Debug("Failed to enqueue ping job", zap.Error(err))
-						}
-					}
-				}(i)
+// runFollower waits for the leader to go silent for an election timeout, or to ask this server to take over.
+func (r *Raft) runFollower() {
+	for r.running() {
+		if role, _ := r.State.Role(); role != Follower {
+			return
+		}
+		select {
+		case <-r.done:
+		case <-r.events:
+		case leaderId := <-r.timeoutNow:
+			// the leader might have been replaced since it sent the request
+			if current, _ := r.State.Leader(); current == leaderId && r.State.isElectable(r.State.self) {
+				r.becomeCandidate(leaderId)
 			}
-
-		} else {
-			select {
-			// if the leader didn't send a message for too long, start an election.
-			case <-r.State.FollowerTimer.C:
-				r.startElection()
+		// if the leader didn't send a message for too long, start an election.
+		case <-r.State.FollowerTimer.C():
+			if r.State.isElectable(r.State.self) {
+				r.campaign()
+			} else {
+				r.resetFollowerTimer()
 			}
 		}
+	}
+}
+
+// runLeader replicates the log to the followers every heartbeat interval until this server is no longer the leader
+// of term.
+func (r *Raft) runLeader(term uint) {
+	heartbeat := r.State.clock.NewTicker(r.State.timing.heartbeatInterval)
+	defer heartbeat.Stop()
 
+	for r.running() && r.stillIn(Leader, term) {
+		if r.config.CheckQuorum && !r.hasQuorum() {
+			r.logger.Info("Did not hear from a majority of the cluster within an election timeout, stepping down")
+			r.becomeFollower()
+			return
+		}
+		// every follower is updated by its own replication goroutine, this only starts the ones that are not running
+		r.replicateLog(term)
+		select {
+		case <-heartbeat.C():
+		case <-r.events:
+		case <-r.stepDown:
+			r.becomeFollower()
+		case <-r.done:
+		}
 	}
 }
 
-func (r *Raft) startElection() {
+// stillIn reports whether this server still plays role in term, and makes it a follower if it saw a newer term or,
+// as a candidate, heard from the leader of its term.
+func (r *Raft) stillIn(role Role, term uint) bool {
+	if current, currentTerm := r.State.Role(); current != role || currentTerm != term {
+		return false
+	}
+	leaderId, _ := r.State.Leader()
+	if r.State.Persistent.GetCurrentTerm() != term || (role == Candidate && leaderId != "" && leaderId != r.State.ServerId) {
+		r.becomeFollower()
+		return false
+	}
+	return true
+}
 
-	r.logger.Info("Starting a new Election")
-	err := r.State.Persistent.SetCurrentTerm(r.State.Persistent.GetCurrentTerm() + 1)
-	if err != nil {
-		r.logger.Debug("Failed to set term", zap.Error(err))
+// handleAppendResponse updates the replication state of the peer from its answer to an append request and reports
+// whether the follower stored the entries. On a conflict the next index skips the whole conflicting term: to the
+// last entry of that term in the leader's log, or to the first one of the follower if the leader has none.
+func (r *Raft) handleAppendResponse(peer *Peer, request AppendRequest, response *AppendResponse) bool {
+	if response.Term > request.Term {
+		r.compareTerms(response.Term)
+		return false
+	}
+	if response.Success {
+		// the log of the follower matches the leader up to the last entry it was sent
+		peer.matched(request.PrevLogIndex + uint(len(request.Entries)))
+		return true
+	}
+
+	next := response.ConflictIndex
+	if response.ConflictTerm > 0 {
+		if index, ok := r.State.lastIndexOfTerm(response.ConflictTerm, request.PrevLogIndex); ok {
+			next = index + 1
+		}
+	}
+	// a delayed answer neither moves the next index forward nor behind what the follower is known to hold
+	peer.retry(next)
+	return false
+}
+
+// enqueueSnapshot schedules streaming the snapshot to the peer unless a transfer to it is already running.
+func (r *Raft) enqueueSnapshot(peer *Peer) {
+	if !peer.installingSnapshot.CompareAndSwap(false, true) {
 		return
 	}
 
-	err = r.State.Persistent.SetVotedFor(r.State.ServerId)
+	job, err := utils.NewJob(
+		r.sendSnapshot,
+		[]any{peer},
+		func(peer *Peer, raft *Raft, jobReturns ...any) {
+			peer.installingSnapshot.Store(false)
+			if jobReturns[0] != nil {
+				raft.logger.Error(fmt.Sprintf("InstallSnapshot RPC to follower: %v has failed", peer.addr), zap.Error(jobReturns[0].(error)))
+			} else {
+				raft.logger.Info(fmt.Sprintf("Snapshot has been installed on follower: %v", peer.addr))
+			}
+		}, []any{peer, r})
+
 	if err != nil {
-		r.logger.Debug(fmt.Sprintf("Server failed to vote for itself ID: %v", r.State.ServerId), zap.Error(err))
+		peer.installingSnapshot.Store(false)
+		r.logger.Error("Failed to create install snapshot job", zap.Error(err))
 		return
 	}
 
-	var votes = atomic.Uint64{}
-	// vote for itself
-	votes.Add(1)
+	err = r.workerPool.Enqueue(job)
+	if err != nil {
+		peer.installingSnapshot.Store(false)
+		r.logger.Debug("Failed to enqueue install snapshot job", zap.Error(err))
+	}
+}
 
-	// the channel to signal a vote upon follower response
-	signal := make(chan struct{})
-	// this makes sure that the current election is not infected by previous elections terminations
-	r.State.cancelElection = make(chan struct{})
+// campaign starts an election unless the pre-vote shows that this server cannot win it.
+func (r *Raft) campaign() {
+	if r.config.PreVote && !r.preVote() {
+		r.logger.Info("Pre-vote was not granted by a majority, staying a follower")
+		r.becomeFollower()
+		return
+	}
+	r.becomeCandidate("")
+}
+
+// becomeCandidate makes this server a candidate of the next term. An election started on request of the leader to
+// transfer its leadership, transferFrom being the id of that leader, skips the pre-vote, and the other servers that
+// follow that leader vote in it even though they hear from it.
+func (r *Raft) becomeCandidate(transferFrom string) {
+	r.logger.Info("Starting a new Election")
+	// the term and the vote change together, a vote request of the new term must not be granted in between
+	r.State.voteMutex.Lock()
+	defer r.State.voteMutex.Unlock()
+	term := r.State.Persistent.GetCurrentTerm() + 1
+	if err := r.State.Persistent.SetCurrentTerm(term); err != nil {
+		r.logger.Debug("Failed to set term", zap.Error(err))
+		r.becomeFollower()
+		return
+	}
+	if err := r.State.Persistent.SetVotedFor(r.State.ServerId); err != nil {
+		r.logger.Debug(fmt.Sprintf("Server failed to vote for itself ID: %v", r.State.ServerId), zap.Error(err))
+		r.becomeFollower()
+		return
+	}
+	r.State.setLeader("", "")
+	r.transferFrom = transferFrom
+	r.State.setRole(Candidate, term)
+}
 
+// runCandidate asks the voters for their votes and makes this server the leader once a majority granted them. A
+// candidate that neither won nor lost within an election timeout campaigns again.
+func (r *Raft) runCandidate() {
+	_, term := r.State.Role()
+	lastLogIndex := r.State.Persistent.LastIndex()
 	request := VoteRequest{
-		Term:         r.State.Persistent.GetCurrentTerm(),
-		LastLogIndex: r.State.CommitIndex,
+		Term:         term,
+		LastLogIndex: lastLogIndex,
+		LastLogTerm:  r.State.termOfIndex(lastLogIndex),
 		CandidateId:  r.State.ServerId,
+		ClusterId:    r.State.candidateClusterId(),
+		TransferFrom: r.transferFrom,
 	}
-
-	for i := 0; i < len(r.State.peers); i++ {
-		go func(peerIdx uint) {
-			response := new(VoteResponse)
-
-			job, err := utils.NewJob(
-				// the main job to execute
-				sendRPC,
-				[]any{
-					&r.State.peers[peerIdx],
-					"RpcController.Vote",
-					request,
-					response,
-				},
-				// post job
-				func(
-					peer uint,
-					raft *Raft,
-					vote *chan struct{},
-					jobReturns ...any,
-				) {
-					if jobReturns[0] != nil {
-						raft.logger.Error(fmt.Sprintf("Vote RPC to follower: %v has failed", raft.State.peers[peer].addr), zap.Error(jobReturns[0].(error)))
-					}
-					// at this point, vote was granted since there are no errors
-					*vote <- struct{}{}
-				}, []any{peerIdx, r, &signal},
-			)
-
-			if err != nil {
-				r.logger.Error("Failed to create vote job", zap.Error(err))
-			}
-
-			err = r.workerPool.Enqueue(job)
-			if err != nil {
-				r.logger.Debug("Failed to enqueue vote job", zap.Error(err))
-			}
-		}(uint(i))
-
+	// the granted votes, the ones that arrive after the election ended are dropped
+	voters := r.State.Voters()
+	granted := make(chan struct{}, len(voters))
+	for _, peer := range voters {
+		r.requestVote(peer, request, granted)
 	}
 
-	electionTimeout := time.Duration(rand.Intn(150)+150) * time.Millisecond // 150-300 ms
+	electionTimeout := r.electionTimeout()
 	r.logger.Info("Election will timeout after", zap.Duration("timeout_ms", electionTimeout))
+	timer := r.State.clock.NewTimer(electionTimeout)
+	defer timer.Stop()
 
-	timer := time.NewTimer(electionTimeout)
-	for {
+	// vote for itself
+	votes := 1
+	for r.running() && r.stillIn(Candidate, term) {
+		if votes >= r.State.GetMajority() {
+			r.logger.Info("Became leader with majority of votes", zap.Int("votes", votes))
+			r.becomeLeader(term)
+			return
+		}
 		select {
-		case <-timer.C:
+		case <-granted:
+			votes++
+		case <-timer.C():
 			r.logger.Info("Election timed out!")
+			r.campaign()
 			return
-		case <-signal:
-			votes.Add(1)
-		case <-r.State.cancelElection:
-			r.logger.Info("Received an election cancellation signal, canceling election! until next time.")
-			return
-		default:
-			if int(votes.Load()) >= r.State.GetMajority() {
-				r.logger.Info("Became leader with majority of votes", zap.Int("votes", int(votes.Load())))
-				r.State.IsLeader = true
-				// initialized to leaders last log + 1
-				for i := 0; i < len(r.State.peers); i++ {
-					r.State.peers[i].matchIndex = 0
-					r.State.peers[i].nextIndex = r.State.CommitIndex + 1
-				}
+		case <-r.events:
+		case <-r.done:
+		}
+	}
+}
+
+// requestVote sends the vote request to the peer from the worker pool, and signals granted if the peer voted for
+// this server.
+func (r *Raft) requestVote(peer *Peer, request VoteRequest, granted chan struct{}) {
+	response := new(VoteResponse)
+	job, err := utils.NewJob(
+		// the main job to execute
+		r.sendRPC,
+		[]any{
+			peer,
+			rpcVote,
+			request,
+			response,
+		},
+		// post job
+		func(
+			peer *Peer,
+			raft *Raft,
+			jobReturns ...any,
+		) {
+			if jobReturns[0] != nil {
+				raft.logger.Error(fmt.Sprintf("Vote RPC to follower: %v has failed", peer.addr), zap.Error(jobReturns[0].(error)))
+				return
+			}
+			// a voter of a newer term makes this server a follower, the election is over
+			if response.Term > request.Term {
+				raft.compareTerms(response.Term)
+				return
+			}
+			if !response.VoteGranted {
+				raft.logger.Debug(fmt.Sprintf("Vote RPC to follower: %v was not granted", peer.addr))
 				return
 			}
+			select {
+			case granted <- struct{}{}:
+			default:
+			}
+		}, []any{peer, r},
+	)
+	if err != nil {
+		r.logger.Error("Failed to create vote job", zap.Error(err))
+		return
+	}
+
+	// the queue might be full, the event loop does not wait for it
+	go func() {
+		if err := r.workerPool.Enqueue(job); err != nil {
+			r.logger.Debug("Failed to enqueue vote job", zap.Error(err))
 		}
+	}()
+}
+
+// becomeLeader makes this server the leader of term.
+func (r *Raft) becomeLeader(term uint) {
+	// initialized to leaders last log + 1. Every peer gets a full election timeout to be heard from
+	for _, peer := range r.State.Peers() {
+		peer.resetProgress(r.State.Persistent.LastIndex() + 1)
+		peer.lastContact.Store(r.State.clock.Now().UnixNano())
+		peer.acknowledged.Store(0)
+	}
+	r.State.setLeader(r.State.ServerId, r.apiAddr)
+	r.State.setRole(Leader, term)
+	// the entries of the previous terms are only committed along with an entry of this term (section 5.4.2 of the Raft
+	// paper), the no-op commits them without waiting for a client to write. It also lets the leader serve reads.
+	r.propose([]storage.LogEntry{{Type: storage.EntryNoOp}})
+	if r.State.ClusterId() == "" {
+		r.nameCluster()
 	}
+}
 
+// becomeFollower makes this server a follower of the current term. The proposals of a leader fail, they might still
+// be committed by the next leader.
+func (r *Raft) becomeFollower() {
+	role, _ := r.State.Role()
+	r.State.setRole(Follower, r.State.Persistent.GetCurrentTerm())
+	if role == Leader {
+		if id, _ := r.State.Leader(); id == r.State.ServerId {
+			r.State.setLeader("", "")
+		}
+		r.proposals.fail(ErrLeadershipLost)
+	}
+	r.resetFollowerTimer()
 }
 
+// compareTerms moves this server to term if it is newer than its own. The leader of the new term is not known yet,
+// and the event loop is woken up to make this server a follower.
 func (r *Raft) compareTerms(term uint) {
+	r.State.voteMutex.Lock()
+	defer r.State.voteMutex.Unlock()
 	if term > r.State.Persistent.GetCurrentTerm() {
 		err := r.State.Persistent.SetCurrentTerm(term)
 		if err != nil {
@@ -311,132 +523,166 @@ func (r *Raft) compareTerms(term uint) {
 		if err != nil {
 			r.logger.Debug("Failed to unset votedFor", zap.Error(err))
 		}
-
-		// if leader/candidate, then become a follower
-		r.State.IsLeader = false
-		if r.State.cancelElection != nil {
-			r.State.cancelElection <- struct{}{}
-		}
+		r.State.setLeader("", "")
+		r.wake()
 	}
 }
 
 func (r *Raft) resetFollowerTimer() {
 	// reset the follower timer to avoid starting a new election
 	// This will be invoked when term of a sender = term of the current server, either from prev cycles or after setting a new term
-	r.State.FollowerTimer.Reset(time.Duration(rand.Intn(150)+150) * time.Millisecond) // 150-300 ms
+	r.State.FollowerTimer.Reset(r.electionTimeout())
 }
 
-func sendRPC(peer *Peer, remoteFunc string, request any, response any) error {
+func (r *Raft) sendRPC(peer *Peer, method string, request any, response any) error {
 	if reflect.ValueOf(response).Kind() != reflect.Ptr {
 		return fmt.Errorf("response must be a pointer")
 	}
 
-	peer.mutex.Lock()
-	defer peer.mutex.Unlock()
-
-	// Reuse the client if it's already connected, otherwise create new one
-	if peer.client == nil {
-		client, err := rpc.Dial("tcp", peer.addr)
-		if err != nil {
-			return fmt.Errorf("unable to connect to peer %s: %w", peer.addr, err)
-		}
-		peer.client = client
-	}
-
-	err := peer.client.Call(remoteFunc, request, response)
+	err := r.transport.Call(peer.addr, method, request, response)
 	if err != nil {
+		var serverError rpc.ServerError
+		if errors.As(err, &serverError) {
+			// the peer is reachable even if it refused the request
+			peer.lastContact.Store(r.State.clock.Now().UnixNano())
+		}
 		return fmt.Errorf("error calling rpc: %w", err)
 	}
+	peer.lastContact.Store(r.State.clock.Now().UnixNano())
 
 	return nil
 }
 
-// Put handles the logic for putting a new entry on the leader or redirecting the command to the current leader on followers.
-// it cannot be async since the user will be waiting for a response.
-func (r *Raft) Put(data []types.Type) []storage.LogEntry {
-	// TODO: check if this server is a leader, if not forward to the current leader for now assume that put will be only called on leaders
+// Command is a command proposed for the state machine.
+type Command struct {
+	// Data is the payload the state machine decodes when the command is applied
+	Data []byte
+	// ClientId and Sequence identify the client session and the request that proposed the command
+	ClientId string
+	Sequence uint64
+}
 
-	// create a log entry of the new values
-	var entries []storage.LogEntry
-	var lastIndex uint // will hold the index of the last appended log entry
+// Propose appends the commands to the log of the leader and replicates them to the followers. The returned
+// proposal resolves once they are committed and applied. Followers return a NotLeaderError pointing to the current
+// leader so that the client can retry there.
+func (r *Raft) Propose(commands ...Command) (*Proposal, error) {
+	if r.stopping.Load() {
+		return nil, ErrShutdown
+	}
+	if !r.State.IsLeader() {
+		return nil, r.notLeaderError()
+	}
+	if r.transferring.Load() {
+		return nil, ErrLeadershipTransferInProgress
+	}
 
+	entries := make([]storage.LogEntry, 0, len(commands))
+	for _, command := range commands {
+		entries = append(entries, storage.LogEntry{
+			Type:     storage.EntryCommand,
+			Data:     command.Data,
+			ClientId: command.ClientId,
+			Sequence: command.Sequence,
+		})
+	}
+	return r.propose(entries), nil
+}
+
+// Put proposes the key-value pairs as a single KVCommand and waits until it is committed and applied, or until the
+// context is done.
+func (r *Raft) Put(ctx context.Context, data []types.Type) error {
+	var pairs []types.KeyValue
 	for _, kv := range data {
-		fmt.Println(kv)
-		if pair, ok := kv.(types.KeyValue); ok {
-			fmt.Println(pair)
-			entry := storage.LogEntry{
-				Term: r.State.Persistent.GetCurrentTerm(),
-				Pair: pair,
-			}
-			idx := r.State.Persistent.Append(entry)
-			r.State.CommitIndex = r.State.CommitIndex + 1
-			lastIndex = idx
-			entries = append(entries, entry)
-		} else {
-			r.logger.Error("unable to assert to KeyValue")
+		pair, ok := kv.(types.KeyValue)
+		if !ok {
+			return fmt.Errorf("unable to assert %v to KeyValue", kv)
 		}
+		pairs = append(pairs, pair)
 	}
-	fmt.Println(lastIndex)
-
-	commits := atomic.Uint64{}
-	// add this leader server
-	commits.Add(1)
-
-	signal := make(chan struct{})
+	return r.proposeKV(ctx, KVCommand{Op: KVPut, Pairs: pairs})
+}
 
-	// populate the new entry to followers
-	for i := 0; i < len(r.State.peers); i++ {
-		go func(peerIdx int, raft *Raft) {
+// Delete proposes the removal of the keys as a single KVCommand and waits until it is committed and applied, or until
+// the context is done.
+func (r *Raft) Delete(ctx context.Context, keys []types.Type) error {
+	var pairs []types.KeyValue
+	for _, key := range keys {
+		pairs = append(pairs, types.KeyValue{Key: key})
+	}
+	return r.proposeKV(ctx, KVCommand{Op: KVDelete, Pairs: pairs})
+}
 
-			request := AppendRequest{
-				Term:         r.State.Persistent.GetCurrentTerm(),
-				LeaderId:     r.State.ServerId,
-				PrevLogIndex: r.State.peers[peerIdx].nextIndex - 1,
-				LeaderCommit: r.State.CommitIndex,
-				Entries:      entries,
-			}
+func (r *Raft) proposeKV(ctx context.Context, command KVCommand) error {
+	data, err := EncodeKVCommand(command)
+	if err != nil {
+		return err
+	}
+	proposal, err := r.Propose(Command{Data: data})
+	if err != nil {
+		return err
+	}
+	_, err = proposal.Wait(ctx)
+	return err
+}
 
-			response := new(AppendResponse)
+// propose appends the entries to the log of the leader and wakes the replication goroutines up. The entries are
+// committed once a majority has stored them, the returned proposal resolves when they are applied. It fails with
+// ErrLeadershipLost if this server is not the leader of the current term.
+func (r *Raft) propose(data []storage.LogEntry) *Proposal {
+	entries, lastIndex, term, err := r.appendEntries(data)
+	proposal := newProposal(entries, lastIndex, term)
+	if err != nil {
+		proposal.resolve(err)
+		return proposal
+	}
+	if len(entries) == 0 {
+		proposal.resolve(nil)
+		return proposal
+	}
+	r.proposals.add(proposal)
+	// a leader that stepped down meanwhile failed the proposals it knew of, this one might never be committed
+	if isLeader, currentTerm := r.State.Leadership(); !isLeader || currentTerm != term {
+		proposal.resolve(ErrLeadershipLost)
+		return proposal
+	}
 
-			err := sendRPC(&r.State.peers[peerIdx],
-				"RpcController.Append",
-				request,
-				response)
-			if err != nil {
-				raft.logger.Debug(fmt.Sprintf("error appending new entry to follower: %v", peerIdx), zap.Error(err))
-				return
-			}
+	// the replication goroutines send the entries to the followers, a leader without followers commits them right away
+	r.replicateLog(term)
+	r.advanceCommitIndex(term)
 
-			signal <- struct{}{}
+	return proposal
+}
 
-		}(i, r)
+// appendEntries appends the entries to the log with the term this server leads, and returns them along with the
+// index of the last one. The term cannot change while they are appended: it only moves forward with the vote mutex
+// held.
+func (r *Raft) appendEntries(data []storage.LogEntry) ([]storage.LogEntry, uint, uint, error) {
+	r.State.voteMutex.Lock()
+	defer r.State.voteMutex.Unlock()
+	isLeader, term := r.State.Leadership()
+	if !isLeader {
+		return nil, 0, 0, ErrLeadershipLost
 	}
 
-	// TODO: rethink this one since it's dangerous in the senario when leader is not able to get a majority to commit the entry
-	for {
-		select {
-		case <-signal:
-			commits.Add(1)
-		default:
-			if int(commits.Load()) >= r.State.GetMajority() {
-				// majority has acknowledged, apply entries
-				r.State.CommitIndex = lastIndex
-				r.State.ApplyNewEntries()
-				fmt.Println(r.State.state)
-				fmt.Println(r.State.CommitIndex)
-				fmt.Println(r.State.LastApplied)
-				return entries
-			}
+	var entries []storage.LogEntry
+	var lastIndex uint // will hold the index of the last appended log entry
+	for _, entry := range data {
+		entry.Version = storage.EntryVersion
+		entry.Term = term
+		idx, err := r.State.Persistent.Append(entry)
+		if err != nil {
+			r.logger.Error("Failed to append entry to the log", zap.Error(err))
+			continue
+		}
+		// a new configuration is in effect as soon as it is in the log
+		if entry.Type == storage.EntryConfiguration {
+			r.State.setMembership(configurationOf(&entry), idx)
 		}
+		lastIndex = idx
+		entries = append(entries, entry)
 	}
-
-}
-
-func (r *Raft) Get(key types.Type) (types.Type, error) {
-	// If this node is not the leader, in a fully-fledged implementation we would
-	// forward the request to the current leader. For the time being – until
-	// redirection logic is implemented – we simply try to satisfy the request
-	// from the local constructed state map. This will work correctly when the
-	// request is sent to the current leader and during single-node deployments.
-	return r.State.Get(key)
+	if len(entries) == 0 && len(data) > 0 {
+		return nil, 0, term, fmt.Errorf("unable to append the entries to the log")
+	}
+	return entries, lastIndex, term, nil
 }
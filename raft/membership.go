@@ -0,0 +1,376 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"go.uber.org/zap"
+	"slices"
+)
+
+// Membership changes are done one server at a time, as described in section 4.3 of the Raft dissertation.
+// Every change is written to the log as a configuration entry holding the full list of servers, and a server
+// uses the latest configuration in its log as soon as the entry is appended, committed or not. Allowing only one
+// uncommitted change at a time keeps the majorities of the old and the new configuration overlapping. A new leader
+// only makes a change once it committed an entry of its term, the configuration in its log might otherwise be an
+// uncommitted one that the next leader replaces.
+
+// configuration is the membership of the cluster. Learners and witnesses are members too.
+type configuration struct {
+	members []string
+	// the members that do not vote
+	learners []string
+	// the voters that are sent the entries without their commands
+	witnesses []string
+}
+
+// configurationOf returns the configuration a configuration entry holds.
+func configurationOf(entry *storage.LogEntry) configuration {
+	return configuration{members: entry.Members, learners: entry.Learners, witnesses: entry.Witnesses}
+}
+
+func (c configuration) clone() configuration {
+	return configuration{
+		members:   slices.Clone(c.members),
+		learners:  slices.Clone(c.learners),
+		witnesses: slices.Clone(c.witnesses),
+	}
+}
+
+// electable returns the number of voters that may become the leader.
+func (c configuration) electable() int {
+	count := 0
+	for _, member := range c.members {
+		if !slices.Contains(c.learners, member) && !slices.Contains(c.witnesses, member) {
+			count++
+		}
+	}
+	return count
+}
+
+// AddServer adds the server listening on addr to the cluster as a voter. It can only be called on the leader, and
+// returns once the change is committed or the context is done.
+func (r *Raft) AddServer(ctx context.Context, addr string) error {
+	return r.changeMembership(ctx, func(c configuration) (configuration, error) {
+		if slices.Contains(c.members, addr) {
+			return c, fmt.Errorf("server %v is already a member of the cluster", addr)
+		}
+		c.members = append(c.members, addr)
+		return c, nil
+	})
+}
+
+// AddLearner adds the server listening on addr to the cluster as a learner. A learner receives the log and the
+// snapshots like any other member but does not vote and does not count towards the majority, so a new server can
+// catch up without affecting the availability of the cluster. It can only be called on the leader.
+func (r *Raft) AddLearner(ctx context.Context, addr string) error {
+	return r.changeMembership(ctx, func(c configuration) (configuration, error) {
+		if slices.Contains(c.members, addr) {
+			return c, fmt.Errorf("server %v is already a member of the cluster", addr)
+		}
+		c.members = append(c.members, addr)
+		c.learners = append(c.learners, addr)
+		return c, nil
+	})
+}
+
+// AddWitness adds the server listening on addr to the cluster as a witness. A witness votes and counts towards the
+// majority like any other voter, but the leader sends it the entries and the snapshots without the commands: it
+// holds the terms of the log, which is all the elections and the commits need. It never becomes the leader and does
+// not serve reads. It can only be called on the leader.
+func (r *Raft) AddWitness(ctx context.Context, addr string) error {
+	return r.changeMembership(ctx, func(c configuration) (configuration, error) {
+		if slices.Contains(c.members, addr) {
+			return c, fmt.Errorf("server %v is already a member of the cluster", addr)
+		}
+		c.members = append(c.members, addr)
+		c.witnesses = append(c.witnesses, addr)
+		return c, nil
+	})
+}
+
+// PromoteLearner makes the learner listening on addr a voter. The learner has to hold every committed entry, so that
+// it does not hold up commits once it counts towards the majority. It can only be called on the leader.
+func (r *Raft) PromoteLearner(ctx context.Context, addr string) error {
+	return r.changeMembership(ctx, func(c configuration) (configuration, error) {
+		idx := slices.Index(c.learners, addr)
+		if idx == -1 {
+			return c, fmt.Errorf("server %v is not a learner of the cluster", addr)
+		}
+		if peer := r.State.peer(addr); peer == nil || peer.match() < r.State.CommitIndex() {
+			return c, ErrLearnerNotCaughtUp
+		}
+		c.learners = slices.Delete(c.learners, idx, idx+1)
+		return c, nil
+	})
+}
+
+// RemoveServer removes the server listening on addr from the cluster, be it a voter, a learner or a witness. It can
+// only be called on the leader. A leader that removes itself steps down once the change is committed.
+func (r *Raft) RemoveServer(ctx context.Context, addr string) error {
+	return r.changeMembership(ctx, func(c configuration) (configuration, error) {
+		idx := slices.Index(c.members, addr)
+		if idx == -1 {
+			return c, fmt.Errorf("server %v is not a member of the cluster", addr)
+		}
+		c.members = slices.Delete(c.members, idx, idx+1)
+		c.learners = slices.DeleteFunc(c.learners, func(learner string) bool { return learner == addr })
+		c.witnesses = slices.DeleteFunc(c.witnesses, func(witness string) bool { return witness == addr })
+		// witnesses alone cannot elect a leader
+		if c.electable() == 0 {
+			return c, fmt.Errorf("cannot remove the last voter of the cluster that is not a witness")
+		}
+		return c, nil
+	})
+}
+
+// Members returns the raft addresses of the servers in the current configuration, learners and witnesses included.
+func (r *Raft) Members() []string {
+	return r.State.Members()
+}
+
+// Learners returns the raft addresses of the servers of the current configuration that do not vote.
+func (r *Raft) Learners() []string {
+	return r.State.Learners()
+}
+
+// Witnesses returns the raft addresses of the servers of the current configuration that vote but do not store the
+// commands.
+func (r *Raft) Witnesses() []string {
+	return r.State.Witnesses()
+}
+
+// changeMembership proposes the configuration change makes to the one in effect, and waits until it is committed or
+// the context is done. A change that timed out might still be committed, the next one waits for it.
+func (r *Raft) changeMembership(ctx context.Context, change func(c configuration) (configuration, error)) error {
+	if r.stopping.Load() {
+		return ErrShutdown
+	}
+	isLeader, term := r.State.Leadership()
+	if !isLeader {
+		return r.notLeaderError()
+	}
+	if r.transferring.Load() {
+		return ErrLeadershipTransferInProgress
+	}
+
+	r.membershipMutex.Lock()
+	defer r.membershipMutex.Unlock()
+
+	current, err := r.committedMembership(ctx, term)
+	if err != nil {
+		return err
+	}
+
+	c, err := change(current)
+	if err != nil {
+		return err
+	}
+
+	entry := storage.LogEntry{
+		Type:      storage.EntryConfiguration,
+		Members:   c.members,
+		Learners:  c.learners,
+		Witnesses: c.witnesses,
+	}
+	if _, err = r.propose([]storage.LogEntry{entry}).Wait(ctx); err != nil {
+		return fmt.Errorf("unable to commit the configuration entry: %w", err)
+	}
+	r.logger.Info("Cluster membership has changed", zap.Strings("members", c.members), zap.Strings("learners", c.learners),
+		zap.Strings("witnesses", c.witnesses))
+
+	if !r.State.isMember(r.State.self) {
+		r.logger.Info("This server was removed from the cluster, stepping down")
+		select {
+		case r.stepDown <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// committedMembership waits until the leader of term committed an entry of its term and the configuration in effect,
+// and returns that configuration. Until then the configuration in effect might be an uncommitted one of a previous
+// leader, and a change made on top of it would not overlap with the configuration the next leader might use.
+func (r *Raft) committedMembership(ctx context.Context, term uint) (configuration, error) {
+	for {
+		// taken before checking, an entry committed in between closes it
+		applied := r.applied.wait()
+		if isLeader, currentTerm := r.State.Leadership(); !isLeader || currentTerm != term {
+			return configuration{}, r.notLeaderError()
+		}
+		current, index := r.State.membership()
+		commitIndex := r.State.CommitIndex()
+		if index <= commitIndex && r.State.termOfIndex(commitIndex) == term {
+			return current, nil
+		}
+
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			if index > commitIndex {
+				return configuration{}, fmt.Errorf("%w: %w", ErrMembershipChangeInProgress, ctx.Err())
+			}
+			return configuration{}, fmt.Errorf("the leader has not committed an entry of its term yet: %w", ctx.Err())
+		case <-r.done:
+			return configuration{}, ErrShutdown
+		}
+	}
+}
+
+// setMembership makes c the configuration in effect. Peers that stay in the cluster keep their connection and
+// replication progress.
+func (s *State) setMembership(c configuration, index uint) {
+	s.peersMutex.Lock()
+	defer s.peersMutex.Unlock()
+
+	existing := make(map[string]*Peer, len(s.peers))
+	for _, p := range s.peers {
+		existing[p.addr] = p
+	}
+
+	peers := make([]*Peer, 0, len(c.members))
+	for _, addr := range c.members {
+		if addr == s.self {
+			continue
+		}
+		p, ok := existing[addr]
+		if ok {
+			delete(existing, addr)
+		} else {
+			p = newPeer(addr, s.Persistent.LastIndex()+1)
+		}
+		p.learner.Store(slices.Contains(c.learners, addr))
+		p.witness.Store(slices.Contains(c.witnesses, addr))
+		peers = append(peers, p)
+	}
+	for _, p := range existing {
+		if s.transport != nil {
+			s.transport.Disconnect(p.addr)
+		}
+	}
+
+	s.current = c.clone()
+	s.membershipIndex = index
+	s.peers = peers
+}
+
+// reloadMembership puts the latest configuration in the log in effect again. It has to be called whenever entries
+// that might hold a configuration were appended or removed.
+func (s *State) reloadMembership() {
+	s.setMembership(s.membershipAt(s.Persistent.LastIndex()))
+}
+
+// membershipAt returns the configuration in effect at the log index and the index of the entry it came from.
+func (s *State) membershipAt(index uint) (configuration, uint) {
+	s.snapshotMutex.RLock()
+	snapshotIndex, snapshotMembership := s.snapshotIndex, s.snapshotMembership
+	s.snapshotMutex.RUnlock()
+	for idx := index; idx > snapshotIndex; idx-- {
+		entry := s.Persistent.GetEntryOfIndex(idx)
+		if entry != nil && entry.Type == storage.EntryConfiguration {
+			return configurationOf(entry), idx
+		}
+	}
+	if snapshotMembership != nil {
+		return *snapshotMembership, snapshotIndex
+	}
+	return s.bootstrap, 0
+}
+
+func (s *State) membership() (configuration, uint) {
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	return s.current.clone(), s.membershipIndex
+}
+
+func (s *State) Members() []string {
+	c, _ := s.membership()
+	return c.members
+}
+
+func (s *State) Learners() []string {
+	c, _ := s.membership()
+	return c.learners
+}
+
+func (s *State) Witnesses() []string {
+	c, _ := s.membership()
+	return c.witnesses
+}
+
+func (s *State) isMember(addr string) bool {
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	return slices.Contains(s.current.members, addr)
+}
+
+// isVoter reports whether addr is a member of the current configuration that is not a learner. Witnesses vote.
+func (s *State) isVoter(addr string) bool {
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	return slices.Contains(s.current.members, addr) && !slices.Contains(s.current.learners, addr)
+}
+
+// isLearner reports whether addr is a member of the current configuration that does not vote.
+func (s *State) isLearner(addr string) bool {
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	return slices.Contains(s.current.learners, addr)
+}
+
+// isWitness reports whether addr is a voter of the current configuration that does not store the commands.
+func (s *State) isWitness(addr string) bool {
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	return slices.Contains(s.current.witnesses, addr)
+}
+
+// isElectable reports whether addr may become the leader: it is a voter that holds the commands of its log.
+func (s *State) isElectable(addr string) bool {
+	return s.isVoter(addr) && !s.isWitness(addr)
+}
+
+// Peers returns the other servers of the current configuration.
+func (s *State) Peers() []*Peer {
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	return slices.Clone(s.peers)
+}
+
+// Voters returns the other servers of the current configuration that are not learners.
+func (s *State) Voters() []*Peer {
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	voters := make([]*Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		if !p.learner.Load() {
+			voters = append(voters, p)
+		}
+	}
+	return voters
+}
+
+// peer returns the other server of the current configuration listening on addr, or nil if there is none.
+func (s *State) peer(addr string) *Peer {
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	for _, p := range s.peers {
+		if p.addr == addr {
+			return p
+		}
+	}
+	return nil
+}
+
+// peerWithId returns the peer whose id is id, or nil if none of the peers that answered this leader has it.
+func (s *State) peerWithId(id string) *Peer {
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	for _, p := range s.peers {
+		if id != "" && p.serverId() == id {
+			return p
+		}
+	}
+	return nil
+}
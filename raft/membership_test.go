@@ -0,0 +1,225 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestLearnersAreNotPartOfTheMajority(t *testing.T) {
+	node := newFollower(t, 1)
+	self := node.State.self
+	node.State.setMembership(configuration{members: []string{self, "b", "c", "d", "e"}, learners: []string{"d", "e"}}, 1)
+
+	if majority := node.State.GetMajority(); majority != 2 {
+		t.Errorf("Expected a majority of 2 out of 3 voters, got %v", majority)
+	}
+	if voters := node.State.Voters(); len(voters) != 2 {
+		t.Errorf("Expected 2 voting peers, got %v", len(voters))
+	}
+	if peers := node.State.Peers(); len(peers) != 4 {
+		t.Errorf("Expected learners to be replicated to, got %v peers", len(peers))
+	}
+
+	// promoting a learner keeps its replication progress
+	learner := node.State.peer("d")
+	learner.matchIndex = 1
+	node.State.setMembership(configuration{members: []string{self, "b", "c", "d", "e"}, learners: []string{"e"}}, 2)
+	if peer := node.State.peer("d"); peer != learner || peer.learner.Load() || peer.matchIndex != 1 {
+		t.Errorf("Expected the promoted learner to keep its progress and become a voter")
+	}
+	if majority := node.State.GetMajority(); majority != 3 {
+		t.Errorf("Expected a majority of 3 out of 4 voters, got %v", majority)
+	}
+}
+
+func TestLearnerDoesNotVote(t *testing.T) {
+	node := newFollower(t, 1)
+	self := node.State.self
+	node.State.setMembership(configuration{members: []string{"a", self}, learners: []string{self}}, 1)
+
+	request := VoteRequest{Term: 2, LastLogIndex: 1, LastLogTerm: 1, CandidateId: "a"}
+	controller := NewRpcController(node, zap.NewNop())
+	response := new(VoteResponse)
+	if err := controller.Vote(request, response); err != nil || response.VoteGranted {
+		t.Errorf("Expected a learner to refuse the vote, got %+v and %v", *response, err)
+	}
+	response = new(VoteResponse)
+	if err := controller.PreVote(request, response); err != nil || response.VoteGranted {
+		t.Errorf("Expected a learner to refuse the pre-vote, got %+v and %v", *response, err)
+	}
+	if err := controller.TimeoutNow(TimeoutNowRequest{Term: 2, LeaderId: "a"}, new(TimeoutNowResponse)); err == nil {
+		t.Errorf("Expected a learner to refuse to start an election")
+	}
+}
+
+func TestPromoteLearner(t *testing.T) {
+	leader, _ := startCluster(t, 3)
+
+	// the learner is not reachable, it must not hold up the membership change or later writes
+	learner := "127.0.0.1:9100"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.AddLearner(ctx, learner); err != nil {
+		t.Fatalf("Failed to add learner: %v", err)
+	}
+	if err := leader.Put(ctx, []types.Type{types.KeyValue{Key: types.String("k"), Value: types.String("v")}}); err != nil {
+		t.Fatalf("Expected writes to be committed without the learner: %v", err)
+	}
+
+	if err := leader.PromoteLearner(ctx, learner); !errors.Is(err, ErrLearnerNotCaughtUp) {
+		t.Errorf("Expected promoting a learner that is behind to fail with %v, got %v", ErrLearnerNotCaughtUp, err)
+	}
+	if err := leader.PromoteLearner(ctx, leader.State.self); err == nil {
+		t.Errorf("Expected promoting a voter to fail")
+	}
+
+	if err := leader.RemoveServer(ctx, learner); err != nil {
+		t.Fatalf("Failed to remove learner: %v", err)
+	}
+	if learners := leader.Learners(); len(learners) != 0 {
+		t.Errorf("Expected no learners after the removal, got %v", learners)
+	}
+}
+
+// putCommand returns the command that writes a value to the key k.
+func putCommand(t *testing.T) []byte {
+	t.Helper()
+	types.RegisterDataTypes()
+	data, err := EncodeKVCommand(KVCommand{Op: KVPut, Pairs: []types.KeyValue{{Key: types.String("k"), Value: types.String("v")}}})
+	if err != nil {
+		t.Fatalf("Failed to encode command: %v", err)
+	}
+	return data
+}
+
+func TestWitnessesArePartOfTheMajority(t *testing.T) {
+	node := newFollower(t, 1)
+	self := node.State.self
+	node.State.setMembership(configuration{members: []string{self, "b", "c"}, witnesses: []string{"c"}}, 1)
+
+	if majority := node.State.GetMajority(); majority != 2 {
+		t.Errorf("Expected a majority of 2 out of 3 voters, got %v", majority)
+	}
+	if voters := node.State.Voters(); len(voters) != 2 {
+		t.Errorf("Expected the witness to vote, got %v voting peers", len(voters))
+	}
+
+	// the witness is sent the terms of the entries but not their commands
+	if _, err := node.State.Persistent.Append(storage.LogEntry{Term: 1, Type: storage.EntryCommand, Data: putCommand(t)}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	witness, voter := node.State.peer("c"), node.State.peer("b")
+	witness.nextIndex, voter.nextIndex = 2, 2
+	if entries := node.appendRequest(witness, 1).Entries; len(entries) != 1 || entries[0].Term != 1 || entries[0].Data != nil {
+		t.Errorf("Expected the witness to be sent the entry without its command, got %+v", entries)
+	}
+	if entries := node.appendRequest(voter, 1).Entries; len(entries) != 1 || entries[0].Data == nil {
+		t.Errorf("Expected a voter to be sent the command, got %+v", entries)
+	}
+	if entry := node.State.Persistent.GetEntryOfIndex(2); entry.Data == nil {
+		t.Errorf("Expected the leader to keep the command in its log")
+	}
+}
+
+func TestWitnessDoesNotLeadOrServeReads(t *testing.T) {
+	node := newFollower(t, 1)
+	self := node.State.self
+	node.State.setMembership(configuration{members: []string{"a", self}, witnesses: []string{self}}, 1)
+
+	request := VoteRequest{Term: 2, LastLogIndex: 1, LastLogTerm: 1, CandidateId: "a"}
+	controller := NewRpcController(node, zap.NewNop())
+	response := new(VoteResponse)
+	if err := controller.Vote(request, response); err != nil || !response.VoteGranted {
+		t.Errorf("Expected a witness to grant its vote, got %+v and %v", *response, err)
+	}
+	if err := controller.TimeoutNow(TimeoutNowRequest{Term: 2, LeaderId: "a"}, new(TimeoutNowResponse)); err == nil {
+		t.Errorf("Expected a witness to refuse to start an election")
+	}
+
+	// a command that reaches the witness anyway is not applied
+	appendRequest := AppendRequest{Term: 2, LeaderId: "a", PrevLogIndex: 1, PreLogTerm: 1, LeaderCommit: 2,
+		Entries: []storage.LogEntry{{Version: storage.EntryVersion, Term: 2, Type: storage.EntryCommand, Data: putCommand(t)}}}
+	if err := controller.Append(appendRequest, new(AppendResponse)); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if node.State.LastApplied() != 2 {
+		t.Errorf("Expected the witness to move past the committed entry, applied up to %v", node.State.LastApplied())
+	}
+	if value, _ := node.State.fsm.(*KVStore).Get(types.String("k")); value != nil {
+		t.Errorf("Expected the state machine of the witness to stay empty, got %v", value)
+	}
+	if _, err := node.Get(context.Background(), types.String("k"), ReadStale); !errors.Is(err, ErrWitness) {
+		t.Errorf("Expected a read from a witness to fail with %v, got %v", ErrWitness, err)
+	}
+}
+
+func TestAddWitness(t *testing.T) {
+	leader, _ := startCluster(t, 3)
+
+	// the witness is not reachable, the three other voters are a majority without it
+	witness := "127.0.0.1:9100"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.AddWitness(ctx, witness); err != nil {
+		t.Fatalf("Failed to add witness: %v", err)
+	}
+	if witnesses := leader.Witnesses(); len(witnesses) != 1 || witnesses[0] != witness {
+		t.Fatalf("Expected %v to be a witness, got %v", witness, witnesses)
+	}
+	if majority := leader.State.GetMajority(); majority != 3 {
+		t.Errorf("Expected a majority of 3 out of 4 voters, got %v", majority)
+	}
+	if err := leader.TransferLeadership(ctx, witness); err == nil {
+		t.Errorf("Expected the leadership not to be transferred to a witness")
+	}
+	if err := leader.Put(ctx, []types.Type{types.KeyValue{Key: types.String("k"), Value: types.String("v")}}); err != nil {
+		t.Fatalf("Expected writes to be committed without the witness: %v", err)
+	}
+
+	if err := leader.RemoveServer(ctx, witness); err != nil {
+		t.Fatalf("Failed to remove witness: %v", err)
+	}
+	if witnesses := leader.Witnesses(); len(witnesses) != 0 {
+		t.Errorf("Expected no witnesses after the removal, got %v", witnesses)
+	}
+}
+
+func TestMembershipChangeWaitsForACommitOfTheTerm(t *testing.T) {
+	node := newFollower(t, 1)
+	node.State.setRole(Leader, 2)
+	if err := node.State.Persistent.SetCurrentTerm(2); err != nil {
+		t.Fatalf("Failed to set term: %v", err)
+	}
+
+	// the entry of the previous term is not known to be committed, neither is the configuration in effect
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := node.AddServer(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the change to wait for a commit of the term until the deadline, got %v", err)
+	}
+	if lastIndex := node.State.Persistent.LastIndex(); lastIndex != 1 {
+		t.Errorf("Expected no configuration entry to be appended, the log ends at %v", lastIndex)
+	}
+
+	// the no-op of the term commits the entries before it
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- node.AddLearner(ctx, "b")
+	}()
+	if _, err := node.propose([]storage.LogEntry{{Type: storage.EntryNoOp}}).Wait(ctx); err != nil {
+		t.Fatalf("Failed to commit the no-op: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the change to be made once an entry of the term was committed, got %v", err)
+	}
+	if learners := node.Learners(); len(learners) != 1 || learners[0] != "b" {
+		t.Errorf("Expected b to be a learner, got %v", learners)
+	}
+}
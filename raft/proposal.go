@@ -0,0 +1,112 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"sync"
+)
+
+// Proposal is the future of entries proposed to the leader. It resolves once the entries are committed and applied
+// to the state machine, or once this leader can no longer commit them.
+type Proposal struct {
+	entries []storage.LogEntry
+	// the index of the last entry and the term the entries were proposed in
+	index uint
+	term  uint
+
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newProposal(entries []storage.LogEntry, index uint, term uint) *Proposal {
+	return &Proposal{
+		entries: entries,
+		index:   index,
+		term:    term,
+		done:    make(chan struct{}),
+	}
+}
+
+// Done is closed once the proposal is resolved.
+func (p *Proposal) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns nil if the entries were committed and applied, it must only be called once Done is closed.
+func (p *Proposal) Err() error {
+	return p.err
+}
+
+// Wait blocks until the proposal is resolved or the context is done, and returns the committed entries. Entries whose
+// wait timed out might still be committed later.
+func (p *Proposal) Wait(ctx context.Context) ([]storage.LogEntry, error) {
+	select {
+	case <-p.done:
+		if p.err != nil {
+			return nil, p.err
+		}
+		return p.entries, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", ErrCommitTimeout, ctx.Err())
+	}
+}
+
+func (p *Proposal) resolve(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+}
+
+// proposals are the proposals of the leader that are not resolved yet.
+type proposals struct {
+	mutex   sync.Mutex
+	pending []*Proposal
+}
+
+func (p *proposals) add(proposal *Proposal) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pending = append(p.pending, proposal)
+}
+
+// applied resolves the proposals up to the last applied index. A proposal whose last entry was replaced by the one
+// of another term fails, and so does a proposal with an entry the state machine refused.
+func (p *proposals) applied(lastApplied uint, termOfIndex func(index uint) uint, refused map[uint]error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pending := p.pending[:0]
+	for _, proposal := range p.pending {
+		switch {
+		case proposal.index > lastApplied:
+			pending = append(pending, proposal)
+		case termOfIndex(proposal.index) == proposal.term:
+			proposal.resolve(proposal.refusal(refused))
+		default:
+			proposal.resolve(ErrLeadershipLost)
+		}
+	}
+	p.pending = pending
+}
+
+// refusal returns the error the state machine refused one of the entries of the proposal with, if any.
+func (p *Proposal) refusal(refused map[uint]error) error {
+	for idx := p.index + 1 - uint(len(p.entries)); idx <= p.index; idx++ {
+		if err, ok := refused[idx]; ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail resolves all the pending proposals with the error.
+func (p *proposals) fail(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, proposal := range p.pending {
+		proposal.resolve(err)
+	}
+	p.pending = nil
+}
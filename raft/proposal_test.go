@@ -0,0 +1,113 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+)
+
+func TestProposals(t *testing.T) {
+	entries := []storage.LogEntry{{Term: 2}}
+	termOfIndex := func(index uint) uint {
+		if index == 4 {
+			return 3
+		}
+		return 2
+	}
+
+	t.Run("proposals resolve once their entries are applied", func(t *testing.T) {
+		var pending proposals
+		committed := newProposal(entries, 3, 2)
+		replaced := newProposal(entries, 4, 2)
+		waiting := newProposal(entries, 5, 2)
+		pending.add(committed)
+		pending.add(replaced)
+		pending.add(waiting)
+
+		pending.applied(4, termOfIndex, nil)
+
+		if result, err := committed.Wait(context.Background()); err != nil || len(result) != 1 {
+			t.Errorf("Expected the proposal to be committed, got %v", err)
+		}
+		if _, err := replaced.Wait(context.Background()); !errors.Is(err, ErrLeadershipLost) {
+			t.Errorf("Expected a proposal whose entry was replaced to fail with ErrLeadershipLost, got %v", err)
+		}
+		select {
+		case <-waiting.Done():
+			t.Errorf("Expected the proposal after the last applied index to be pending")
+		default:
+		}
+	})
+
+	t.Run("a proposal fails with the error its entry was refused with", func(t *testing.T) {
+		var pending proposals
+		refusal := errors.New("refused")
+		accepted := newProposal(entries, 2, 2)
+		refused := newProposal([]storage.LogEntry{{Term: 2}, {Term: 2}}, 6, 2)
+		pending.add(accepted)
+		pending.add(refused)
+
+		pending.applied(6, func(uint) uint { return 2 }, map[uint]error{5: refusal})
+
+		if err := accepted.Err(); err != nil {
+			t.Errorf("Expected the other proposal to be committed, got %v", err)
+		}
+		if _, err := refused.Wait(context.Background()); !errors.Is(err, refusal) {
+			t.Errorf("Expected the proposal to fail with the refusal, got %v", err)
+		}
+	})
+
+	t.Run("a wait that times out fails with ErrCommitTimeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := newProposal(entries, 1, 2).Wait(ctx)
+		if !errors.Is(err, ErrCommitTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected ErrCommitTimeout wrapping the deadline, got %v", err)
+		}
+	})
+
+	t.Run("pending proposals fail when the leadership is lost", func(t *testing.T) {
+		var pending proposals
+		proposal := newProposal(entries, 1, 2)
+		pending.add(proposal)
+
+		pending.fail(ErrLeadershipLost)
+
+		if _, err := proposal.Wait(context.Background()); !errors.Is(err, ErrLeadershipLost) {
+			t.Errorf("Expected ErrLeadershipLost, got %v", err)
+		}
+		// later resolutions are ignored
+		pending.applied(1, termOfIndex, nil)
+		proposal.resolve(nil)
+		if !errors.Is(proposal.Err(), ErrLeadershipLost) {
+			t.Errorf("Expected the proposal to keep its first resolution, got %v", proposal.Err())
+		}
+	})
+}
+
+func TestProposeUsesTheTermOfTheLeadership(t *testing.T) {
+	node := newFollower(t, 1)
+	node.State.setRole(Leader, 1)
+	// a newer term was seen, the event loop did not step down yet
+	if err := node.State.Persistent.SetCurrentTerm(2); err != nil {
+		t.Fatalf("Failed to set term: %v", err)
+	}
+	if _, err := node.propose([]storage.LogEntry{{Type: storage.EntryNoOp}}).Wait(context.Background()); !errors.Is(err, ErrLeadershipLost) {
+		t.Errorf("Expected a proposal of a former leader to fail with ErrLeadershipLost, got %v", err)
+	}
+	if lastIndex := node.State.Persistent.LastIndex(); lastIndex != 1 {
+		t.Errorf("Expected nothing to be appended with the newer term, the log ends at %v", lastIndex)
+	}
+
+	node.State.setRole(Leader, 2)
+	if _, err := node.propose([]storage.LogEntry{{Type: storage.EntryNoOp}}).Wait(context.Background()); err != nil {
+		t.Fatalf("Expected the leader of the term to commit its proposal, got %v", err)
+	}
+	if term := node.State.termOfIndex(2); term != 2 {
+		t.Errorf("Expected the entry to be appended with the term of the leadership, got %v", term)
+	}
+}
@@ -0,0 +1,258 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// ReadConsistency is the guarantee a read is served with.
+type ReadConsistency uint8
+
+const (
+	// ReadLinearizable reads go through the ReadIndex protocol, the leader confirms it is still the leader with a
+	// heartbeat round to a majority before serving the read
+	ReadLinearizable ReadConsistency = iota
+	// ReadLease reads are served by the leader without a heartbeat round while its lease holds, they fall back to
+	// ReadIndex otherwise. They rely on bounded clock drift between the servers
+	ReadLease
+	// ReadStale reads are served from the local state of any server and might not reflect the latest writes
+	ReadStale
+)
+
+var ErrLeadershipNotConfirmed = errors.New("unable to confirm leadership with a majority of the cluster")
+
+// ParseReadConsistency returns the consistency level of its name, an empty name is a linearizable read.
+func ParseReadConsistency(name string) (ReadConsistency, error) {
+	switch name {
+	case "", "linearizable":
+		return ReadLinearizable, nil
+	case "lease":
+		return ReadLease, nil
+	case "stale":
+		return ReadStale, nil
+	default:
+		return 0, fmt.Errorf("unknown read consistency: %v", name)
+	}
+}
+
+func (c ReadConsistency) String() string {
+	switch c {
+	case ReadLinearizable:
+		return "linearizable"
+	case ReadLease:
+		return "lease"
+	case ReadStale:
+		return "stale"
+	default:
+		return fmt.Sprintf("ReadConsistency(%d)", uint8(c))
+	}
+}
+
+// lease is the time until which the leader knows that no other server can be elected. It is taken at the start of
+// a heartbeat round acknowledged by a majority, and shortened by the maximum clock drift.
+type lease struct {
+	term   uint
+	expiry time.Time
+	mutex  sync.Mutex
+}
+
+func (l *lease) extend(term uint, start time.Time, electionTimeoutMin time.Duration, driftPercent uint) {
+	duration := electionTimeoutMin * time.Duration(100-min(driftPercent, 100)) / 100
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.term != term || start.Add(duration).After(l.expiry) {
+		l.term = term
+		l.expiry = start.Add(duration)
+	}
+}
+
+// invalidate ends the lease, the leader serves no lease read until it is extended again.
+func (l *lease) invalidate() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.expiry = time.Time{}
+}
+
+func (l *lease) valid(term uint, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.term == term && now.Before(l.expiry)
+}
+
+// Get reads the value of the key with the requested consistency from the state machine, which must implement
+// KeyValueReader. Linearizable and lease reads can only be served by the leader, followers return a NotLeaderError
+// pointing to it. A witness serves no read at all.
+func (r *Raft) Get(ctx context.Context, key types.Type, consistency ReadConsistency) (types.Type, error) {
+	reader, ok := r.State.fsm.(KeyValueReader)
+	if !ok {
+		return nil, fmt.Errorf("the state machine does not support reading keys")
+	}
+	if err := r.ReadBarrier(ctx, consistency); err != nil {
+		return nil, err
+	}
+	return reader.Get(key)
+}
+
+// ReadBarrier returns once the state machine reflects every write a read with the requested consistency must
+// observe. Reads of custom state machines call it before querying them.
+func (r *Raft) ReadBarrier(ctx context.Context, consistency ReadConsistency) error {
+	if r.State.isWitness(r.State.self) {
+		return ErrWitness
+	}
+	if consistency == ReadStale {
+		return nil
+	}
+	if !r.State.IsLeader() {
+		return r.notLeaderError()
+	}
+
+	// the target of a leadership transfer is elected without waiting for the lease to expire
+	term := r.State.Persistent.GetCurrentTerm()
+	if consistency == ReadLease && r.config.LeaseReads && !r.transferring.Load() && r.lease.valid(term, r.State.clock.Now()) {
+		return r.waitApplied(ctx, r.State.CommitIndex())
+	}
+
+	readIndex, err := r.readIndex(ctx)
+	if err != nil {
+		return err
+	}
+	return r.waitApplied(ctx, readIndex)
+}
+
+// readIndex returns the commit index as of the time the read was received, once a majority has confirmed that this
+// server is still the leader.
+func (r *Raft) readIndex(ctx context.Context) (uint, error) {
+	readIndex, err := r.committedInTerm(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.confirmLeadership(ctx); err != nil {
+		return 0, err
+	}
+	return readIndex, nil
+}
+
+// committedInTerm returns the commit index once the leader committed an entry of its term. The commit index of a new
+// leader may lag behind the one of the previous leader until the no-op entry it appended when it was elected is
+// committed, the entries it commits are applied and wake the read up. If everything in its log is committed it cannot
+// lag behind.
+func (r *Raft) committedInTerm(ctx context.Context) (uint, error) {
+	for {
+		// taken before checking, a commit or a step down in between closes them
+		applied, changed := r.applied.wait(), r.State.role.changed.wait()
+		commitIndex := r.State.CommitIndex()
+		if commitIndex >= r.State.Persistent.LastIndex() || r.State.termOfIndex(commitIndex) == r.State.Persistent.GetCurrentTerm() {
+			return commitIndex, nil
+		}
+		if !r.State.IsLeader() {
+			return 0, r.notLeaderError()
+		}
+		select {
+		case <-applied:
+		case <-changed:
+		case <-ctx.Done():
+			return 0, fmt.Errorf("%w: the leader has not committed an entry of its term yet: %w", ErrLeadershipNotConfirmed, ctx.Err())
+		case <-r.done:
+			return 0, ErrShutdown
+		}
+	}
+}
+
+// confirmLeadership sends a heartbeat to every peer and returns once a majority, counting this server, acknowledged it.
+func (r *Raft) confirmLeadership(ctx context.Context) error {
+	term := r.State.Persistent.GetCurrentTerm()
+	start := r.State.clock.Now()
+
+	acks := 0
+	if r.State.isVoter(r.State.self) {
+		acks++
+	}
+
+	peers := r.State.Voters()
+	signal := make(chan bool, len(peers))
+	for _, p := range peers {
+		go func(peer *Peer) {
+			request := PingRequest{
+				Term:       term,
+				LeaderId:   r.State.ServerId,
+				LeaderAddr: r.apiAddr,
+				ClusterId:  r.State.ClusterId(),
+			}
+			err := r.sendRPC(peer, rpcPing, request, new(PingResponse))
+			if err != nil {
+				r.logger.Debug(fmt.Sprintf("Heartbeat to follower: %v has failed", peer.addr), zap.Error(err))
+			}
+			signal <- err == nil
+		}(p)
+	}
+
+	for answers := 0; acks < r.State.GetMajority(); answers++ {
+		if answers == len(peers) {
+			return ErrLeadershipNotConfirmed
+		}
+		select {
+		case ack := <-signal:
+			if ack {
+				acks++
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrLeadershipNotConfirmed, ctx.Err())
+		}
+	}
+
+	if !r.State.IsLeader() || r.State.Persistent.GetCurrentTerm() != term {
+		return r.notLeaderError()
+	}
+	if !r.transferring.Load() {
+		r.lease.extend(term, start, r.State.timing.electionTimeoutMin, r.config.MaxClockDriftPercent)
+	}
+	return nil
+}
+
+// waitApplied blocks until the state machine has applied the entry at index.
+func (r *Raft) waitApplied(ctx context.Context, index uint) error {
+	for {
+		// taken before checking, an entry applied in between closes it
+		applied := r.applied.wait()
+		if r.State.LastApplied() >= index {
+			return nil
+		}
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.done:
+			return ErrShutdown
+		}
+	}
+}
+
+// signal wakes up the goroutines waiting for something to change.
+type signal struct {
+	mutex sync.Mutex
+	ch    chan struct{}
+}
+
+// wait returns a channel that is closed by the next call to notify.
+func (s *signal) wait() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+func (s *signal) notify() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+}
@@ -0,0 +1,89 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+)
+
+func TestReadBarrier(t *testing.T) {
+	read := func(leader *Raft, consistency ReadConsistency) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		return leader.ReadBarrier(ctx, consistency)
+	}
+
+	t.Run("a linearizable read confirms the leadership with a majority and takes the lease", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		_, peer := newServingNode(t, network, "9002")
+		leader := newLeader(t, network, "127.0.0.1:9002")
+
+		if err := read(leader, ReadLinearizable); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if !leader.lease.valid(1, leader.State.clock.Now()) {
+			t.Errorf("Expected the heartbeat round to extend the lease")
+		}
+
+		_ = peer.Close()
+		if err := read(leader, ReadLinearizable); !errors.Is(err, ErrLeadershipNotConfirmed) {
+			t.Errorf("Expected a read without a majority to fail with %v, got %v", ErrLeadershipNotConfirmed, err)
+		}
+	})
+
+	t.Run("a read on a new leader waits for the entry of its term to be committed", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		newServingNode(t, network, "9002")
+		leader := newLeader(t, network, "127.0.0.1:9002")
+		// the no-op entry of term 2 is not committed yet
+		if _, err := leader.State.Persistent.Append(storage.LogEntry{Term: 2}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		if err := leader.State.Persistent.SetCurrentTerm(2); err != nil {
+			t.Fatalf("Failed to set term: %v", err)
+		}
+		leader.State.setRole(Leader, 2)
+
+		result := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			result <- leader.ReadBarrier(ctx, ReadLinearizable)
+		}()
+		select {
+		case err := <-result:
+			t.Fatalf("Expected the read to wait for the commit, got %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		leader.State.commitUpTo(2)
+		leader.applyCommitted()
+		if err := <-result; err != nil {
+			t.Errorf("Expected the read to be served once the entry of the term is committed, got %v", err)
+		}
+	})
+
+	t.Run("a lease read is served without a majority while the lease holds", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		leader := newLeader(t, network, "127.0.0.1:9002")
+		if err := read(leader, ReadLease); !errors.Is(err, ErrLeadershipNotConfirmed) {
+			t.Errorf("Expected a lease read without a lease to fall back to ReadIndex, got %v", err)
+		}
+
+		leader.lease.extend(1, leader.State.clock.Now(), time.Minute, 0)
+		if err := read(leader, ReadLease); err != nil {
+			t.Errorf("Expected the lease read to be served, got %v", err)
+		}
+		if err := read(leader, ReadLinearizable); !errors.Is(err, ErrLeadershipNotConfirmed) {
+			t.Errorf("Expected a linearizable read to ignore the lease, got %v", err)
+		}
+
+		leader.config.LeaseReads = false
+		if err := read(leader, ReadLease); !errors.Is(err, ErrLeadershipNotConfirmed) {
+			t.Errorf("Expected the lease to be ignored while the lease reads are disabled, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package raft
+
+import (
+	"cmp"
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"go.uber.org/zap"
+	"slices"
+	"time"
+)
+
+// appendResult is the outcome of an append request sent by a replication goroutine.
+type appendResult struct {
+	request  AppendRequest
+	response *AppendResponse
+	// when the request was sent, an acknowledged request extends the lease of the leader from that time on
+	sent time.Time
+	err  error
+}
+
+// replicateLog makes sure a replication goroutine runs for every peer in term and wakes them up to send the entries
+// that were appended since.
+func (r *Raft) replicateLog(term uint) {
+	for _, peer := range r.State.Peers() {
+		if peer.replicationTerm.Swap(uint64(term)) != uint64(term) {
+			if !r.spawn(func() { r.replicate(peer, term) }) {
+				peer.replicationTerm.CompareAndSwap(uint64(term), 0)
+			}
+		}
+		select {
+		case peer.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate streams the log of the leader to the peer until this server is no longer the leader of term or the peer
+// was removed from the cluster. The entries appended while requests are in flight are sent together in the next one,
+// up to MaxLogBatch entries and MaxLogBatchBytes bytes, and up to MaxInflightAppends requests are in flight at once.
+// After a failure or a conflict a single request is in flight until the follower matches the leader again. A request
+// is sent at least every heartbeat interval, without entries if the follower has all of them.
+func (r *Raft) replicate(peer *Peer, term uint) {
+	defer peer.replicationTerm.CompareAndSwap(uint64(term), 0)
+
+	window := int(max(r.config.MaxInflightAppends, 1))
+	results := make(chan appendResult, window)
+	heartbeat := r.State.clock.NewTimer(r.State.timing.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	inflight := 0
+	probing := true
+	heartbeatDue := true
+	// cleared when a request failed, it is retried with the next heartbeat rather than right away
+	reachable := true
+	for r.replicating(peer, term) {
+		// the entries the follower needs next were compacted, send it the snapshot instead
+		snapshotIndex, _ := r.State.snapshotted()
+		if next, _ := peer.progress(); next <= snapshotIndex {
+			r.enqueueSnapshot(peer)
+		}
+
+		limit := window
+		if probing {
+			limit = 1
+		}
+		for inflight < limit && !peer.installingSnapshot.Load() && (heartbeatDue || reachable && r.behind(peer)) {
+			request := r.appendRequest(peer, term)
+			go func() {
+				response := new(AppendResponse)
+				sent := r.State.clock.Now()
+				err := r.sendRPC(peer, rpcAppend, request, response)
+				results <- appendResult{request: request, response: response, sent: sent, err: err}
+			}()
+			inflight++
+			heartbeatDue = false
+			heartbeat.Reset(r.State.timing.heartbeatInterval)
+			// the next request continues after the entries of this one without waiting for its answer
+			peer.sent(request.PrevLogIndex + uint(len(request.Entries)) + 1)
+		}
+
+		select {
+		case result := <-results:
+			inflight--
+			reachable = result.err == nil
+			probing = !r.handleAppendResult(peer, term, result)
+		case <-peer.trigger:
+		case <-heartbeat.C():
+			heartbeatDue = true
+			heartbeat.Reset(r.State.timing.heartbeatInterval)
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// replicating reports whether the replication goroutine of term should keep running for the peer.
+func (r *Raft) replicating(peer *Peer, term uint) bool {
+	return peer.replicationTerm.Load() == uint64(term) &&
+		r.running() &&
+		r.State.IsLeader() &&
+		r.State.Persistent.GetCurrentTerm() == term &&
+		slices.Contains(r.State.Peers(), peer)
+}
+
+// behind reports whether the leader has entries the peer was not sent yet.
+func (r *Raft) behind(peer *Peer) bool {
+	next, _ := peer.progress()
+	return next <= r.State.Persistent.LastIndex()
+}
+
+// appendRequest returns the request that sends the peer the entries following its next index.
+func (r *Raft) appendRequest(peer *Peer, term uint) AppendRequest {
+	next, _ := peer.progress()
+	prevLogIndex := next - 1
+	entries := r.nextBatch(next)
+	if peer.witness.Load() {
+		entries = withoutCommands(entries)
+	}
+	return AppendRequest{
+		Term:         term,
+		LeaderId:     r.State.ServerId,
+		LeaderAddr:   r.apiAddr,
+		ClusterId:    r.State.ClusterId(),
+		PrevLogIndex: prevLogIndex,
+		PreLogTerm:   r.State.termOfIndex(prevLogIndex),
+		LeaderCommit: r.State.CommitIndex(),
+		Entries:      entries,
+	}
+}
+
+// withoutCommands drops the commands of the entries sent to a witness. The terms and the types of the entries are
+// kept, so that the witness takes part in the elections and the commits like any other voter.
+func withoutCommands(entries []storage.LogEntry) []storage.LogEntry {
+	for i := range entries {
+		if entries[i].Type == storage.EntryCommand {
+			entries[i].Data = nil
+		}
+	}
+	return entries
+}
+
+// nextBatch returns the entries starting at index, at most MaxLogBatch of them and at most MaxLogBatchBytes bytes of
+// payload. The first entry is always part of the batch.
+func (r *Raft) nextBatch(index uint) []storage.LogEntry {
+	lastIndex := min(r.State.Persistent.LastIndex(), index+max(r.config.MaxLogBatch, 1)-1)
+	entries := r.State.GetLogsRange(index, lastIndex)
+	size := uint(0)
+	for i, entry := range entries {
+		size += uint(len(entry.Data))
+		if i > 0 && r.config.MaxLogBatchBytes > 0 && size > r.config.MaxLogBatchBytes {
+			return entries[:i]
+		}
+	}
+	return entries
+}
+
+// handleAppendResult updates the replication state of the peer from the outcome of an append request and reports
+// whether the follower stored the entries. A request that failed is sent again.
+func (r *Raft) handleAppendResult(peer *Peer, term uint, result appendResult) bool {
+	if result.err != nil {
+		r.logger.Debug(fmt.Sprintf("Append RPC to follower: %v has failed", peer.addr), zap.Error(result.err))
+		peer.retry(result.request.PrevLogIndex + 1)
+		return false
+	}
+	if result.response.ServerId != "" {
+		peer.id.Store(result.response.ServerId)
+	}
+	// the follower accepted this server as the leader of the term, whether its log matched or not
+	if result.response.Term == term {
+		peer.acknowledged.Store(max(peer.acknowledged.Load(), result.sent.UnixNano()))
+		r.extendLease(term)
+	}
+	if !r.handleAppendResponse(peer, result.request, result.response) {
+		return false
+	}
+	r.advanceCommitIndex(term)
+	return true
+}
+
+// advanceCommitIndex commits the entries stored by a majority of the cluster. Only an entry of the current term is
+// committed by counting the servers that store it, the entries before it are committed along with it (section 5.4.2
+// of the Raft paper).
+func (r *Raft) advanceCommitIndex(term uint) {
+	r.commitMutex.Lock()
+	defer r.commitMutex.Unlock()
+
+	var matched []uint
+	if r.State.isVoter(r.State.self) {
+		matched = append(matched, r.State.Persistent.LastIndex())
+	}
+	for _, peer := range r.State.Voters() {
+		matched = append(matched, peer.match())
+	}
+	majority := r.State.GetMajority()
+	if len(matched) < majority {
+		return
+	}
+	slices.SortFunc(matched, func(a, b uint) int {
+		return cmp.Compare(b, a)
+	})
+
+	index := matched[majority-1]
+	if r.State.termOfIndex(index) != term || !r.State.IsLeader() || r.State.Persistent.GetCurrentTerm() != term {
+		return
+	}
+	if r.State.commitUpTo(index) {
+		r.applyCommitted()
+	}
+}
+
+// extendLease extends the lease of the leader to the time a majority of the cluster, counting this server, last
+// acknowledged its leadership. A leader that transfers its leadership gave its lease up and does not extend it.
+func (r *Raft) extendLease(term uint) {
+	if r.transferring.Load() {
+		return
+	}
+	now := r.State.clock.Now()
+	var acknowledged []int64
+	if r.State.isVoter(r.State.self) {
+		acknowledged = append(acknowledged, now.UnixNano())
+	}
+	for _, peer := range r.State.Voters() {
+		acknowledged = append(acknowledged, peer.acknowledged.Load())
+	}
+	majority := r.State.GetMajority()
+	if len(acknowledged) < majority {
+		return
+	}
+	slices.SortFunc(acknowledged, func(a, b int64) int {
+		return cmp.Compare(b, a)
+	})
+	if start := acknowledged[majority-1]; start > 0 {
+		r.lease.extend(term, time.Unix(0, start), r.State.timing.electionTimeoutMin, r.config.MaxClockDriftPercent)
+	}
+}
@@ -0,0 +1,122 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+)
+
+func TestNextBatch(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxLogBatch = 3
+	cfg.MaxLogBatchBytes = 10
+	node := newNode(t, cfg, NewInMemoryNetwork().Transport("127.0.0.1:9001"))
+	for _, size := range []int{4, 4, 4, 20, 1, 1, 1, 1} {
+		if _, err := node.State.Persistent.Append(storage.LogEntry{Term: 1, Data: make([]byte, size)}); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+
+	tests := []struct {
+		index    uint
+		expected int
+	}{
+		{index: 1, expected: 2}, // the third entry exceeds the byte limit
+		{index: 4, expected: 1}, // an entry larger than the limit is sent on its own
+		{index: 5, expected: 3}, // at most MaxLogBatch entries are sent
+		{index: 8, expected: 1},
+		{index: 9, expected: 0},
+	}
+	for _, test := range tests {
+		if batch := node.nextBatch(test.index); len(batch) != test.expected {
+			t.Errorf("Expected a batch of %d entries at index %d, got %d", test.expected, test.index, len(batch))
+		}
+	}
+}
+
+func TestLeaderCommitsANoOp(t *testing.T) {
+	leader, servers := startCluster(t, 3)
+	_, term := leader.State.Leadership()
+
+	// the no-op is the first entry of the term of the leader
+	index := leader.State.Persistent.LastIndex()
+	for index > 1 && leader.State.termOfIndex(index-1) == term {
+		index--
+	}
+	if entry := leader.State.Persistent.GetEntryOfIndex(index); entry == nil || entry.Type != storage.EntryNoOp {
+		t.Fatalf("Expected a no-op at the start of term %v, got %+v", term, entry)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, server := range servers {
+		for server.State.CommitIndex() < index {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %v to commit the no-op at index %v, got commit index %v", server.State.self, index,
+					server.State.CommitIndex())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestCommitOnlyEntriesOfTheCurrentTerm(t *testing.T) {
+	// the leader of term 3 holds entries of terms 1 and 2 that a majority stores, like in figure 8 of the Raft paper
+	node := newFollower(t, 1, 2)
+	if err := node.State.Persistent.SetCurrentTerm(3); err != nil {
+		t.Fatalf("Failed to set term: %v", err)
+	}
+	node.State.setMembership(configuration{members: []string{node.State.self, "b", "c"}}, 0)
+	node.State.setRole(Leader, 3)
+	follower := node.State.peer("b")
+
+	follower.matchIndex = 2
+	node.advanceCommitIndex(3)
+	if commitIndex := node.State.CommitIndex(); commitIndex != 0 {
+		t.Fatalf("Expected the entries of the previous terms not to be committed by counting, got commit index %v", commitIndex)
+	}
+
+	// they are committed along with an entry of the current term
+	if _, err := node.State.Persistent.Append(storage.LogEntry{Version: storage.EntryVersion, Type: storage.EntryNoOp, Term: 3}); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	follower.matchIndex = 3
+	node.advanceCommitIndex(3)
+	if commitIndex, lastApplied := node.State.CommitIndex(), node.State.LastApplied(); commitIndex != 3 || lastApplied != 3 {
+		t.Errorf("Expected the entries to be committed and applied up to index 3, got %v and %v", commitIndex, lastApplied)
+	}
+}
+
+// BenchmarkReplication measures the throughput of a three server cluster as the number of concurrent writers grows.
+// Writes proposed while the followers are busy are replicated together in the next batch.
+func BenchmarkReplication(b *testing.B) {
+	for _, writers := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			leader, _ := startCluster(b, 3)
+			pair := []types.Type{types.KeyValue{Key: types.String("key"), Value: types.String("value")}}
+
+			b.ResetTimer()
+			start := time.Now()
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := w; i < b.N; i += writers {
+						ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+						if err := leader.Put(ctx, pair); err != nil {
+							b.Errorf("Put failed: %v", err)
+						}
+						cancel()
+					}
+				}(w)
+			}
+			wg.Wait()
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "writes/s")
+		})
+	}
+}
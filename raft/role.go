@@ -0,0 +1,142 @@
+package raft
+
+import (
+	"sync"
+)
+
+// Role is the part a server plays in the cluster (section 5.1 of the Raft paper).
+type Role uint8
+
+const (
+	// Follower answers the requests of the leader and the candidates
+	Follower Role = iota
+	// Candidate asks the other voters for their votes to become the leader of its term
+	Candidate
+	// Leader accepts the proposals and replicates its log to the other servers
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return "unknown"
+	}
+}
+
+// RoleChange tells the observers of a server that it took on a new role in term.
+type RoleChange struct {
+	Role Role
+	Term uint
+}
+
+// Only the event loop of the server changes its role. The RPC handlers and the replication goroutines persist the
+// newer terms they see and wake the loop up, and the loop steps down. A leader is the leader of a single term: it
+// stops acting as one as soon as a newer term was persisted, even before the loop handled it.
+
+// role is the role of the server and the term it took it on in, it is written by the event loop only.
+type role struct {
+	mutex sync.RWMutex
+	role  Role
+	term  uint
+	// notified whenever the role changes, for the goroutines of this server that wait for it
+	changed signal
+
+	// the observers of the role changes, each channel holds the latest change it was not given yet
+	observersMutex  sync.Mutex
+	roleObservers   []chan RoleChange
+	leaderObservers []chan bool
+}
+
+// Role returns the current role of this server and the term it took it on in.
+func (s *State) Role() (Role, uint) {
+	s.role.mutex.RLock()
+	defer s.role.mutex.RUnlock()
+	return s.role.role, s.role.term
+}
+
+// IsLeader reports whether this server is the leader of the current term.
+func (s *State) IsLeader() bool {
+	isLeader, _ := s.Leadership()
+	return isLeader
+}
+
+// Leadership reports whether this server is the leader of the current term and the term it was elected in.
+func (s *State) Leadership() (bool, uint) {
+	role, term := s.Role()
+	if role != Leader || s.Persistent.GetCurrentTerm() != term {
+		return false, 0
+	}
+	return true, term
+}
+
+// setRole makes role the role of this server in term and tells the observers about it.
+func (s *State) setRole(role Role, term uint) {
+	s.role.mutex.Lock()
+	previous, previousTerm := s.role.role, s.role.term
+	s.role.role, s.role.term = role, term
+	s.role.mutex.Unlock()
+	if previous == role && previousTerm == term {
+		return
+	}
+	s.role.changed.notify()
+
+	s.role.observersMutex.Lock()
+	defer s.role.observersMutex.Unlock()
+	for _, observer := range s.role.roleObservers {
+		sendLatest(observer, RoleChange{Role: role, Term: term})
+	}
+	if (previous == Leader) != (role == Leader) {
+		for _, observer := range s.role.leaderObservers {
+			sendLatest(observer, role == Leader)
+		}
+	}
+}
+
+// RoleCh returns a channel that receives the role changes of this server. An observer that falls behind misses the
+// changes in between and receives the latest one.
+func (r *Raft) RoleCh() <-chan RoleChange {
+	observer := make(chan RoleChange, 1)
+	r.State.role.observersMutex.Lock()
+	defer r.State.role.observersMutex.Unlock()
+	r.State.role.roleObservers = append(r.State.role.roleObservers, observer)
+	return observer
+}
+
+// LeaderCh returns a channel that receives true when this server becomes the leader and false when it stops being
+// the leader. An observer that falls behind receives the latest value only.
+func (r *Raft) LeaderCh() <-chan bool {
+	observer := make(chan bool, 1)
+	r.State.role.observersMutex.Lock()
+	defer r.State.role.observersMutex.Unlock()
+	r.State.role.leaderObservers = append(r.State.role.leaderObservers, observer)
+	return observer
+}
+
+// sendLatest replaces the value waiting in the channel, whose buffer holds a single value, by value.
+func sendLatest[T any](observer chan T, value T) {
+	for {
+		select {
+		case observer <- value:
+			return
+		default:
+		}
+		select {
+		case <-observer:
+		default:
+		}
+	}
+}
+
+// wake tells the event loop that the term changed or that the role of this server has to be checked.
+func (r *Raft) wake() {
+	select {
+	case r.events <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,92 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLeaderCh(t *testing.T) {
+	leader, servers := startCluster(t, 3)
+	var target *Raft
+	for _, server := range servers {
+		if server != leader {
+			target = server
+			break
+		}
+	}
+	lost, won := leader.LeaderCh(), target.LeaderCh()
+	changes := target.RoleCh()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.TransferLeadership(ctx, target.State.self); err != nil {
+		t.Fatalf("Failed to transfer the leadership: %v", err)
+	}
+
+	for _, expected := range []struct {
+		observer <-chan bool
+		isLeader bool
+	}{{lost, false}, {won, true}} {
+		select {
+		case isLeader := <-expected.observer:
+			if isLeader != expected.isLeader {
+				t.Errorf("Expected the leadership to be %v, got %v", expected.isLeader, isLeader)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Expected the leadership change to be observed")
+		}
+	}
+	// the candidacy was replaced by the latest change
+	select {
+	case change := <-changes:
+		if _, term := target.State.Leadership(); change.Role != Leader || change.Term != term {
+			t.Errorf("Expected the role change to the leader of term %v, got %+v", term, change)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Expected the role change to be observed")
+	}
+}
+
+func TestLeaderOfAnOlderTerm(t *testing.T) {
+	node := newFollower(t, 1)
+	node.State.setRole(Leader, 1)
+	if !node.State.IsLeader() {
+		t.Fatalf("Expected the server to be the leader of term 1")
+	}
+
+	// the event loop is not running, the server stops acting as the leader before it stepped down
+	node.compareTerms(2)
+	if node.State.IsLeader() {
+		t.Errorf("Expected the leader of term 1 not to lead term 2")
+	}
+	var notLeader *NotLeaderError
+	if _, err := node.Propose(Command{}); !errors.As(err, &notLeader) {
+		t.Errorf("Expected a proposal to fail with a NotLeaderError, got %v", err)
+	}
+	if node.stillIn(Leader, 1) {
+		t.Errorf("Expected the event loop to step down")
+	}
+	if role, term := node.State.Role(); role != Follower || term != 2 {
+		t.Errorf("Expected a follower of term 2, got a %v of term %v", role, term)
+	}
+}
+
+func TestCandidateHearsFromTheLeader(t *testing.T) {
+	node := newFollower(t, 1, 2)
+	node.State.setRole(Candidate, 2)
+
+	request := AppendRequest{Term: 2, LeaderId: "a", PrevLogIndex: 2, PreLogTerm: 2}
+	if err := NewRpcController(node, zap.NewNop()).Append(request, new(AppendResponse)); err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+	if node.stillIn(Candidate, 2) {
+		t.Errorf("Expected a candidate that heard from the leader of its term to step down")
+	}
+	if role, _ := node.State.Role(); role != Follower {
+		t.Errorf("Expected a follower, got a %v", role)
+	}
+}
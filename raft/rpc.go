@@ -4,18 +4,28 @@ import (
 	"fmt"
 	"github.com/MohammedShetaya/kayakdb/raft/storage"
 	"go.uber.org/zap"
+	"reflect"
+	"slices"
 )
 
+// Every request carries the id of the cluster of its sender, servers of another cluster reject it.
+
 type VoteRequest struct {
 	Term         uint
 	CandidateId  string
+	ClusterId    string
 	LastLogIndex uint
 	LastLogTerm  uint
+	// the id of the leader that asked the candidate to take over its leadership with TimeoutNow, empty for an election
+	// that was not started on request of the leader
+	TransferFrom string
 }
 
 type AppendRequest struct {
 	Term         uint
 	LeaderId     string
+	LeaderAddr   string // client address of the leader, followers redirect clients to it
+	ClusterId    string
 	PrevLogIndex uint
 	PreLogTerm   uint
 	LeaderCommit uint
@@ -23,20 +33,65 @@ type AppendRequest struct {
 }
 
 type PingRequest struct {
-	Term uint
+	Term       uint
+	LeaderId   string
+	LeaderAddr string
+	ClusterId  string
+}
+
+// InstallSnapshotRequest carries one chunk of the leader's snapshot, chunks are sent in order starting at offset 0.
+type InstallSnapshotRequest struct {
+	Term              uint
+	LeaderId          string
+	LeaderAddr        string
+	ClusterId         string
+	LastIncludedIndex uint
+	LastIncludedTerm  uint
+	Members           []string
+	Learners          []string
+	Witnesses         []string
+	Offset            uint
+	Data              []byte
+	Done              bool
+}
+
+// TimeoutNowRequest is sent by a leader that transfers its leadership, the receiver starts an election right away.
+type TimeoutNowRequest struct {
+	Term      uint
+	LeaderId  string
+	ClusterId string
 }
 
 type VoteResponse struct {
+	// the current term of the voter, a candidate with an older term steps down
+	Term        uint
+	VoteGranted bool
 }
 
 type AppendResponse struct {
-	CommitIndex uint
+	// the current term of the follower, a leader with an older term steps down
+	Term    uint
+	Success bool
+	// when the log did not match, ConflictTerm is the term of the follower's entry at PrevLogIndex (0 if it has none)
+	// and ConflictIndex is the first index of that term, or the index the follower expects next
+	ConflictTerm  uint
+	ConflictIndex uint
+	CommitIndex   uint
+	// the id of the follower, the leader resolves the target of a leadership transfer given by id with it
+	ServerId string
 }
 
 // PingResponse no need for extra fields on a ping
 type PingResponse struct {
 }
 
+type InstallSnapshotResponse struct {
+	Term uint
+}
+
+type TimeoutNowResponse struct {
+}
+
 type RpcController struct {
 	logger *zap.Logger
 	raft   *Raft
@@ -50,55 +105,251 @@ func NewRpcController(raft *Raft, logger *zap.Logger) *RpcController {
 	return controller
 }
 
+// Handle decodes a gob encoded request, calls the RPC method the same way net/rpc does and returns the gob encoded
+// response. It lets transports other than net/rpc serve the controller.
+func (c *RpcController) Handle(method string, request []byte) ([]byte, error) {
+	m := reflect.ValueOf(c).MethodByName(method)
+	if !m.IsValid() {
+		return nil, fmt.Errorf("rpc: can't find method RpcController.%v", method)
+	}
+
+	req := reflect.New(m.Type().In(0))
+	if err := decode(request, req.Interface()); err != nil {
+		return nil, err
+	}
+	resp := reflect.New(m.Type().In(1).Elem())
+
+	returns := m.Call([]reflect.Value{req.Elem(), resp})
+	if err, _ := returns[0].Interface().(error); err != nil {
+		return nil, err
+	}
+	return encode(resp.Interface())
+}
+
+// Vote grants the vote of this server to a candidate (section 5.2 of the Raft paper). A refused vote is not an
+// error, the response tells the candidate the vote was not granted along with the term of this server.
 func (c *RpcController) Vote(request VoteRequest, response *VoteResponse) error {
+	if !c.raft.enter() {
+		return ErrShutdown
+	}
+	defer c.raft.leave()
 	c.logger.Debug("Received a voting request from", zap.String("candidate", request.CandidateId))
-	if request.Term < c.raft.State.Persistent.GetCurrentTerm() {
-		return fmt.Errorf("request term is less than current term of: %v", c.raft.State.Persistent.GetCurrentTerm())
+	if err := c.checkCluster(request.ClusterId, false); err != nil {
+		return err
 	}
-	if c.raft.State.Persistent.GetVotedFor() == "" &&
-		c.raft.State.CommitIndex <= request.LastLogIndex {
-		// this is unset when a newer term is received or if the server became a candidate
-		err := c.raft.State.Persistent.SetVotedFor(request.CandidateId)
-		if err != nil {
-			c.logger.Debug(fmt.Sprintf("Failed to set votedFor %v", request.CandidateId), zap.Error(err))
-			return fmt.Errorf("server failed to persist the voted for value")
-		}
+	state := c.raft.State
+
+	response.Term = state.Persistent.GetCurrentTerm()
+	// a server that heard from a leader recently does not help to replace it, this keeps the lease of the leader valid.
+	// The leader gives up its lease when it transfers the leadership
+	if reason := c.voteRefusal(request, !c.transferredBy(request, response.Term)); reason != "" {
+		c.refuseVote(request, reason)
+		return nil
+	}
+
+	c.raft.compareTerms(request.Term)
+	state.voteMutex.Lock()
+	defer state.voteMutex.Unlock()
+	response.Term = state.Persistent.GetCurrentTerm()
+	if response.Term != request.Term {
+		c.refuseVote(request, fmt.Sprintf("request term is less than current term of: %v", response.Term))
+		return nil
+	}
+	// only one vote is granted per term. votedFor is unset when a newer term is received
+	if votedFor := state.Persistent.GetVotedFor(); votedFor != "" && votedFor != request.CandidateId {
+		c.refuseVote(request, fmt.Sprintf("already voted for %v in term %v", votedFor, request.Term))
+		return nil
+	}
+	if !c.candidateUpToDate(request) {
+		c.refuseVote(request, "the log of the candidate is behind the log of this server")
+		return nil
+	}
+	err := state.Persistent.SetVotedFor(request.CandidateId)
+	if err != nil {
+		c.logger.Debug(fmt.Sprintf("Failed to set votedFor %v", request.CandidateId), zap.Error(err))
+		return fmt.Errorf("server failed to persist the voted for value")
+	}
+	response.VoteGranted = true
+	return nil
+}
+
+// PreVote tells a server that is about to start an election whether this server would vote for it. It grants the
+// vote under the same conditions as Vote but does not change the term or the vote of this server.
+func (c *RpcController) PreVote(request VoteRequest, response *VoteResponse) error {
+	if !c.raft.enter() {
+		return ErrShutdown
+	}
+	defer c.raft.leave()
+	c.logger.Debug("Received a pre-vote request from", zap.String("candidate", request.CandidateId))
+	if err := c.checkCluster(request.ClusterId, false); err != nil {
+		return err
+	}
+
+	response.Term = c.raft.State.Persistent.GetCurrentTerm()
+	if reason := c.voteRefusal(request, true); reason != "" {
+		c.refuseVote(request, reason)
+		return nil
+	}
+	if !c.candidateUpToDate(request) {
+		c.refuseVote(request, "the log of the candidate is behind the log of this server")
+		return nil
 	}
+	response.VoteGranted = true
 	return nil
 }
 
+// voteRefusal returns why this server refuses to vote for the candidate regardless of its log and of the votes it
+// granted, or an empty string. With checkLeader set, the vote is refused while a leader was heard from recently.
+func (c *RpcController) voteRefusal(request VoteRequest, checkLeader bool) string {
+	state := c.raft.State
+	if term := state.Persistent.GetCurrentTerm(); request.Term < term {
+		return fmt.Sprintf("request term is less than current term of: %v", term)
+	}
+	if state.isLearner(state.self) {
+		return "this server is a learner and does not vote"
+	}
+	if checkLeader && state.heardFromLeader() {
+		return "the current leader was heard from within the minimum election timeout"
+	}
+	return ""
+}
+
+// transferredBy reports whether the candidate runs in the election the current leader of this server asked it to start
+// to take over its leadership, term being the current term of this server. The leader gave up its lease before, the
+// claim of a candidate that was not asked by that leader, or that skipped a term since, is not trusted.
+func (c *RpcController) transferredBy(request VoteRequest, term uint) bool {
+	if request.TransferFrom == "" || request.Term != term+1 {
+		return false
+	}
+	leaderId, _ := c.raft.State.Leader()
+	return leaderId == request.TransferFrom
+}
+
+func (c *RpcController) refuseVote(request VoteRequest, reason string) {
+	c.logger.Debug("Refused to vote", zap.String("candidate", request.CandidateId), zap.Uint("term", request.Term),
+		zap.String("reason", reason))
+}
+
+// candidateUpToDate reports whether the log of the candidate is at least as up to date as the log of this server:
+// its last entry has a higher term, or the same term and an index at least as high (section 5.4.1 of the Raft paper).
+func (c *RpcController) candidateUpToDate(request VoteRequest) bool {
+	lastIndex := c.raft.State.Persistent.LastIndex()
+	lastTerm := c.raft.State.termOfIndex(lastIndex)
+	if request.LastLogTerm != lastTerm {
+		return request.LastLogTerm > lastTerm
+	}
+	return request.LastLogIndex >= lastIndex
+}
+
 func (c *RpcController) Append(request AppendRequest, response *AppendResponse) error {
+	if !c.raft.enter() {
+		return ErrShutdown
+	}
+	defer c.raft.leave()
 	c.logger.Debug("Received an append request from", zap.String("leader", request.LeaderId))
-	// check if there is a log entry on this server at index PrevLogIndex that has the same PreLogTerm
-	// also check if the leader is not expired
-	if l := c.raft.State.Persistent.GetEntryOfIndex(request.PrevLogIndex); request.Term < c.raft.State.Persistent.GetCurrentTerm() || (l != nil && l.Term != request.PreLogTerm) {
-		return fmt.Errorf("missmatched logs or terms")
+	if err := c.checkCluster(request.ClusterId, true); err != nil {
+		return err
+	}
+	state := c.raft.State
+
+	// reply with the current term so that an expired leader can step down
+	response.Term = state.Persistent.GetCurrentTerm()
+	response.ServerId = state.ServerId
+	if request.Term < response.Term {
+		return nil
 	}
 	// at this point this server should become a follower. become one if not.
 	c.raft.compareTerms(request.Term)
 	c.raft.resetFollowerTimer()
+	state.setLeader(request.LeaderId, request.LeaderAddr)
+	// a candidate of the same term steps down
+	c.raft.wake()
+	response.Term = state.Persistent.GetCurrentTerm()
 
-	// now the incoming logs are checked to be valid. Append them all and override if there are other logs at the same index.
-	err := c.raft.State.Persistent.AppendMany(request.PrevLogIndex+1, request.Entries)
-	if err != nil {
-		c.logger.Debug("Error appending logs", zap.Error(err))
-		return fmt.Errorf("error appending logs: %w", err)
+	// the leader pipelines its requests, they are handled one at a time in whatever order they arrive
+	c.raft.appendMutex.Lock()
+	defer c.raft.appendMutex.Unlock()
+
+	// check if there is a log entry on this server at index PrevLogIndex that has the same PreLogTerm. If not, the
+	// leader is told where the logs diverge so that it can skip a whole term per round trip
+	if !c.logMatches(request, response) {
+		return nil
+	}
+
+	// entries of a newer version are refused rather than applied without being understood
+	if i := slices.IndexFunc(request.Entries, func(e storage.LogEntry) bool {
+		return e.Version > storage.EntryVersion
+	}); i >= 0 {
+		return fmt.Errorf("unsupported log entry version: %v", request.Entries[i].Version)
+	}
+
+	// now the incoming logs are checked to be valid. Entries this server already has are skipped, so that a delayed
+	// request never truncates entries that a later one appended. The rest override the conflicting entries.
+	matched := state.Persistent.FindLastMatchingIndex(request.PrevLogIndex, request.Entries)
+	if entries := request.Entries[matched-request.PrevLogIndex:]; len(entries) > 0 {
+		if err := state.Persistent.AppendMany(matched+1, entries); err != nil {
+			c.logger.Debug("Error appending logs", zap.Error(err))
+			return fmt.Errorf("error appending logs: %w", err)
+		}
+	}
+
+	// a configuration entry was received or the one in effect might have been overwritten
+	_, membershipIndex := c.raft.State.membership()
+	if membershipIndex > request.PrevLogIndex || slices.ContainsFunc(request.Entries, func(e storage.LogEntry) bool {
+		return e.Type == storage.EntryConfiguration
+	}) {
+		c.raft.State.reloadMembership()
 	}
 
 	var idx uint
-	if request.LeaderCommit > c.raft.State.CommitIndex {
+	if request.LeaderCommit > c.raft.State.CommitIndex() {
 		// set the commit index to min(leader commit, index of last received log)
 		idx = min(request.LeaderCommit, request.PrevLogIndex+uint(len(request.Entries)))
-		c.raft.State.CommitIndex = idx
+		if c.raft.State.commitUpTo(idx) {
+			c.raft.applyCommitted()
+		}
 	}
 
 	response.CommitIndex = idx
+	response.Success = true
 
 	return nil
 }
 
+// logMatches reports whether the log of this server has the entry at PrevLogIndex with the term PreLogTerm. If it
+// does not, the response is filled in with the conflict.
+func (c *RpcController) logMatches(request AppendRequest, response *AppendResponse) bool {
+	state := c.raft.State
+	lastIndex := state.Persistent.LastIndex()
+	snapshotIndex, _ := state.snapshotted()
+	switch {
+	case request.PrevLogIndex > lastIndex:
+		// the log is too short, the leader continues after its last entry
+		response.ConflictIndex = lastIndex + 1
+	case request.PrevLogIndex < snapshotIndex:
+		// the entry was compacted and is known to be committed, the leader continues after the snapshot
+		response.ConflictIndex = snapshotIndex + 1
+	case state.termOfIndex(request.PrevLogIndex) != request.PreLogTerm:
+		response.ConflictTerm = state.termOfIndex(request.PrevLogIndex)
+		response.ConflictIndex = request.PrevLogIndex
+		for response.ConflictIndex-1 > snapshotIndex && state.termOfIndex(response.ConflictIndex-1) == response.ConflictTerm {
+			response.ConflictIndex--
+		}
+	default:
+		return true
+	}
+	return false
+}
+
 // Ping should be used by leaders to send empty heartbeats to followers in case the log is synced with the leader
 func (c *RpcController) Ping(request PingRequest, response *PingResponse) error {
+	if !c.raft.enter() {
+		return ErrShutdown
+	}
+	defer c.raft.leave()
+	if err := c.checkCluster(request.ClusterId, true); err != nil {
+		return err
+	}
 
 	// don't accept anything from an expired leader
 	if request.Term < c.raft.State.Persistent.GetCurrentTerm() {
@@ -106,6 +357,99 @@ func (c *RpcController) Ping(request PingRequest, response *PingResponse) error
 	}
 	c.raft.compareTerms(request.Term)
 	c.raft.resetFollowerTimer()
+	c.raft.State.setLeader(request.LeaderId, request.LeaderAddr)
+	// a candidate of the same term steps down
+	c.raft.wake()
+
+	return nil
+}
+
+// InstallSnapshot receives the snapshot of the leader chunk by chunk. Once the last chunk arrived the state machine and
+// the log of this server are reset from it.
+func (c *RpcController) InstallSnapshot(request InstallSnapshotRequest, response *InstallSnapshotResponse) error {
+	if !c.raft.enter() {
+		return ErrShutdown
+	}
+	defer c.raft.leave()
+	c.logger.Debug("Received an install snapshot request from", zap.String("leader", request.LeaderId), zap.Uint("offset", request.Offset))
+	if err := c.checkCluster(request.ClusterId, true); err != nil {
+		return err
+	}
+	state := c.raft.State
+
+	// reply with the current term so that an expired leader can step down
+	response.Term = state.Persistent.GetCurrentTerm()
+	if request.Term < response.Term {
+		return nil
+	}
+	c.raft.compareTerms(request.Term)
+	c.raft.resetFollowerTimer()
+	state.setLeader(request.LeaderId, request.LeaderAddr)
+	// a candidate of the same term steps down
+	c.raft.wake()
+	response.Term = state.Persistent.GetCurrentTerm()
+
+	// the chunks are handled one at a time, and never while entries of the leader are being appended
+	c.raft.appendMutex.Lock()
+	defer c.raft.appendMutex.Unlock()
 
+	if request.Offset == 0 {
+		state.pendingSnapshot = nil
+	}
+	if request.Offset != uint(len(state.pendingSnapshot)) {
+		return fmt.Errorf("unexpected snapshot chunk at offset %v, expected offset %v", request.Offset, len(state.pendingSnapshot))
+	}
+	state.pendingSnapshot = append(state.pendingSnapshot, request.Data...)
+	if !request.Done {
+		return nil
+	}
+
+	data := state.pendingSnapshot
+	state.pendingSnapshot = nil
+	// everything covered by the snapshot is already known to this server
+	if snapshotIndex, _ := state.snapshotted(); request.LastIncludedIndex <= snapshotIndex || request.LastIncludedIndex <= state.CommitIndex() {
+		return nil
+	}
+
+	err := c.raft.installSnapshot(&storage.Snapshot{
+		LastIncludedIndex: request.LastIncludedIndex,
+		LastIncludedTerm:  request.LastIncludedTerm,
+		Members:           request.Members,
+		Learners:          request.Learners,
+		Witnesses:         request.Witnesses,
+		Data:              data,
+	})
+	if err != nil {
+		c.logger.Error("Failed to install snapshot", zap.Error(err))
+		return fmt.Errorf("error installing snapshot: %w", err)
+	}
+	c.logger.Info("Installed snapshot from leader", zap.String("leader", request.LeaderId), zap.Uint("last_included_index", request.LastIncludedIndex))
+	return nil
+}
+
+// TimeoutNow is sent by the leader once the log of this server is up to date, to make it the next leader.
+func (c *RpcController) TimeoutNow(request TimeoutNowRequest, response *TimeoutNowResponse) error {
+	if !c.raft.enter() {
+		return ErrShutdown
+	}
+	defer c.raft.leave()
+	c.logger.Info("Received a timeout now request from", zap.String("leader", request.LeaderId))
+	if err := c.checkCluster(request.ClusterId, true); err != nil {
+		return err
+	}
+	if request.Term < c.raft.State.Persistent.GetCurrentTerm() {
+		return fmt.Errorf("request term is less than current term of: %v", c.raft.State.Persistent.GetCurrentTerm())
+	}
+	// the voters only vote for the target while they hear from the leader if the leader is the one they follow
+	if leaderId, _ := c.raft.State.Leader(); request.Term != c.raft.State.Persistent.GetCurrentTerm() || leaderId != request.LeaderId {
+		return fmt.Errorf("the request is not from the current leader of this server")
+	}
+	if !c.raft.State.isElectable(c.raft.State.self) {
+		return fmt.Errorf("this server cannot become the leader of the cluster")
+	}
+	select {
+	case c.raft.timeoutNow <- request.LeaderId:
+	default:
+	}
 	return nil
 }
@@ -0,0 +1,316 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"go.uber.org/zap"
+)
+
+func entriesOfTerms(terms ...uint) []storage.LogEntry {
+	var entries []storage.LogEntry
+	for _, term := range terms {
+		entries = append(entries, storage.LogEntry{Version: storage.EntryVersion, Term: term})
+	}
+	return entries
+}
+
+func TestAppend(t *testing.T) {
+	tests := []struct {
+		name     string
+		log      []uint
+		request  AppendRequest
+		expected AppendResponse
+		// the last entry of the log after a successful append
+		lastIndex uint
+		lastTerm  uint
+	}{
+		{
+			name:      "matching entries are appended",
+			log:       []uint{1, 1, 2},
+			request:   AppendRequest{Term: 2, PrevLogIndex: 3, PreLogTerm: 2, Entries: entriesOfTerms(2, 2)},
+			expected:  AppendResponse{Term: 2, Success: true},
+			lastIndex: 5,
+			lastTerm:  2,
+		},
+		{
+			name:     "a stale leader is told the current term",
+			log:      []uint{1, 3},
+			request:  AppendRequest{Term: 2, PrevLogIndex: 2, PreLogTerm: 3},
+			expected: AppendResponse{Term: 3},
+		},
+		{
+			name:     "a short log reports the index it expects next",
+			log:      []uint{1, 1},
+			request:  AppendRequest{Term: 3, PrevLogIndex: 5, PreLogTerm: 3},
+			expected: AppendResponse{Term: 3, ConflictIndex: 3},
+		},
+		{
+			name:     "a conflicting entry reports the first index of its term",
+			log:      []uint{1, 2, 2, 2},
+			request:  AppendRequest{Term: 4, PrevLogIndex: 4, PreLogTerm: 3},
+			expected: AppendResponse{Term: 4, ConflictTerm: 2, ConflictIndex: 2},
+		},
+		{
+			name:      "conflicting entries after the match are replaced",
+			log:       []uint{1, 2, 2},
+			request:   AppendRequest{Term: 3, PrevLogIndex: 1, PreLogTerm: 1, Entries: entriesOfTerms(3)},
+			expected:  AppendResponse{Term: 3, Success: true},
+			lastIndex: 2,
+			lastTerm:  3,
+		},
+		{
+			name:      "a delayed request does not truncate the entries that follow it",
+			log:       []uint{1, 2, 2},
+			request:   AppendRequest{Term: 2, PrevLogIndex: 1, PreLogTerm: 1, Entries: entriesOfTerms(2)},
+			expected:  AppendResponse{Term: 2, Success: true},
+			lastIndex: 3,
+			lastTerm:  2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newFollower(t, test.log...)
+			lastIndex := node.State.Persistent.LastIndex()
+
+			response := new(AppendResponse)
+			if err := NewRpcController(node, zap.NewNop()).Append(test.request, response); err != nil {
+				t.Fatalf("Append failed: %v", err)
+			}
+			// every answer tells the leader who the follower is
+			test.expected.ServerId = node.State.ServerId
+			if *response != test.expected {
+				t.Errorf("Expected the response %+v, got %+v", test.expected, *response)
+			}
+			if !test.expected.Success {
+				if last := node.State.Persistent.LastIndex(); last != lastIndex {
+					t.Errorf("Expected the log to be unchanged, got the last index %d", last)
+				}
+				return
+			}
+			if last := node.State.Persistent.LastIndex(); last != test.lastIndex || node.State.termOfIndex(last) != test.lastTerm {
+				t.Errorf("Expected the log to end at index %d of term %d, got index %d of term %d",
+					test.lastIndex, test.lastTerm, last, node.State.termOfIndex(last))
+			}
+		})
+	}
+}
+
+func TestVote(t *testing.T) {
+	tests := []struct {
+		name string
+		// the log and the vote of the voter, its current term is the term of its last entry
+		log      []uint
+		votedFor string
+		// the voter heard from a leader within the minimum election timeout
+		leader   bool
+		request  VoteRequest
+		expected VoteResponse
+	}{
+		{
+			name:     "a candidate of an older term is told the current term",
+			log:      []uint{1, 2},
+			request:  VoteRequest{Term: 1, CandidateId: "a", LastLogIndex: 5, LastLogTerm: 2},
+			expected: VoteResponse{Term: 2},
+		},
+		{
+			name:     "a log whose last term is higher is more up to date even if it is shorter",
+			log:      []uint{1, 1, 2},
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 1, LastLogTerm: 3},
+			expected: VoteResponse{Term: 3, VoteGranted: true},
+		},
+		{
+			name:     "a log whose last term is lower is behind even if it is longer",
+			log:      []uint{1, 1, 2},
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 10, LastLogTerm: 1},
+			expected: VoteResponse{Term: 3},
+		},
+		{
+			name:     "a longer log of the same last term is more up to date",
+			log:      []uint{1, 1, 2},
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 4, LastLogTerm: 2},
+			expected: VoteResponse{Term: 3, VoteGranted: true},
+		},
+		{
+			name:     "an identical log is up to date",
+			log:      []uint{1, 1, 2},
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 3, LastLogTerm: 2},
+			expected: VoteResponse{Term: 3, VoteGranted: true},
+		},
+		{
+			name:     "a shorter log of the same last term is behind",
+			log:      []uint{1, 1, 2},
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2},
+			expected: VoteResponse{Term: 3},
+		},
+		{
+			name:     "only one candidate gets the vote of a term",
+			log:      []uint{1, 2},
+			votedFor: "b",
+			request:  VoteRequest{Term: 2, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2},
+			expected: VoteResponse{Term: 2},
+		},
+		{
+			name:     "a candidate that retries gets the vote again",
+			log:      []uint{1, 2},
+			votedFor: "a",
+			request:  VoteRequest{Term: 2, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2},
+			expected: VoteResponse{Term: 2, VoteGranted: true},
+		},
+		{
+			name:     "a newer term resets the vote",
+			log:      []uint{1, 2},
+			votedFor: "b",
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2},
+			expected: VoteResponse{Term: 3, VoteGranted: true},
+		},
+		{
+			name:     "a voter that heard from the leader recently refuses",
+			log:      []uint{1, 2},
+			leader:   true,
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2},
+			expected: VoteResponse{Term: 2},
+		},
+		{
+			name:     "the target of a leadership transfer gets the vote while the leader is heard from",
+			log:      []uint{1, 2},
+			leader:   true,
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2, TransferFrom: "leader"},
+			expected: VoteResponse{Term: 3, VoteGranted: true},
+		},
+		{
+			name:     "a transfer that another server asked for is not trusted",
+			log:      []uint{1, 2},
+			leader:   true,
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2, TransferFrom: "b"},
+			expected: VoteResponse{Term: 2},
+		},
+		{
+			name:     "a transfer from a term the voter did not follow is not trusted",
+			log:      []uint{1, 2},
+			leader:   true,
+			request:  VoteRequest{Term: 4, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2, TransferFrom: "leader"},
+			expected: VoteResponse{Term: 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newFollower(t, test.log...)
+			if err := node.State.Persistent.SetVotedFor(test.votedFor); err != nil {
+				t.Fatalf("Failed to set the vote: %v", err)
+			}
+			if test.leader {
+				node.State.setLeader("leader", "")
+			}
+
+			response := new(VoteResponse)
+			if err := NewRpcController(node, zap.NewNop()).Vote(test.request, response); err != nil {
+				t.Fatalf("Vote failed: %v", err)
+			}
+			if *response != test.expected {
+				t.Errorf("Expected the response %+v, got %+v", test.expected, *response)
+			}
+			// a granted vote is persisted, a refused one leaves the vote of the voter as it was
+			expectedVote := test.votedFor
+			if test.expected.VoteGranted {
+				expectedVote = test.request.CandidateId
+			}
+			if votedFor := node.State.Persistent.GetVotedFor(); votedFor != expectedVote {
+				t.Errorf("Expected the vote to be for %q, got %q", expectedVote, votedFor)
+			}
+		})
+	}
+}
+
+func TestPreVote(t *testing.T) {
+	tests := []struct {
+		name     string
+		leader   bool
+		request  VoteRequest
+		expected VoteResponse
+	}{
+		{
+			name:     "an up to date candidate would get the vote",
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2},
+			expected: VoteResponse{Term: 2, VoteGranted: true},
+		},
+		{
+			name:     "a candidate that is behind would not",
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 5, LastLogTerm: 1},
+			expected: VoteResponse{Term: 2},
+		},
+		{
+			name:     "a candidate of an older term would not",
+			request:  VoteRequest{Term: 1, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2},
+			expected: VoteResponse{Term: 2},
+		},
+		{
+			name:     "nobody would while the leader is heard from",
+			leader:   true,
+			request:  VoteRequest{Term: 3, CandidateId: "a", LastLogIndex: 2, LastLogTerm: 2, TransferFrom: "leader"},
+			expected: VoteResponse{Term: 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newFollower(t, 1, 2)
+			if test.leader {
+				node.State.setLeader("leader", "")
+			}
+
+			response := new(VoteResponse)
+			if err := NewRpcController(node, zap.NewNop()).PreVote(test.request, response); err != nil {
+				t.Fatalf("PreVote failed: %v", err)
+			}
+			if *response != test.expected {
+				t.Errorf("Expected the response %+v, got %+v", test.expected, *response)
+			}
+			// a pre-vote changes neither the term nor the vote
+			if term, votedFor := node.State.Persistent.GetCurrentTerm(), node.State.Persistent.GetVotedFor(); term != 2 || votedFor != "" {
+				t.Errorf("Expected term 2 without a vote, got term %v and a vote for %q", term, votedFor)
+			}
+		})
+	}
+}
+
+func TestHandleAppendResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response AppendResponse
+		expected uint
+	}{
+		{
+			name:     "the leader skips to the last entry of the conflicting term it has",
+			response: AppendResponse{Term: 5, ConflictTerm: 2, ConflictIndex: 3},
+			expected: 5,
+		},
+		{
+			name:     "the leader skips to the first entry of a conflicting term it does not have",
+			response: AppendResponse{Term: 5, ConflictTerm: 3, ConflictIndex: 4},
+			expected: 4,
+		},
+		{
+			name:     "the leader continues after the last entry of a short log",
+			response: AppendResponse{Term: 5, ConflictIndex: 2},
+			expected: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			leader := newFollower(t, 1, 2, 2, 2, 4, 5, 5)
+			peer := newPeer("127.0.0.1:9002", 8)
+			request := AppendRequest{Term: 5, PrevLogIndex: 7, PreLogTerm: 5}
+
+			if leader.handleAppendResponse(peer, request, &test.response) {
+				t.Fatalf("Expected a conflict not to be reported as a success")
+			}
+			if peer.nextIndex != test.expected {
+				t.Errorf("Expected the next index %d, got %d", test.expected, peer.nextIndex)
+			}
+		})
+	}
+}
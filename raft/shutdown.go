@@ -0,0 +1,123 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Shutdown stops the server. A leader first hands its leadership over to the voter with the most complete log, or
+// steps down if that fails, so the cluster does not wait an election timeout for a new leader. Then the server stops
+// serving RPCs, waits for the handlers and the background goroutines to return, stops the worker pool and closes
+// the storage driver. It returns early with the context error if the context is done before everything stopped.
+func (r *Raft) Shutdown(ctx context.Context) error {
+	if !r.stopping.CompareAndSwap(false, true) {
+		return nil
+	}
+	r.logger.Info("Shutting down raft")
+
+	if r.State.IsLeader() {
+		r.handOverLeadership(ctx)
+	}
+
+	// no background goroutine is started from now on
+	r.routinesMutex.Lock()
+	r.routinesClosed = true
+	r.routinesMutex.Unlock()
+	close(r.done)
+	r.proposals.fail(ErrShutdown)
+
+	var errs []error
+	if err := r.transport.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("unable to close the transport: %w", err))
+	}
+
+	// the handlers that already run are waited for, the ones that did not start yet are rejected
+	r.rpcGate.Lock()
+	r.rpcClosed = true
+	r.rpcGate.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		r.routines.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return errors.Join(append(errs, fmt.Errorf("background goroutines did not stop: %w", ctx.Err()))...)
+	}
+	// the event loop returned, a leader that could not hand its leadership over steps down
+	r.becomeFollower()
+
+	r.workerPool.Stop()
+	if err := r.State.Persistent.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("unable to close the storage driver: %w", err))
+	}
+	r.logger.Info("Raft was shut down")
+	return errors.Join(errs...)
+}
+
+// handOverLeadership transfers the leadership to the voter whose log is the most complete, witnesses and the voters
+// that were not heard from within an election timeout excluded. The transfer gives up after an election timeout, the
+// rest of the shutdown does not wait for a target that does not catch up.
+func (r *Raft) handOverLeadership(ctx context.Context) {
+	var target *Peer
+	for _, peer := range r.State.Voters() {
+		if peer.witness.Load() ||
+			r.State.clock.Now().Sub(time.Unix(0, peer.lastContact.Load())) >= r.State.timing.electionTimeoutMax {
+			continue
+		}
+		if target == nil || peer.match() > target.match() {
+			target = peer
+		}
+	}
+	if target == nil {
+		return
+	}
+	if err := r.TransferLeadership(ctx, target.addr); err != nil {
+		r.logger.Warn("Unable to transfer the leadership before shutting down, stepping down", zap.Error(err))
+	}
+}
+
+// spawn runs f in a background goroutine that Shutdown waits for. It reports false and does not run f once the
+// server shuts down.
+func (r *Raft) spawn(f func()) bool {
+	r.routinesMutex.RLock()
+	defer r.routinesMutex.RUnlock()
+	if r.routinesClosed {
+		return false
+	}
+	r.routines.Add(1)
+	go func() {
+		defer r.routines.Done()
+		f()
+	}()
+	return true
+}
+
+// running reports whether the background goroutines should keep running.
+func (r *Raft) running() bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// enter reports whether an RPC handler may run, a handler that may has to call leave once it returns.
+func (r *Raft) enter() bool {
+	r.rpcGate.RLock()
+	if r.rpcClosed {
+		r.rpcGate.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (r *Raft) leave() {
+	r.rpcGate.RUnlock()
+}
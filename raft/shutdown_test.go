@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestShutdownHandsLeadershipOver(t *testing.T) {
+	leader, servers := startCluster(t, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down the leader: %v", err)
+	}
+	if isLeader, _ := leader.State.Leadership(); isLeader {
+		t.Errorf("Expected the leader to step down")
+	}
+	if _, err := leader.Propose(Command{}); !errors.Is(err, ErrShutdown) {
+		t.Errorf("Expected a proposal to fail with %v, got %v", ErrShutdown, err)
+	}
+	controller := NewRpcController(leader, zap.NewNop())
+	if err := controller.Ping(PingRequest{}, new(PingResponse)); !errors.Is(err, ErrShutdown) {
+		t.Errorf("Expected an rpc to fail with %v, got %v", ErrShutdown, err)
+	}
+
+	// the leadership was handed over, the others do not wait for an election timeout to elect a new leader
+	var next *Raft
+	for _, server := range servers {
+		if isLeader, _ := server.State.Leadership(); isLeader && server != leader {
+			next = server
+		}
+	}
+	if next == nil {
+		t.Fatalf("Expected the leadership to be transferred before the shutdown")
+	}
+	if err := next.Put(ctx, []types.Type{types.KeyValue{Key: types.String("k"), Value: types.String("v")}}); err != nil {
+		t.Errorf("Expected the remaining servers to commit writes: %v", err)
+	}
+
+	if err := leader.Shutdown(ctx); err != nil {
+		t.Errorf("Expected a second shutdown to do nothing, got %v", err)
+	}
+}
+
+func TestShutdownBeforeStart(t *testing.T) {
+	node := newFollower(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := node.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down a server that never started: %v", err)
+	}
+	if err := node.Start(); !errors.Is(err, ErrShutdown) {
+		t.Errorf("Expected a server that was shut down to fail to start with %v, got %v", ErrShutdown, err)
+	}
+}
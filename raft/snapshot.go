@@ -0,0 +1,175 @@
+package raft
+
+import (
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"go.uber.org/zap"
+)
+
+// TakeSnapshot serializes the state machine up to LastApplied and lets the driver discard the log entries it covers.
+func (s *State) TakeSnapshot() error {
+	lastApplied := s.LastApplied()
+	if snapshotIndex, _ := s.snapshotted(); lastApplied <= snapshotIndex {
+		return nil
+	}
+	entry := s.Persistent.GetEntryOfIndex(lastApplied)
+	if entry == nil {
+		return fmt.Errorf("no log entry at the last applied index %d", lastApplied)
+	}
+
+	data, err := s.fsm.Snapshot()
+	if err != nil {
+		return fmt.Errorf("unable to serialize the state machine: %w", err)
+	}
+	c, _ := s.membershipAt(lastApplied)
+	snapshot := &storage.Snapshot{
+		LastIncludedIndex: lastApplied,
+		LastIncludedTerm:  entry.Term,
+		Members:           c.members,
+		Learners:          c.learners,
+		Witnesses:         c.witnesses,
+		Data:              data,
+	}
+	if err = s.Persistent.SaveSnapshot(snapshot); err != nil {
+		return fmt.Errorf("unable to save snapshot: %w", err)
+	}
+
+	// the configuration entry the membership came from might have been compacted
+	s.setSnapshot(snapshot)
+	s.appliedBytes = 0
+	return nil
+}
+
+// snapshotted returns the index and the term of the last entry covered by the latest snapshot.
+func (s *State) snapshotted() (uint, uint) {
+	s.snapshotMutex.RLock()
+	defer s.snapshotMutex.RUnlock()
+	return s.snapshotIndex, s.snapshotTerm
+}
+
+// setSnapshot records the last entry covered by the snapshot and the membership as of it.
+func (s *State) setSnapshot(snapshot *storage.Snapshot) {
+	var membership *configuration
+	if snapshot.Members != nil {
+		membership = &configuration{
+			members:   snapshot.Members,
+			learners:  snapshot.Learners,
+			witnesses: snapshot.Witnesses,
+		}
+	}
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+	s.snapshotIndex, s.snapshotTerm, s.snapshotMembership = snapshot.LastIncludedIndex, snapshot.LastIncludedTerm, membership
+}
+
+// restoreSnapshot replaces the state of the state machine with the content of the snapshot.
+func (s *State) restoreSnapshot(snapshot *storage.Snapshot) error {
+	if err := s.fsm.Restore(snapshot.Data); err != nil {
+		return fmt.Errorf("unable to restore the state machine: %w", err)
+	}
+	s.setSnapshot(snapshot)
+	s.commitUpTo(snapshot.LastIncludedIndex)
+	s.lastApplied.Store(uint64(snapshot.LastIncludedIndex))
+	s.appliedBytes = 0
+	return nil
+}
+
+// maybeSnapshot takes a snapshot once the entries or bytes applied since the last one reach the configured
+// thresholds. A threshold of 0 disables it.
+func (r *Raft) maybeSnapshot() {
+	s := r.State
+	snapshotIndex, _ := s.snapshotted()
+	byEntries := r.config.SnapshotThreshold > 0 && s.LastApplied()-snapshotIndex >= r.config.SnapshotThreshold
+	byBytes := r.config.SnapshotThresholdBytes > 0 && s.appliedBytes >= r.config.SnapshotThresholdBytes
+	if !byEntries && !byBytes {
+		return
+	}
+
+	if err := s.TakeSnapshot(); err != nil {
+		r.logger.Error("Failed to take snapshot", zap.Error(err))
+		return
+	}
+	snapshotIndex, snapshotTerm := s.snapshotted()
+	r.logger.Info("Snapshot taken", zap.Uint("last_included_index", snapshotIndex), zap.Uint("last_included_term", snapshotTerm))
+}
+
+// installSnapshot persists a snapshot received from the leader and resets the state machine from it. Log entries that
+// follow the snapshot are kept by the driver if they match it, and are applied again once committed.
+func (r *Raft) installSnapshot(snapshot *storage.Snapshot) error {
+	// the state machine is not reset while committed entries are applied to it
+	r.applyMutex.Lock()
+	defer r.applyMutex.Unlock()
+	if err := r.State.Persistent.SaveSnapshot(snapshot); err != nil {
+		return fmt.Errorf("unable to save snapshot: %w", err)
+	}
+	if err := r.State.restoreSnapshot(snapshot); err != nil {
+		return err
+	}
+	r.State.reloadMembership()
+	// the proposals of a follower are not tracked, the refusals are not reported
+	_ = r.State.ApplyNewEntries()
+	r.applied.notify()
+	return nil
+}
+
+// sendSnapshot streams the latest snapshot to a follower whose next entry was already compacted on the leader.
+// It blocks until the last chunk was acknowledged.
+func (r *Raft) sendSnapshot(peer *Peer) error {
+	snapshot, err := r.State.Persistent.LoadSnapshot()
+	if err != nil {
+		return fmt.Errorf("unable to load snapshot: %w", err)
+	}
+	if snapshot == nil {
+		return fmt.Errorf("there is no snapshot to install")
+	}
+
+	// a witness restores an empty state machine
+	data := snapshot.Data
+	if peer.witness.Load() {
+		data = nil
+	}
+	chunkSize := max(r.config.SnapshotChunkSize, 1)
+	size := uint(len(data))
+	for offset := uint(0); ; offset += chunkSize {
+		end := min(offset+chunkSize, size)
+		request := InstallSnapshotRequest{
+			Term:              r.State.Persistent.GetCurrentTerm(),
+			LeaderId:          r.State.ServerId,
+			LeaderAddr:        r.apiAddr,
+			ClusterId:         r.State.ClusterId(),
+			LastIncludedIndex: snapshot.LastIncludedIndex,
+			LastIncludedTerm:  snapshot.LastIncludedTerm,
+			Members:           snapshot.Members,
+			Learners:          snapshot.Learners,
+			Witnesses:         snapshot.Witnesses,
+			Offset:            offset,
+			Data:              data[offset:end],
+			Done:              end == size,
+		}
+		response := new(InstallSnapshotResponse)
+		if err = r.sendRPC(peer, rpcInstallSnapshot, request, response); err != nil {
+			return err
+		}
+		if response.Term > request.Term {
+			r.compareTerms(response.Term)
+			return fmt.Errorf("follower %v has a newer term %v", peer.addr, response.Term)
+		}
+		if request.Done {
+			break
+		}
+	}
+
+	peer.matched(snapshot.LastIncludedIndex)
+	return nil
+}
+
+// applyCommitted applies the newly committed entries to the state machine, resolves the proposals they complete and
+// compacts the log if needed.
+func (r *Raft) applyCommitted() {
+	r.applyMutex.Lock()
+	defer r.applyMutex.Unlock()
+	refused := r.State.ApplyNewEntries()
+	r.proposals.applied(r.State.LastApplied(), r.State.termOfIndex, refused)
+	r.applied.notify()
+	r.maybeSnapshot()
+}
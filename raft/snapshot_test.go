@@ -0,0 +1,109 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"go.uber.org/zap"
+)
+
+// chunkRecorder records the offsets of the snapshot chunks sent through the transport.
+type chunkRecorder struct {
+	Transport
+	offsets []uint
+}
+
+func (c *chunkRecorder) Call(addr string, method string, request any, response any) error {
+	if chunk, ok := request.(InstallSnapshotRequest); ok {
+		c.offsets = append(c.offsets, chunk.Offset)
+	}
+	return c.Transport.Call(addr, method, request, response)
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	types.RegisterDataTypes()
+
+	t.Run("the snapshot is sent in chunks and restored once it is complete", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		follower, _ := newServingNode(t, network, "9002")
+
+		cfg := testConfig(t)
+		cfg.SnapshotChunkSize = 16
+		transport := &chunkRecorder{Transport: network.Transport("127.0.0.1:9001")}
+		leader := newNode(t, cfg, transport)
+		for i := 0; i < 3; i++ {
+			if _, err := leader.State.Persistent.Append(storage.LogEntry{Term: 1, Data: putCommand(t)}); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		if err := leader.State.Persistent.SetCurrentTerm(1); err != nil {
+			t.Fatalf("Failed to set term: %v", err)
+		}
+		leader.State.commitUpTo(3)
+		leader.State.ApplyNewEntries()
+		if err := leader.State.TakeSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+		snapshot, err := leader.State.Persistent.LoadSnapshot()
+		if err != nil || snapshot == nil {
+			t.Fatalf("Failed to load snapshot: %v", err)
+		}
+
+		peer := newPeer("127.0.0.1:9002", 1)
+		if err = leader.sendSnapshot(peer); err != nil {
+			t.Fatalf("Failed to send snapshot: %v", err)
+		}
+		if chunks := (len(snapshot.Data) + 15) / 16; chunks < 2 || len(transport.offsets) != chunks {
+			t.Errorf("Expected the %d bytes of the snapshot in chunks of 16 bytes, got the offsets %v", len(snapshot.Data), transport.offsets)
+		}
+		if next, match := peer.progress(); match != 3 || next != 4 {
+			t.Errorf("Expected the follower to be known to hold the snapshot, got next %d and match %d", next, match)
+		}
+		if index, term := follower.State.snapshotted(); index != 3 || term != 1 {
+			t.Errorf("Expected the snapshot of index 3 of term 1, got index %d of term %d", index, term)
+		}
+		if follower.State.LastApplied() != 3 || follower.State.CommitIndex() != 3 {
+			t.Errorf("Expected the follower to have applied and committed up to 3, got %d and %d", follower.State.LastApplied(), follower.State.CommitIndex())
+		}
+		if value, _ := follower.State.fsm.(KeyValueReader).Get(types.String("k")); value == nil || value.String() != "v" {
+			t.Errorf("Expected the state machine to be restored, got %v", value)
+		}
+	})
+
+	t.Run("a chunk that does not follow the previous ones is refused", func(t *testing.T) {
+		store := NewKVStore()
+		_ = store.Apply(storage.LogEntry{Term: 1, Data: putCommand(t)})
+		data, err := store.Snapshot()
+		if err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+		half := uint(len(data) / 2)
+
+		follower := newFollower(t, 1)
+		controller := NewRpcController(follower, zap.NewNop())
+		request := InstallSnapshotRequest{Term: 1, LeaderId: "leader", LastIncludedIndex: 5, LastIncludedTerm: 1, Data: data[:half]}
+		if err = controller.InstallSnapshot(request, new(InstallSnapshotResponse)); err != nil {
+			t.Fatalf("Failed to install the first chunk: %v", err)
+		}
+		request.Offset, request.Data, request.Done = half+1, data[half:], true
+		if err = controller.InstallSnapshot(request, new(InstallSnapshotResponse)); err == nil {
+			t.Errorf("Expected a chunk that leaves a gap to be refused")
+		}
+		if index, _ := follower.State.snapshotted(); index != 0 {
+			t.Errorf("Expected no snapshot to be installed, got one up to %d", index)
+		}
+
+		// the leader sends the chunk again from the offset the follower expects
+		request.Offset = half
+		if err = controller.InstallSnapshot(request, new(InstallSnapshotResponse)); err != nil {
+			t.Fatalf("Failed to install the last chunk: %v", err)
+		}
+		if index, _ := follower.State.snapshotted(); index != 5 {
+			t.Errorf("Expected the snapshot up to 5 to be installed, got one up to %d", index)
+		}
+		if value, _ := follower.State.fsm.(KeyValueReader).Get(types.String("k")); value == nil || value.String() != "v" {
+			t.Errorf("Expected the state machine to be restored, got %v", value)
+		}
+	})
+}
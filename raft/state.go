@@ -3,67 +3,261 @@ package raft
 import (
 	"fmt"
 	"github.com/MohammedShetaya/kayakdb/raft/storage"
-	"github.com/MohammedShetaya/kayakdb/types"
-	"net/rpc"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Peer struct {
-	addr   string
-	client *rpc.Client
-	mutex  sync.Mutex
+	addr string
+	// the id of the peer, empty until it answered an append request of this leader
+	id atomic.Value
 
-	// leader specific state
-	nextIndex  uint
-	matchIndex uint
+	// leader specific state, updated by the replication goroutine, the snapshot transfer and the event loop
+	nextIndex     uint
+	matchIndex    uint
+	progressMutex sync.Mutex
+	// set while a snapshot is being streamed to the peer
+	installingSnapshot atomic.Bool
+	// the last time the peer answered an RPC, used by CheckQuorum
+	lastContact atomic.Int64
+	// the send time of the latest request with which the peer acknowledged the leadership of this server
+	acknowledged atomic.Int64
+	// the term of the replication goroutine running for the peer, 0 if there is none
+	replicationTerm atomic.Uint64
+	// notified whenever the peer is known to hold more entries
+	progressed signal
+	// wakes the replication goroutine up when entries were appended
+	trigger chan struct{}
+	// a learner receives the log but does not vote and is not part of the majority
+	learner atomic.Bool
+	// a witness votes but is sent the entries without their commands
+	witness atomic.Bool
+}
+
+func newPeer(addr string, nextIndex uint) *Peer {
+	return &Peer{
+		addr:      addr,
+		nextIndex: nextIndex,
+		trigger:   make(chan struct{}, 1),
+	}
+}
+
+// progress returns the index of the next entry to send to the peer and the index of the last entry it is known to
+// hold.
+func (p *Peer) progress() (uint, uint) {
+	p.progressMutex.Lock()
+	defer p.progressMutex.Unlock()
+	return p.nextIndex, p.matchIndex
+}
+
+// serverId returns the id of the peer, or an empty string if it is not known yet.
+func (p *Peer) serverId() string {
+	id, _ := p.id.Load().(string)
+	return id
+}
+
+// match returns the index of the last entry the peer is known to hold.
+func (p *Peer) match() uint {
+	_, match := p.progress()
+	return match
+}
+
+// resetProgress makes the peer known to hold no entry, the entries from nextIndex on are sent to it first.
+func (p *Peer) resetProgress(nextIndex uint) {
+	p.progressMutex.Lock()
+	defer p.progressMutex.Unlock()
+	p.nextIndex = nextIndex
+	p.matchIndex = 0
+}
+
+// matched records that the log of the peer matches the one of the leader up to index.
+func (p *Peer) matched(index uint) {
+	p.progressMutex.Lock()
+	progressed := index > p.matchIndex
+	p.matchIndex = max(p.matchIndex, index)
+	p.nextIndex = max(p.nextIndex, index+1)
+	p.progressMutex.Unlock()
+	if progressed {
+		p.progressed.notify()
+	}
+}
+
+// sent moves the next index past the entries of a request that was just sent, the next request continues after them
+// without waiting for its answer.
+func (p *Peer) sent(nextIndex uint) {
+	p.progressMutex.Lock()
+	defer p.progressMutex.Unlock()
+	p.nextIndex = nextIndex
+}
+
+// retry moves the next index back to index, so that the entries from there on are sent again. It neither moves it
+// forward nor behind what the peer is known to hold.
+func (p *Peer) retry(index uint) {
+	p.progressMutex.Lock()
+	defer p.progressMutex.Unlock()
+	p.nextIndex = max(min(p.nextIndex, index), p.matchIndex+1)
 }
 
 type State struct {
 	Persistent storage.Driver
-	// volatile state
-	CommitIndex uint // last committed log entry. initialized to 0 (0 is not considered a log index)
-	LastApplied uint // last applied to the state map
+	// volatile state, read by any goroutine
+	commitIndex atomic.Uint64 // last committed log entry. initialized to 0 (0 is not considered a log index)
+	lastApplied atomic.Uint64 // last applied to the state machine, written while applying only
+
+	// the last entry that is covered by the latest snapshot and the membership as of it, nil if there is none. They
+	// are read by any goroutine
+	snapshotIndex      uint
+	snapshotTerm       uint
+	snapshotMembership *configuration
+	snapshotMutex      sync.RWMutex
+	// size of the key-value pairs applied since the latest snapshot
+	appliedBytes uint
+	// chunks of a snapshot that is being received from the leader
+	pendingSnapshot []byte
 
-	peers []Peer
+	// cluster membership, the latest configuration in the log is the one in effect
+	self            string        // raft address of this server
+	bootstrap       configuration // membership before any configuration entry was written
+	current         configuration
+	membershipIndex uint // index of the configuration entry current came from, 0 for the bootstrap membership
+	peers           []*Peer
+	peersMutex      sync.RWMutex
+	// used to release the connections to servers that leave the cluster
+	transport Transport
 
-	ServerId       string
-	IsLeader       bool
-	cancelElection chan struct{}
-	FollowerTimer  *time.Timer
+	ServerId string
+	// election timeouts and heartbeat interval
+	timing timing
+	// the cluster this server belongs to, empty until it was configured or learned from a leader
+	clusterId     string
+	identityMutex sync.RWMutex
+	// the role of this server, changed by the event loop only
+	role role
+	// the current leader as last heard of, empty while it is unknown
+	LeaderId    string
+	LeaderAddr  string
+	leaderMutex sync.RWMutex
+	// makes granting a vote and moving to a new term atomic
+	voteMutex     sync.Mutex
+	FollowerTimer Timer
+	clock         Clock
+	// the last time a message from the current leader was accepted
+	lastLeaderContact atomic.Int64
 
-	// constructed key-value map from the log
-	// TODO: use swap and disk (lru based)
-	state map[string]types.Type
+	// the state machine the committed entries are applied to
+	fsm FSM
 }
 
-func NewState(driver storage.Driver) *State {
+// NewState restores the state machine from the latest snapshot. The log entries that follow it might not be
+// committed, they are applied once the server learns that they are: from the leader, or from a majority once it is
+// the leader itself.
+func NewState(driver storage.Driver, fsm FSM) (*State, error) {
 	s := &State{
 		Persistent: driver,
+		fsm:        fsm,
+		clock:      realClock{},
 	}
-	constructedState, err := s.Persistent.ConstructMappingFromLog()
+
+	snapshot, err := s.Persistent.LoadSnapshot()
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to load snapshot: %w", err)
+	}
+	if snapshot != nil {
+		if err = s.restoreSnapshot(snapshot); err != nil {
+			return nil, err
+		}
 	}
-	s.state = constructedState
-	return s
+	return s, nil
 }
 
-func (s *State) Get(key types.Type) (types.Type, error) {
-	// TODO: after implementing swapping make sure to retrieve cold values
-	return s.state[string(key.Bytes())], nil
+// CommitIndex returns the index of the last entry known to be committed, 0 if there is none.
+func (s *State) CommitIndex() uint {
+	return uint(s.commitIndex.Load())
 }
 
-//func (s *State) Put(key types.Type, val types.Type) error {
-//
-//}
+// LastApplied returns the index of the last entry applied to the state machine.
+func (s *State) LastApplied() uint {
+	return uint(s.lastApplied.Load())
+}
 
+// commitUpTo moves the commit index forward to index and reports whether it moved. It never moves back, whichever
+// goroutine learned of the commit first.
+func (s *State) commitUpTo(index uint) bool {
+	for {
+		current := s.commitIndex.Load()
+		if uint64(index) <= current {
+			return false
+		}
+		if s.commitIndex.CompareAndSwap(current, uint64(index)) {
+			return true
+		}
+	}
+}
+
+func (s *State) setLeader(id string, addr string) {
+	if id != "" && id != s.ServerId {
+		s.lastLeaderContact.Store(s.clock.Now().UnixNano())
+	}
+	s.leaderMutex.Lock()
+	defer s.leaderMutex.Unlock()
+	s.LeaderId = id
+	s.LeaderAddr = addr
+}
+
+// Leader returns the id and the client address of the current leader, both are empty while it is unknown.
+func (s *State) Leader() (string, string) {
+	s.leaderMutex.RLock()
+	defer s.leaderMutex.RUnlock()
+	return s.LeaderId, s.LeaderAddr
+}
+
+// heardFromLeader reports whether a leader was heard from within the minimum election timeout, the leader itself
+// included.
+func (s *State) heardFromLeader() bool {
+	if s.IsLeader() {
+		return true
+	}
+	if id, _ := s.Leader(); id == "" {
+		return false
+	}
+	return s.clock.Now().Sub(time.Unix(0, s.lastLeaderContact.Load())) < s.timing.electionTimeoutMin
+}
+
+// GetMajority returns the number of voters of the current configuration that form a quorum. Learners are not counted,
+// witnesses are.
 func (s *State) GetMajority() int {
-	return s.peersCount()/2 + 1
+	s.peersMutex.RLock()
+	defer s.peersMutex.RUnlock()
+	return (len(s.current.members)-len(s.current.learners))/2 + 1
+}
+
+// termOfIndex returns the term of the entry at index, including the last entry covered by the snapshot. It returns 0
+// for index 0 and for entries that are not known.
+func (s *State) termOfIndex(index uint) uint {
+	if snapshotIndex, snapshotTerm := s.snapshotted(); index == snapshotIndex {
+		return snapshotTerm
+	}
+	if entry := s.Persistent.GetEntryOfIndex(index); entry != nil {
+		return entry.Term
+	}
+	return 0
 }
 
-func (s *State) peersCount() int {
-	return len(s.peers)
+// lastIndexOfTerm returns the index of the last entry of the term at or before index. It reports false if the log
+// has no entry of the term after the snapshot.
+func (s *State) lastIndexOfTerm(term uint, index uint) (uint, bool) {
+	snapshotIndex, _ := s.snapshotted()
+	for idx := min(index, s.Persistent.LastIndex()); idx > snapshotIndex; idx-- {
+		switch t := s.termOfIndex(idx); {
+		case t == term:
+			return idx, true
+		case t < term:
+			// the terms only decrease from here on
+			return 0, false
+		}
+	}
+	return 0, false
 }
 
 func (s *State) GetLogsRange(start uint, end uint) []storage.LogEntry {
@@ -82,15 +276,36 @@ func (s *State) GetLogsRange(start uint, end uint) []storage.LogEntry {
 }
 
 // ApplyNewEntries applies all log entries that have been committed but not yet applied
-// to the in-memory state map. After execution LastApplied will equal CommitIndex.
-func (s *State) ApplyNewEntries() {
-	fmt.Println("applying #####")
-	for idx := s.LastApplied + 1; idx <= s.CommitIndex; idx++ {
+// to the state machine. After execution LastApplied will equal CommitIndex. It returns the errors the state machine
+// refused commands with, by index.
+func (s *State) ApplyNewEntries() map[uint]error {
+	var refused map[uint]error
+	for idx := s.LastApplied() + 1; idx <= s.CommitIndex(); idx++ {
 		entry := s.Persistent.GetEntryOfIndex(idx)
 		if entry == nil {
 			continue
 		}
-		s.state[string(entry.Pair.Key.Bytes())] = entry.Pair.Value
-		s.LastApplied = idx
+		if entry.Type != storage.EntryCommand {
+			// a server that failed to persist the cluster id joins the cluster with the next message of the leader
+			if entry.Type == storage.EntryConfiguration && entry.ClusterId != "" {
+				_, _ = s.checkCluster(entry.ClusterId, true)
+			}
+			s.lastApplied.Store(uint64(idx))
+			continue
+		}
+		// a witness holds the entries without their commands, its state machine stays empty
+		if s.isWitness(s.self) {
+			s.lastApplied.Store(uint64(idx))
+			continue
+		}
+		if err := s.fsm.Apply(*entry); err != nil {
+			if refused == nil {
+				refused = make(map[uint]error)
+			}
+			refused[idx] = err
+		}
+		s.appliedBytes += uint(len(entry.Data))
+		s.lastApplied.Store(uint64(idx))
 	}
+	return refused
 }
@@ -1,23 +1,109 @@
 package storage
 
 import (
-	"github.com/MohammedShetaya/kayakdb/types"
+	"fmt"
+	"sort"
 )
 
 // Driver This is the interface that will be used by the raft lib to deal with the underlying storage.
+// Log indexes are 1-based, index 0 means "no entry". Entries that are covered by the latest snapshot are
+// no longer returned by GetEntryOfIndex.
 type Driver interface {
 	GetCurrentTerm() uint
 	SetCurrentTerm(term uint) error
 	GetVotedFor() string
 	SetVotedFor(candidate string) error
-	Append(entry LogEntry) uint
+	// GetIdentity returns the identity of this server, its fields are empty until they were set for the first time.
+	GetIdentity() Identity
+	SetIdentity(identity Identity) error
+	Append(entry LogEntry) (uint, error)
 	AppendMany(startIndex uint, entries []LogEntry) error
 	GetEntryOfIndex(index uint) *LogEntry
-	//FindLastMatchingIndex(startIndex uint, entries []LogEntry) (uint, error)
-	ConstructMappingFromLog() (map[string]types.Type, error)
+	// LastIndex returns the index of the last entry in the log, or of the snapshot if the log is empty.
+	LastIndex() uint
+	// FindLastMatchingIndex returns the largest index up to which the log already holds the entries, entries[0]
+	// being the entry at startIndex+1. startIndex is returned if the first one is missing or conflicts.
+	FindLastMatchingIndex(startIndex uint, entries []LogEntry) uint
+	// SaveSnapshot persists the snapshot and discards the log entries up to its last included index.
+	SaveSnapshot(snapshot *Snapshot) error
+	// LoadSnapshot returns the latest snapshot or nil if none was taken yet.
+	LoadSnapshot() (*Snapshot, error)
+	// Close flushes any buffered state and releases the underlying resources.
+	Close() error
+}
+
+// Identity identifies a server and the cluster it belongs to across restarts.
+type Identity struct {
+	ServerId  string
+	ClusterId string
+}
+
+// EntryVersion is the version of the log entry envelope written by this build. A server refuses entries of a newer
+// version instead of applying what it does not understand.
+const EntryVersion uint8 = 1
+
+type EntryType uint8
+
+const (
+	// EntryCommand carries a command for the state machine in its data
+	EntryCommand EntryType = iota
+	// EntryConfiguration carries the full membership of the cluster
+	EntryConfiguration
+	// EntryNoOp carries nothing, a new leader appends one to commit the entries of the previous terms
+	EntryNoOp
+)
+
+func (t EntryType) String() string {
+	switch t {
+	case EntryCommand:
+		return "command"
+	case EntryConfiguration:
+		return "configuration"
+	case EntryNoOp:
+		return "no-op"
+	default:
+		return fmt.Sprintf("EntryType(%d)", uint8(t))
+	}
 }
 
 type LogEntry struct {
-	Term uint
-	Pair types.KeyValue
+	Version uint8
+	Term    uint
+	Type    EntryType
+	// Data is the command payload, it is opaque to raft and decoded by the state machine
+	Data []byte
+	// ClientId and Sequence identify the client session and the request that proposed a command, if any
+	ClientId string
+	Sequence uint64
+	Members  []string // raft addresses of all the servers, set on configuration entries only
+	Learners []string // the members that do not vote, set on configuration entries only
+	// the voters that are sent the entries without their commands, set on configuration entries only
+	Witnesses []string
+	// the id of the cluster, set on the configuration entry proposed by the first leader of a cluster only
+	ClusterId string
+}
+
+// Snapshot is the serialized state machine up to and including LastIncludedIndex.
+type Snapshot struct {
+	LastIncludedIndex uint
+	LastIncludedTerm  uint
+	// the cluster membership as of LastIncludedIndex
+	Members   []string
+	Learners  []string
+	Witnesses []string
+	Data      []byte
+}
+
+// findLastMatchingIndex implements FindLastMatchingIndex for the drivers. Two entries with the same index and term
+// are preceded by the same entries, so the entries the log holds are a prefix that is found with a binary search.
+// Entries covered by the snapshot are committed and therefore match.
+func findLastMatchingIndex(startIndex uint, entries []LogEntry, snapshotIndex uint, entryOfIndex func(index uint) *LogEntry) uint {
+	return startIndex + uint(sort.Search(len(entries), func(i int) bool {
+		idx := startIndex + uint(i) + 1
+		if idx <= snapshotIndex {
+			return false
+		}
+		existing := entryOfIndex(idx)
+		return existing == nil || existing.Term != entries[i].Term
+	}))
 }
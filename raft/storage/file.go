@@ -0,0 +1,673 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	metaFileName     = "meta"
+	snapshotFileName = "snapshot"
+	segmentPrefix    = "wal-"
+	segmentSuffix    = ".log"
+	// every wal record is prefixed by the length of the encoded entry and its crc32 checksum
+	recordHeaderSize = 8
+)
+
+var errCorruptRecord = errors.New("corrupt wal record")
+
+// FileDriver is a durable implementation of the Driver interface.
+// Log entries are written to an append-only write-ahead log that is split into segments, while the current term
+// and vote live in a separate metadata file, together with the identity of the server. Every mutation is fsynced before returning, so nothing is
+// acknowledged to a peer before it reached the disk.
+// Compaction deletes whole segments, so the first segment might still hold some entries that are covered by the
+// snapshot. Those are skipped on recovery.
+type FileDriver struct {
+	mutex       sync.Mutex
+	dir         string
+	segmentSize int64
+
+	currentTerm uint
+	votedFor    string
+	identity    Identity
+
+	snapshot *Snapshot
+	// the log is also kept in memory, log[0] is the entry that directly follows the snapshot
+	// and positions[i] is where log[i] lives on disk
+	log       []LogEntry
+	positions []recordPosition
+	// ordered by first index, only the last segment is open for writes
+	segments []*segment
+}
+
+type segment struct {
+	firstIndex uint
+	path       string
+	file       *os.File
+	size       int64
+}
+
+type recordPosition struct {
+	segment *segment
+	offset  int64
+}
+
+type metadata struct {
+	CurrentTerm uint   `json:"current_term"`
+	VotedFor    string `json:"voted_for"`
+	ServerId    string `json:"server_id,omitempty"`
+	ClusterId   string `json:"cluster_id,omitempty"`
+}
+
+// NewFileDriver opens (or creates) the data directory and recovers the term, vote and log from it.
+// A partially written record at the tail of the wal, which is what a crash in the middle of an append leaves
+// behind, is discarded.
+func NewFileDriver(dir string, segmentSize uint) (*FileDriver, error) {
+	if segmentSize == 0 {
+		return nil, fmt.Errorf("wal segment size must be larger than zero")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create data directory %s: %w", dir, err)
+	}
+
+	d := &FileDriver{
+		dir:         dir,
+		segmentSize: int64(segmentSize),
+		log:         make([]LogEntry, 0),
+	}
+
+	if err := d.loadMetadata(); err != nil {
+		return nil, err
+	}
+	if err := d.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := d.loadSegments(); err != nil {
+		_ = d.closeSegments()
+		return nil, err
+	}
+	if len(d.segments) == 0 {
+		if err := d.createSegment(d.snapshotIndex() + 1); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *FileDriver) GetCurrentTerm() uint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.currentTerm
+}
+
+// SetCurrentTerm persist the value of the current term.
+func (d *FileDriver) SetCurrentTerm(term uint) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.writeMetadata(term, d.votedFor, d.identity); err != nil {
+		return err
+	}
+	d.currentTerm = term
+	return nil
+}
+
+func (d *FileDriver) GetVotedFor() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.votedFor
+}
+
+// SetVotedFor persists the value of the last performed vote.
+func (d *FileDriver) SetVotedFor(candidate string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.writeMetadata(d.currentTerm, candidate, d.identity); err != nil {
+		return err
+	}
+	d.votedFor = candidate
+	return nil
+}
+
+func (d *FileDriver) GetIdentity() Identity {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.identity
+}
+
+// SetIdentity persists the identity of the server.
+func (d *FileDriver) SetIdentity(identity Identity) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.writeMetadata(d.currentTerm, d.votedFor, identity); err != nil {
+		return err
+	}
+	d.identity = identity
+	return nil
+}
+
+// Append appends a log entry and returns the log index.
+func (d *FileDriver) Append(entry LogEntry) (uint, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := d.write([]LogEntry{entry}); err != nil {
+		return 0, err
+	}
+	return d.lastIndex(), nil
+}
+
+// AppendMany writes the entries starting at startIndex. An existing entry that conflicts with a new one
+// (same index but different term) is deleted together with all the entries that follow it.
+func (d *FileDriver) AppendMany(startIndex uint, entries []LogEntry) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if startIndex <= d.snapshotIndex() || startIndex > d.lastIndex()+1 {
+		return fmt.Errorf("start index %d is outside of the log [%d, %d]", startIndex, d.snapshotIndex()+1, d.lastIndex()+1)
+	}
+
+	for i, entry := range entries {
+		idx := startIndex + uint(i)
+		if idx > d.lastIndex() {
+			return d.write(entries[i:])
+		}
+		if d.entryOfIndex(idx).Term != entry.Term {
+			if err := d.truncateFrom(idx); err != nil {
+				return err
+			}
+			return d.write(entries[i:])
+		}
+	}
+	return nil
+}
+
+func (d *FileDriver) GetEntryOfIndex(index uint) *LogEntry {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.entryOfIndex(index)
+}
+
+func (d *FileDriver) LastIndex() uint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.lastIndex()
+}
+
+func (d *FileDriver) entryOfIndex(index uint) *LogEntry {
+	first := d.snapshotIndex() + 1
+	if index < first || index > d.lastIndex() {
+		return nil
+	}
+	entry := d.log[index-first]
+	return &entry
+}
+
+// SaveSnapshot writes the snapshot to disk and then discards the log entries that it covers. If the log does
+// not contain the last included entry of the snapshot the whole log is discarded.
+func (d *FileDriver) SaveSnapshot(snapshot *Snapshot) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if snapshot.LastIncludedIndex <= d.snapshotIndex() {
+		return fmt.Errorf("snapshot at index %d is older than the current one at %d", snapshot.LastIncludedIndex, d.snapshotIndex())
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(snapshot); err != nil {
+		return fmt.Errorf("unable to encode snapshot: %w", err)
+	}
+	// the snapshot has to be durable before any of the entries it replaces are removed
+	if err := writeFileAtomic(d.dir, snapshotFileName, buffer.Bytes()); err != nil {
+		return err
+	}
+
+	entry := d.entryOfIndex(snapshot.LastIncludedIndex)
+	keep := entry != nil && entry.Term == snapshot.LastIncludedTerm
+	compacted := snapshot.LastIncludedIndex - d.snapshotIndex()
+	d.snapshot = snapshot
+
+	if !keep {
+		return d.resetSegments()
+	}
+
+	d.log = append([]LogEntry(nil), d.log[compacted:]...)
+	d.positions = append([]recordPosition(nil), d.positions[compacted:]...)
+	// delete the segments that hold nothing but compacted entries, the active segment is always kept
+	for len(d.segments) > 1 && d.segments[1].firstIndex <= snapshot.LastIncludedIndex+1 {
+		if err := removeSegment(d.segments[0]); err != nil {
+			return err
+		}
+		d.segments = d.segments[1:]
+	}
+	return syncDir(d.dir)
+}
+
+// LoadSnapshot returns the latest snapshot or nil if none was taken yet.
+func (d *FileDriver) LoadSnapshot() (*Snapshot, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.snapshot, nil
+}
+
+// FindLastMatchingIndex returns the largest index up to which the log already holds the entries, entries[0] being
+// the entry at startIndex+1. startIndex is returned if the first one is missing or conflicts.
+func (d *FileDriver) FindLastMatchingIndex(startIndex uint, entries []LogEntry) uint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return findLastMatchingIndex(startIndex, entries, d.snapshotIndex(), d.entryOfIndex)
+}
+
+// Close flushes the active segment and closes every open file.
+func (d *FileDriver) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	active := d.segments[len(d.segments)-1]
+	if err := active.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync wal segment %s: %w", active.path, err)
+	}
+	return d.closeSegments()
+}
+
+// write appends the entries to the active segment, rotating it when it grows beyond the segment size,
+// and fsyncs before returning.
+func (d *FileDriver) write(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	firstNew := d.lastIndex() + 1
+
+	err := func() error {
+		for _, entry := range entries {
+			record, err := encodeRecord(entry)
+			if err != nil {
+				return err
+			}
+			if err = d.rotateIfFull(); err != nil {
+				return err
+			}
+			active := d.segments[len(d.segments)-1]
+			if _, err = active.file.Write(record); err != nil {
+				return fmt.Errorf("unable to write to wal segment %s: %w", active.path, err)
+			}
+			d.positions = append(d.positions, recordPosition{segment: active, offset: active.size})
+			d.log = append(d.log, entry)
+			active.size += int64(len(record))
+		}
+		active := d.segments[len(d.segments)-1]
+		if err := active.file.Sync(); err != nil {
+			return fmt.Errorf("unable to sync wal segment %s: %w", active.path, err)
+		}
+		return nil
+	}()
+
+	if err != nil {
+		// do not keep entries around that might not have made it to the disk
+		_ = d.truncateFrom(firstNew)
+	}
+	return err
+}
+
+func (d *FileDriver) rotateIfFull() error {
+	active := d.segments[len(d.segments)-1]
+	if active.size < d.segmentSize {
+		return nil
+	}
+	if err := active.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync wal segment %s: %w", active.path, err)
+	}
+	if err := active.file.Close(); err != nil {
+		return fmt.Errorf("unable to close wal segment %s: %w", active.path, err)
+	}
+	active.file = nil
+	return d.createSegment(d.lastIndex() + 1)
+}
+
+// truncateFrom deletes the entry at index and every entry after it.
+func (d *FileDriver) truncateFrom(index uint) error {
+	if index <= d.snapshotIndex() || index > d.lastIndex() {
+		return nil
+	}
+	offset := index - d.snapshotIndex() - 1
+	pos := d.positions[offset]
+
+	for len(d.segments) > 0 && d.segments[len(d.segments)-1] != pos.segment {
+		if err := removeSegment(d.segments[len(d.segments)-1]); err != nil {
+			return err
+		}
+		d.segments = d.segments[:len(d.segments)-1]
+	}
+
+	seg := pos.segment
+	if seg.file == nil {
+		file, err := openSegmentFile(seg.path)
+		if err != nil {
+			return err
+		}
+		seg.file = file
+	}
+	if err := seg.file.Truncate(pos.offset); err != nil {
+		return fmt.Errorf("unable to truncate wal segment %s: %w", seg.path, err)
+	}
+	if err := seg.file.Sync(); err != nil {
+		return fmt.Errorf("unable to sync wal segment %s: %w", seg.path, err)
+	}
+	seg.size = pos.offset
+
+	d.log = d.log[:offset]
+	d.positions = d.positions[:offset]
+	return syncDir(d.dir)
+}
+
+// resetSegments deletes the whole wal and starts a new one right after the snapshot.
+func (d *FileDriver) resetSegments() error {
+	for _, seg := range d.segments {
+		if err := removeSegment(seg); err != nil {
+			return err
+		}
+	}
+	d.segments = nil
+	d.log = make([]LogEntry, 0)
+	d.positions = nil
+	return d.createSegment(d.snapshotIndex() + 1)
+}
+
+func (d *FileDriver) snapshotIndex() uint {
+	if d.snapshot == nil {
+		return 0
+	}
+	return d.snapshot.LastIncludedIndex
+}
+
+func (d *FileDriver) lastIndex() uint {
+	return d.snapshotIndex() + uint(len(d.log))
+}
+
+func (d *FileDriver) createSegment(firstIndex uint) error {
+	path := segmentPath(d.dir, firstIndex)
+	file, err := openSegmentFile(path)
+	if err != nil {
+		return err
+	}
+	d.segments = append(d.segments, &segment{firstIndex: firstIndex, path: path, file: file})
+	return syncDir(d.dir)
+}
+
+func (d *FileDriver) loadSegments() error {
+	dirEntries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return fmt.Errorf("unable to read data directory %s: %w", d.dir, err)
+	}
+
+	var firstIndexes []uint
+	for _, e := range dirEntries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		idx, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected wal segment name %s: %w", name, err)
+		}
+		firstIndexes = append(firstIndexes, uint(idx))
+	}
+	sort.Slice(firstIndexes, func(i, j int) bool { return firstIndexes[i] < firstIndexes[j] })
+
+	if len(firstIndexes) > 0 && firstIndexes[0] > d.snapshotIndex()+1 {
+		return fmt.Errorf("wal starts at index %d but the snapshot ends at %d", firstIndexes[0], d.snapshotIndex())
+	}
+
+	// whether the entries on disk continue the snapshot. They do not if a crash happened after a snapshot that
+	// replaced the whole log was written but before the old segments were deleted.
+	continuesSnapshot := true
+	next := uint(0)
+	for i, firstIndex := range firstIndexes {
+		path := segmentPath(d.dir, firstIndex)
+		if i > 0 && firstIndex != next {
+			return fmt.Errorf("wal segment %s does not continue the log at index %d", path, next)
+		}
+
+		file, err := openSegmentFile(path)
+		if err != nil {
+			return err
+		}
+		seg := &segment{firstIndex: firstIndex, path: path, file: file}
+		d.segments = append(d.segments, seg)
+
+		isLast := i == len(firstIndexes)-1
+		var boundaryTerm *uint
+		next, boundaryTerm, err = d.readSegment(seg)
+		if boundaryTerm != nil && *boundaryTerm != d.snapshot.LastIncludedTerm {
+			continuesSnapshot = false
+		}
+		if err != nil {
+			if !isLast || !errors.Is(err, errCorruptRecord) {
+				return fmt.Errorf("unable to recover wal segment %s: %w", path, err)
+			}
+			// a torn write at the tail of the log, the entry was never acknowledged so drop it
+			if err = file.Truncate(seg.size); err != nil {
+				return fmt.Errorf("unable to truncate wal segment %s: %w", path, err)
+			}
+			if err = file.Sync(); err != nil {
+				return fmt.Errorf("unable to sync wal segment %s: %w", path, err)
+			}
+		}
+
+		if !isLast {
+			_ = file.Close()
+			seg.file = nil
+		}
+	}
+
+	if len(d.segments) > 0 && (!continuesSnapshot || next <= d.snapshotIndex()) {
+		return d.resetSegments()
+	}
+	return nil
+}
+
+// readSegment loads the records of the segment that follow the snapshot into the log. It returns the index that
+// the next segment should start at and, if the segment holds the last entry covered by the snapshot, the term of
+// that entry. seg.size is set to the end of the last valid record.
+func (d *FileDriver) readSegment(seg *segment) (uint, *uint, error) {
+	if _, err := seg.file.Seek(0, io.SeekStart); err != nil {
+		return seg.firstIndex, nil, err
+	}
+	reader := bufio.NewReader(seg.file)
+	header := make([]byte, recordHeaderSize)
+	index := seg.firstIndex
+	var boundaryTerm *uint
+	seg.size = 0
+
+	for ; ; index++ {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return index, boundaryTerm, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return index, boundaryTerm, errCorruptRecord
+			}
+			return index, boundaryTerm, err
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return index, boundaryTerm, errCorruptRecord
+			}
+			return index, boundaryTerm, err
+		}
+		if crc32.ChecksumIEEE(data) != checksum {
+			return index, boundaryTerm, errCorruptRecord
+		}
+
+		var entry LogEntry
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+			return index, boundaryTerm, fmt.Errorf("%w: %v", errCorruptRecord, err)
+		}
+
+		if index > d.snapshotIndex() {
+			d.log = append(d.log, entry)
+			d.positions = append(d.positions, recordPosition{segment: seg, offset: seg.size})
+		} else if index == d.snapshotIndex() {
+			term := entry.Term
+			boundaryTerm = &term
+		}
+		seg.size += int64(recordHeaderSize) + int64(length)
+	}
+}
+
+func (d *FileDriver) closeSegments() error {
+	var firstErr error
+	for _, seg := range d.segments {
+		if seg.file == nil {
+			continue
+		}
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("unable to close wal segment %s: %w", seg.path, err)
+		}
+		seg.file = nil
+	}
+	return firstErr
+}
+
+func (d *FileDriver) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(d.dir, snapshotFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to read snapshot file: %w", err)
+	}
+
+	var snapshot Snapshot
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+		return fmt.Errorf("unable to decode snapshot file: %w", err)
+	}
+	d.snapshot = &snapshot
+	return nil
+}
+
+func (d *FileDriver) loadMetadata() error {
+	data, err := os.ReadFile(filepath.Join(d.dir, metaFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to read metadata file: %w", err)
+	}
+
+	var meta metadata
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("unable to decode metadata file: %w", err)
+	}
+	d.currentTerm = meta.CurrentTerm
+	d.votedFor = meta.VotedFor
+	d.identity = Identity{ServerId: meta.ServerId, ClusterId: meta.ClusterId}
+	return nil
+}
+
+// writeMetadata atomically replaces the metadata file, it writes a temporary file, fsyncs it and renames it
+// over the old one.
+func (d *FileDriver) writeMetadata(term uint, votedFor string, identity Identity) error {
+	data, err := json.Marshal(metadata{
+		CurrentTerm: term,
+		VotedFor:    votedFor,
+		ServerId:    identity.ServerId,
+		ClusterId:   identity.ClusterId,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode metadata: %w", err)
+	}
+	return writeFileAtomic(d.dir, metaFileName, data)
+}
+
+func encodeRecord(entry LogEntry) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(entry); err != nil {
+		return nil, fmt.Errorf("unable to encode log entry: %w", err)
+	}
+	data := buffer.Bytes()
+
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+	return record, nil
+}
+
+func segmentPath(dir string, firstIndex uint) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", segmentPrefix, firstIndex, segmentSuffix))
+}
+
+func removeSegment(seg *segment) error {
+	if seg.file != nil {
+		_ = seg.file.Close()
+		seg.file = nil
+	}
+	if err := os.Remove(seg.path); err != nil {
+		return fmt.Errorf("unable to remove wal segment %s: %w", seg.path, err)
+	}
+	return nil
+}
+
+func openSegmentFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open wal segment %s: %w", path, err)
+	}
+	return file, nil
+}
+
+func writeFileAtomic(dir string, name string, data []byte) error {
+	tmpPath := filepath.Join(dir, name+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", tmpPath, err)
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("unable to write %s: %w", tmpPath, err)
+	}
+	if err = file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("unable to sync %s: %w", tmpPath, err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %w", tmpPath, err)
+	}
+	if err = os.Rename(tmpPath, filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("unable to replace %s: %w", name, err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes creations, renames and removals of files in the directory durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open directory %s: %w", dir, err)
+	}
+	defer f.Close()
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("unable to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newEntry(term uint, data string) LogEntry {
+	return LogEntry{
+		Version: EntryVersion,
+		Term:    term,
+		Data:    []byte(data),
+	}
+}
+
+func TestFileDriver(t *testing.T) {
+	t.Run("term and vote survive a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		d, err := NewFileDriver(dir, 1024)
+		if err != nil {
+			t.Fatalf("Failed to open driver: %v", err)
+		}
+		if err = d.SetCurrentTerm(7); err != nil {
+			t.Fatalf("Failed to set term: %v", err)
+		}
+		if err = d.SetVotedFor("node-a"); err != nil {
+			t.Fatalf("Failed to set vote: %v", err)
+		}
+		_ = d.Close()
+
+		d, err = NewFileDriver(dir, 1024)
+		if err != nil {
+			t.Fatalf("Failed to reopen driver: %v", err)
+		}
+		defer d.Close()
+		if d.GetCurrentTerm() != 7 {
+			t.Errorf("Expected term 7, got %d", d.GetCurrentTerm())
+		}
+		if d.GetVotedFor() != "node-a" {
+			t.Errorf("Expected vote for node-a, got %s", d.GetVotedFor())
+		}
+	})
+
+	t.Run("identity survives a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		d, err := NewFileDriver(dir, 1024)
+		if err != nil {
+			t.Fatalf("Failed to open driver: %v", err)
+		}
+		identity := Identity{ServerId: "node-a", ClusterId: "cluster-a"}
+		if err = d.SetIdentity(identity); err != nil {
+			t.Fatalf("Failed to set identity: %v", err)
+		}
+		// writing the term must not drop the identity
+		if err = d.SetCurrentTerm(3); err != nil {
+			t.Fatalf("Failed to set term: %v", err)
+		}
+		_ = d.Close()
+
+		d, err = NewFileDriver(dir, 1024)
+		if err != nil {
+			t.Fatalf("Failed to reopen driver: %v", err)
+		}
+		defer d.Close()
+		if got := d.GetIdentity(); got != identity {
+			t.Errorf("Expected identity %+v, got %+v", identity, got)
+		}
+	})
+
+	t.Run("log survives a restart across segments", func(t *testing.T) {
+		dir := t.TempDir()
+		// tiny segments force a rotation on almost every append
+		d, err := NewFileDriver(dir, 64)
+		if err != nil {
+			t.Fatalf("Failed to open driver: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			idx, err := d.Append(newEntry(1, string(rune('a'+i))))
+			if err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+			if idx != uint(i+1) {
+				t.Fatalf("Expected index %d, got %d", i+1, idx)
+			}
+		}
+		_ = d.Close()
+
+		d, err = NewFileDriver(dir, 64)
+		if err != nil {
+			t.Fatalf("Failed to reopen driver: %v", err)
+		}
+		defer d.Close()
+		for i := 0; i < 10; i++ {
+			entry := d.GetEntryOfIndex(uint(i + 1))
+			if entry == nil || string(entry.Data) != string(rune('a'+i)) {
+				t.Fatalf("Unexpected entry at index %d: %v", i+1, entry)
+			}
+		}
+		if d.GetEntryOfIndex(11) != nil {
+			t.Errorf("Expected no entry past the end of the log")
+		}
+	})
+
+	t.Run("conflicting entries are truncated", func(t *testing.T) {
+		dir := t.TempDir()
+		d, err := NewFileDriver(dir, 64)
+		if err != nil {
+			t.Fatalf("Failed to open driver: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			if _, err = d.Append(newEntry(1, "old")); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		// index 3 matches, index 4 conflicts so 4 and 5 must be replaced
+		err = d.AppendMany(3, []LogEntry{newEntry(1, "old"), newEntry(2, "new")})
+		if err != nil {
+			t.Fatalf("Failed to append many: %v", err)
+		}
+		_ = d.Close()
+
+		d, err = NewFileDriver(dir, 64)
+		if err != nil {
+			t.Fatalf("Failed to reopen driver: %v", err)
+		}
+		defer d.Close()
+		if entry := d.GetEntryOfIndex(4); entry == nil || entry.Term != 2 {
+			t.Errorf("Expected entry of term 2 at index 4, got %v", entry)
+		}
+		if d.GetEntryOfIndex(5) != nil {
+			t.Errorf("Expected index 5 to be truncated")
+		}
+	})
+
+	t.Run("torn write at the tail is discarded", func(t *testing.T) {
+		dir := t.TempDir()
+		d, err := NewFileDriver(dir, 1<<20)
+		if err != nil {
+			t.Fatalf("Failed to open driver: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err = d.Append(newEntry(1, "v")); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		_ = d.Close()
+
+		// simulate a crash in the middle of writing the last record
+		segments, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+		info, _ := os.Stat(segments[0])
+		if err = os.Truncate(segments[0], info.Size()-3); err != nil {
+			t.Fatalf("Failed to truncate segment: %v", err)
+		}
+
+		d, err = NewFileDriver(dir, 1<<20)
+		if err != nil {
+			t.Fatalf("Failed to recover driver: %v", err)
+		}
+		defer d.Close()
+		if d.GetEntryOfIndex(3) != nil {
+			t.Errorf("Expected the torn entry to be dropped")
+		}
+		idx, err := d.Append(newEntry(2, "after"))
+		if err != nil || idx != 3 {
+			t.Errorf("Expected the next append to reuse index 3, got %d (%v)", idx, err)
+		}
+	})
+}
+
+func TestFileDriverSnapshot(t *testing.T) {
+	t.Run("snapshot compacts the log and survives a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		d, err := NewFileDriver(dir, 64)
+		if err != nil {
+			t.Fatalf("Failed to open driver: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err = d.Append(newEntry(1, string(rune('a'+i)))); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		err = d.SaveSnapshot(&Snapshot{LastIncludedIndex: 6, LastIncludedTerm: 1, Data: []byte("state")})
+		if err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+		if d.GetEntryOfIndex(6) != nil {
+			t.Errorf("Expected index 6 to be compacted")
+		}
+		_ = d.Close()
+
+		d, err = NewFileDriver(dir, 64)
+		if err != nil {
+			t.Fatalf("Failed to reopen driver: %v", err)
+		}
+		defer d.Close()
+
+		snapshot, err := d.LoadSnapshot()
+		if err != nil || snapshot == nil || snapshot.LastIncludedIndex != 6 || string(snapshot.Data) != "state" {
+			t.Fatalf("Unexpected snapshot after restart: %v (%v)", snapshot, err)
+		}
+		if d.GetEntryOfIndex(6) != nil {
+			t.Errorf("Expected index 6 to stay compacted after restart")
+		}
+		if entry := d.GetEntryOfIndex(7); entry == nil || string(entry.Data) != "g" {
+			t.Errorf("Expected entry g at index 7, got %v", entry)
+		}
+		if idx, _ := d.Append(newEntry(1, "k")); idx != 11 {
+			t.Errorf("Expected the next append at index 11, got %d", idx)
+		}
+	})
+
+	t.Run("snapshot beyond the log replaces it", func(t *testing.T) {
+		dir := t.TempDir()
+		d, err := NewFileDriver(dir, 64)
+		if err != nil {
+			t.Fatalf("Failed to open driver: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err = d.Append(newEntry(1, "v")); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		if err = d.SaveSnapshot(&Snapshot{LastIncludedIndex: 20, LastIncludedTerm: 4}); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+		_ = d.Close()
+
+		d, err = NewFileDriver(dir, 64)
+		if err != nil {
+			t.Fatalf("Failed to reopen driver: %v", err)
+		}
+		defer d.Close()
+		if d.GetEntryOfIndex(3) != nil {
+			t.Errorf("Expected the old log to be discarded")
+		}
+		if err = d.AppendMany(21, []LogEntry{newEntry(4, "v")}); err != nil {
+			t.Errorf("Expected to continue the log after the snapshot: %v", err)
+		}
+	})
+
+	t.Run("the last matching index is found after the snapshot", func(t *testing.T) {
+		d, err := NewFileDriver(t.TempDir(), 64)
+		if err != nil {
+			t.Fatalf("Failed to open driver: %v", err)
+		}
+		defer d.Close()
+		for _, term := range []uint{1, 1, 2, 2, 3} {
+			if _, err = d.Append(newEntry(term, "v")); err != nil {
+				t.Fatalf("Failed to append: %v", err)
+			}
+		}
+		if err = d.SaveSnapshot(&Snapshot{LastIncludedIndex: 2, LastIncludedTerm: 1}); err != nil {
+			t.Fatalf("Failed to save snapshot: %v", err)
+		}
+
+		entries := []LogEntry{newEntry(1, "v"), newEntry(2, "v"), newEntry(2, "v"), newEntry(4, "v"), newEntry(4, "v")}
+		if idx := d.FindLastMatchingIndex(1, entries); idx != 4 {
+			t.Errorf("Expected the entries to match up to index 4, got %d", idx)
+		}
+		if idx := d.FindLastMatchingIndex(5, entries[3:]); idx != 5 {
+			t.Errorf("Expected no entry past the end of the log to match, got %d", idx)
+		}
+		if idx := d.FindLastMatchingIndex(2, []LogEntry{newEntry(3, "v")}); idx != 2 {
+			t.Errorf("Expected a conflicting first entry to match nothing, got %d", idx)
+		}
+	})
+}
@@ -2,17 +2,19 @@ package storage
 
 import (
 	"fmt"
-	"github.com/MohammedShetaya/kayakdb/types"
+	"sync"
 )
 
-// TODO: replace this with a desk implmentation
-
 // InMemoryDriver is an in-memory implementation of the Driver interface
 // using slices to store the log entries.
 type InMemoryDriver struct {
+	mutex       sync.Mutex
 	currentTerm uint
 	votedFor    string
-	log         []LogEntry
+	identity    Identity
+	// log[0] is the entry that directly follows the snapshot
+	log      []LogEntry
+	snapshot *Snapshot
 }
 
 func NewInMemoryDriver() *InMemoryDriver {
@@ -22,88 +24,144 @@ func NewInMemoryDriver() *InMemoryDriver {
 }
 
 func (d *InMemoryDriver) GetCurrentTerm() uint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return d.currentTerm
 }
 
 // SetCurrentTerm persist the value of the current term.
 func (d *InMemoryDriver) SetCurrentTerm(term uint) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.currentTerm = term
 	return nil
 }
 
 func (d *InMemoryDriver) GetVotedFor() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return d.votedFor
 }
 
 // SetVotedFor persists the value of the last performed vote.
 func (d *InMemoryDriver) SetVotedFor(candidate string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.votedFor = candidate
 	return nil
 }
 
+func (d *InMemoryDriver) GetIdentity() Identity {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.identity
+}
+
+// SetIdentity persists the identity of the server.
+func (d *InMemoryDriver) SetIdentity(identity Identity) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.identity = identity
+	return nil
+}
+
 // Append appends a log entry and returns the log index.
-func (d *InMemoryDriver) Append(entry LogEntry) uint {
-	fmt.Println("appending")
+func (d *InMemoryDriver) Append(entry LogEntry) (uint, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.log = append(d.log, entry)
-	return uint(len(d.log))
+	return d.lastIndex(), nil
 }
 
-func (d *InMemoryDriver) AppendInIndex(index uint, entry LogEntry) uint {
-	// overwrite if it is possible
-	if index < uint(len(d.log)) {
-		d.log[index] = entry
-		return index
-	}
-	// otherwise append last
-	return d.Append(entry)
+func (d *InMemoryDriver) GetEntryOfIndex(index uint) *LogEntry {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.entryOfIndex(index)
 }
 
-func (d *InMemoryDriver) GetEntryOfIndex(index uint) *LogEntry {
-	if index-1 > uint(len(d.log)) {
+func (d *InMemoryDriver) LastIndex() uint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.lastIndex()
+}
+
+func (d *InMemoryDriver) entryOfIndex(index uint) *LogEntry {
+	first := d.snapshotIndex() + 1
+	if index < first || index > d.lastIndex() {
 		return nil
 	}
-	return &d.log[index-1]
+	entry := d.log[index-first]
+	return &entry
 }
 
+// AppendMany writes the entries starting at startIndex. An existing entry that conflicts with a new one
+// (same index but different term) is deleted together with all the entries that follow it.
 func (d *InMemoryDriver) AppendMany(startIndex uint, entries []LogEntry) error {
-	if startIndex > uint(len(d.log)) {
-		return fmt.Errorf("start index is larger than log length")
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if startIndex <= d.snapshotIndex() || startIndex > d.lastIndex()+1 {
+		return fmt.Errorf("start index %d is outside of the log [%d, %d]", startIndex, d.snapshotIndex()+1, d.lastIndex()+1)
+	}
+
+	for i, entry := range entries {
+		idx := startIndex + uint(i)
+		if existing := d.entryOfIndex(idx); existing != nil {
+			if existing.Term == entry.Term {
+				continue
+			}
+			d.log = d.log[:idx-d.snapshotIndex()-1]
+		}
+		d.log = append(d.log, entry)
 	}
+	return nil
+}
 
-	for i := startIndex; i < uint(len(entries))+startIndex; i++ {
-		d.AppendInIndex(i, entries[i])
+// SaveSnapshot stores the snapshot and discards the log entries that it covers.
+func (d *InMemoryDriver) SaveSnapshot(snapshot *Snapshot) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if snapshot.LastIncludedIndex <= d.snapshotIndex() {
+		return fmt.Errorf("snapshot at index %d is older than the current one at %d", snapshot.LastIncludedIndex, d.snapshotIndex())
 	}
+
+	if entry := d.entryOfIndex(snapshot.LastIncludedIndex); entry != nil && entry.Term == snapshot.LastIncludedTerm {
+		// keep the entries that follow the snapshot
+		d.log = append([]LogEntry(nil), d.log[snapshot.LastIncludedIndex-d.snapshotIndex():]...)
+	} else {
+		d.log = make([]LogEntry, 0)
+	}
+	d.snapshot = snapshot
 	return nil
 }
 
-//// FindLastMatchingIndex the function finds the largest index that matches the incoming entries.
-//// startIndex is the start index in the log where the log[startIndex+1] on the sender is the same as  entries[0]
-//func (d *InMemoryDriver) FindLastMatchingIndex(startIndex uint, entries []LogEntry) (uint, error) {
-//	if startIndex > uint(len(d.log)) {
-//		return 0, fmt.Errorf("start index is larger than log length")
-//	}
-//
-//	l := startIndex
-//	h := startIndex + uint(len(entries))
-//	mid := l + (h-l)/2
-//
-//	for l < h {
-//		mid = l + (h-l)/2
-//		if d.log[mid].Term != entries[mid-startIndex].Term {
-//			h = mid - 1
-//		} else {
-//			l = mid + 1
-//		}
-//	}
-//
-//	return mid, nil
-//}
-
-// ConstructMappingFromLog constructs the map of the key-value pairs from the log entries.
-func (d *InMemoryDriver) ConstructMappingFromLog() (map[string]types.Type, error) {
-	mapping := make(map[string]types.Type)
-	for _, entry := range d.log {
-		mapping[string(entry.Pair.Key.Bytes())] = entry.Pair.Value
+// LoadSnapshot returns the latest snapshot or nil if none was taken yet.
+func (d *InMemoryDriver) LoadSnapshot() (*Snapshot, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.snapshot, nil
+}
+
+func (d *InMemoryDriver) snapshotIndex() uint {
+	if d.snapshot == nil {
+		return 0
 	}
-	return mapping, nil
+	return d.snapshot.LastIncludedIndex
+}
+
+func (d *InMemoryDriver) lastIndex() uint {
+	return d.snapshotIndex() + uint(len(d.log))
+}
+
+// FindLastMatchingIndex returns the largest index up to which the log already holds the entries, entries[0] being
+// the entry at startIndex+1. startIndex is returned if the first one is missing or conflicts.
+func (d *InMemoryDriver) FindLastMatchingIndex(startIndex uint, entries []LogEntry) uint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return findLastMatchingIndex(startIndex, entries, d.snapshotIndex(), d.entryOfIndex)
+}
+
+func (d *InMemoryDriver) Close() error {
+	return nil
 }
@@ -0,0 +1,109 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+)
+
+var ErrLeadershipTransferInProgress = errors.New("leadership is being transferred to another server")
+
+// TransferLeadership hands the leadership over to target, the id of a server or its raft address, as described in
+// section 3.10 of the Raft dissertation. The leader stops accepting proposals, brings the target up to date and tells
+// it to start an election right away. The proposals are refused and the lease is given up while the leadership is
+// transferred, so the transfer is aborted if the target did not take over within an election timeout, whatever the
+// deadline of ctx.
+func (r *Raft) TransferLeadership(ctx context.Context, target string) error {
+	if !r.State.IsLeader() {
+		return r.notLeaderError()
+	}
+	if target == r.State.self || target == r.State.ServerId {
+		return fmt.Errorf("server %v is already the leader", target)
+	}
+	peer := r.State.peer(target)
+	if peer == nil {
+		// the ids of the peers are learned from their answers, which a leader gets within a heartbeat interval
+		peer = r.State.peerWithId(target)
+	}
+	if peer == nil {
+		return fmt.Errorf("server %v is not a member of the cluster", target)
+	}
+	if peer.learner.Load() {
+		return fmt.Errorf("server %v is a learner and cannot become the leader", target)
+	}
+	if peer.witness.Load() {
+		return fmt.Errorf("server %v is a witness and cannot become the leader", target)
+	}
+
+	if !r.transferring.CompareAndSwap(false, true) {
+		return ErrLeadershipTransferInProgress
+	}
+	defer r.transferring.Store(false)
+	ctx, cancel := context.WithTimeout(ctx, r.State.timing.electionTimeoutMax)
+	defer cancel()
+
+	r.logger.Info("Transferring leadership", zap.String("target", target))
+	if err := r.catchUp(ctx, peer); err != nil {
+		return fmt.Errorf("unable to bring %v up to date: %w", target, err)
+	}
+
+	// the voters elect the target without waiting for the lease to expire
+	r.lease.invalidate()
+	term := r.State.Persistent.GetCurrentTerm()
+	request := TimeoutNowRequest{
+		Term:      term,
+		LeaderId:  r.State.ServerId,
+		ClusterId: r.State.ClusterId(),
+	}
+	if err := r.sendRPC(peer, rpcTimeoutNow, request, new(TimeoutNowResponse)); err != nil {
+		return err
+	}
+
+	// the target has a complete log and does not wait for its timer, it wins unless it fails on the way
+	if err := r.waitForStepDown(ctx, term); err != nil {
+		return fmt.Errorf("%v did not take over the leadership: %w", target, err)
+	}
+	r.logger.Info("Leadership was transferred", zap.String("target", target))
+	return nil
+}
+
+// catchUp blocks until the replication goroutine of the peer has replicated the whole log of the leader to it.
+func (r *Raft) catchUp(ctx context.Context, peer *Peer) error {
+	for {
+		// taken before checking, a change in between closes them
+		progressed, changed := peer.progressed.wait(), r.State.role.changed.wait()
+		if peer.match() >= r.State.Persistent.LastIndex() {
+			return nil
+		}
+		if !r.State.IsLeader() {
+			return r.notLeaderError()
+		}
+		r.replicateLog(r.State.Persistent.GetCurrentTerm())
+		select {
+		case <-progressed:
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.done:
+			return ErrShutdown
+		}
+	}
+}
+
+// waitForStepDown blocks until this server is no longer the leader of term.
+func (r *Raft) waitForStepDown(ctx context.Context, term uint) error {
+	for {
+		changed := r.State.role.changed.wait()
+		if !r.State.IsLeader() || r.State.Persistent.GetCurrentTerm() != term {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.done:
+			return ErrShutdown
+		}
+	}
+}
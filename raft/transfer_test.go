@@ -0,0 +1,123 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestTransferLeadership(t *testing.T) {
+	t.Run("the target given by its id takes over and the old leader gives up its lease", func(t *testing.T) {
+		leader, servers := startCluster(t, 3)
+		var target *Raft
+		for _, server := range servers {
+			if server != leader {
+				target = server
+				break
+			}
+		}
+		_, term := leader.State.Leadership()
+		// the leader learns the id of the target from its answers
+		deadline := time.Now().Add(5 * time.Second)
+		for leader.State.peerWithId(target.State.ServerId) == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := leader.TransferLeadership(ctx, target.State.ServerId); err != nil {
+			t.Fatalf("Failed to transfer the leadership: %v", err)
+		}
+
+		deadline = time.Now().Add(5 * time.Second)
+		for !followedBy(target, servers) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !followedBy(target, servers) {
+			t.Fatalf("Expected every server to follow %v", target.State.ServerId)
+		}
+		if isLeader, newTerm := target.State.Leadership(); !isLeader || newTerm != term+1 {
+			t.Errorf("Expected the target to lead term %d, got term %d", term+1, newTerm)
+		}
+		if leader.lease.valid(term, leader.State.clock.Now()) {
+			t.Errorf("Expected the old leader to have given up its lease of term %d", term)
+		}
+		var notLeader *NotLeaderError
+		if err := leader.ReadBarrier(ctx, ReadLease); !errors.As(err, &notLeader) {
+			t.Errorf("Expected a read on the old leader to fail with a NotLeaderError, got %v", err)
+		}
+	})
+
+	t.Run("a transfer to a target that does not catch up is aborted after an election timeout", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		leader := newLeader(t, network, "127.0.0.1:9002")
+
+		start := time.Now()
+		if err := leader.TransferLeadership(context.Background(), "127.0.0.1:9002"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the transfer to time out, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*leader.State.timing.electionTimeoutMax {
+			t.Errorf("Expected the transfer to give up within an election timeout, it took %v", elapsed)
+		}
+		if leader.transferring.Load() {
+			t.Errorf("Expected the proposals to be accepted again")
+		}
+	})
+
+	t.Run("a timeout now request is only followed from the leader of the current term", func(t *testing.T) {
+		node := newFollower(t, 1)
+		node.State.setMembership(configuration{members: []string{"a", node.State.self}}, 1)
+		node.State.setLeader("a", "")
+		controller := NewRpcController(node, zap.NewNop())
+
+		if err := controller.TimeoutNow(TimeoutNowRequest{Term: 1, LeaderId: "b"}, new(TimeoutNowResponse)); err == nil {
+			t.Errorf("Expected a request from a server that is not the leader to be refused")
+		}
+		if err := controller.TimeoutNow(TimeoutNowRequest{Term: 2, LeaderId: "a"}, new(TimeoutNowResponse)); err == nil {
+			t.Errorf("Expected a request from a term the server did not follow to be refused")
+		}
+		select {
+		case leaderId := <-node.timeoutNow:
+			t.Fatalf("Expected no election to be started, got one transferred from %v", leaderId)
+		default:
+		}
+
+		if err := controller.TimeoutNow(TimeoutNowRequest{Term: 1, LeaderId: "a"}, new(TimeoutNowResponse)); err != nil {
+			t.Fatalf("Failed to follow the request of the leader: %v", err)
+		}
+		select {
+		case leaderId := <-node.timeoutNow:
+			if leaderId != "a" {
+				t.Errorf("Expected the election to be transferred from a, got %v", leaderId)
+			}
+		default:
+			t.Errorf("Expected an election to be started")
+		}
+	})
+
+	t.Run("the lease is not used while the leadership is transferred", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		leader := newLeader(t, network, "127.0.0.1:9002")
+		read := func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			return leader.ReadBarrier(ctx, ReadLease)
+		}
+
+		leader.lease.extend(1, leader.State.clock.Now(), time.Minute, 0)
+		leader.transferring.Store(true)
+		if err := read(); !errors.Is(err, ErrLeadershipNotConfirmed) {
+			t.Errorf("Expected a lease read during the transfer to fall back to ReadIndex, got %v", err)
+		}
+
+		// the transfer gave up the lease before the target was told to campaign
+		leader.transferring.Store(false)
+		leader.lease.invalidate()
+		if err := read(); !errors.Is(err, ErrLeadershipNotConfirmed) {
+			t.Errorf("Expected the invalidated lease not to serve reads, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,303 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// rpcService is the name the RpcController of a server is registered under, the ones of its groups follow it with
+// the id of the group
+const rpcService = "RpcController"
+
+// names of the RPCs served by the RpcController
+const (
+	rpcVote            = "Vote"
+	rpcPreVote         = "PreVote"
+	rpcAppend          = "Append"
+	rpcPing            = "Ping"
+	rpcInstallSnapshot = "InstallSnapshot"
+	rpcTimeoutNow      = "TimeoutNow"
+)
+
+// Transport carries the RPCs between the servers of the cluster. A request that reached the other server but was
+// refused by it is returned as an rpc.ServerError, any other error means the server could not be reached.
+type Transport interface {
+	// Serve delivers the RPCs sent to this server to the controller. It blocks until the transport is closed.
+	Serve(controller *RpcController) error
+	// Call invokes the method of the RpcController of the server listening on addr and waits for its response.
+	Call(addr string, method string, request any, response any) error
+	// Disconnect releases the connection to the server listening on addr, if any.
+	Disconnect(addr string)
+	// Close stops serving and releases all the connections.
+	Close() error
+}
+
+// Multiplexer carries the RPCs of many raft groups that run on the same servers. Every group gets a Transport of its
+// own and the groups are told apart by their ids, which are the same on all the servers.
+type Multiplexer interface {
+	// Group returns the transport of the group, closing it stops serving that group only.
+	Group(id string) Transport
+	// Listen accepts the connections of the other servers for all the groups. It blocks until the multiplexer is
+	// closed.
+	Listen() error
+	// Close stops serving and releases all the connections.
+	Close() error
+}
+
+// TCPTransport is the default Transport, it sends the RPCs over TCP with net/rpc.
+type TCPTransport struct {
+	listenAddr string
+	logger     *zap.Logger
+	server     *rpc.Server
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[string]*tcpConn
+	// the connections the other servers opened to this one
+	accepted map[net.Conn]struct{}
+	closed   bool
+	// closed along with the transport, the groups stop serving then
+	done chan struct{}
+}
+
+var _ Multiplexer = (*TCPTransport)(nil)
+
+// tcpConn is the connection to one server. A net/rpc client carries concurrent calls, the mutex only guards dialing
+// and dropping it, so the pipelined append requests of the leader are not serialized behind each other.
+type tcpConn struct {
+	mutex  sync.Mutex
+	client *rpc.Client
+}
+
+func NewTCPTransport(listenAddr string, logger *zap.Logger) *TCPTransport {
+	return &TCPTransport{
+		listenAddr: listenAddr,
+		logger:     logger,
+		server:     rpc.NewServer(),
+		conns:      make(map[string]*tcpConn),
+		accepted:   make(map[net.Conn]struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (t *TCPTransport) Serve(controller *RpcController) error {
+	if err := t.server.RegisterName(rpcService, controller); err != nil {
+		return fmt.Errorf("unable to register rpc controller: %w", err)
+	}
+	return t.Listen()
+}
+
+// Listen accepts the connections of the other servers and serves the controllers registered on this transport and
+// on its groups. It blocks until the transport is closed.
+func (t *TCPTransport) Listen() error {
+	listener, err := net.Listen("tcp", t.listenAddr)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		_ = listener.Close()
+		return nil
+	}
+	t.listener = listener
+	t.mutex.Unlock()
+
+	t.logger.Info(fmt.Sprintf("Raft Server is listening on: %v", listener.Addr()))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return nil
+			}
+			t.logger.Warn("Error accept connection from remote server", zap.Error(err))
+			continue
+		}
+		if !t.track(conn) {
+			_ = conn.Close()
+			return nil
+		}
+		go func() {
+			t.server.ServeConn(conn)
+			t.untrack(conn)
+		}()
+	}
+}
+
+func (t *TCPTransport) Call(addr string, method string, request any, response any) error {
+	return t.call(addr, rpcService+"."+method, request, response)
+}
+
+// call invokes the method, prefixed by the name of its service, on the server listening on addr.
+func (t *TCPTransport) call(addr string, method string, request any, response any) error {
+	if t.isClosed() {
+		return rpc.ErrShutdown
+	}
+	conn := t.conn(addr)
+	client, err := conn.dial(addr)
+	if err != nil {
+		return err
+	}
+
+	err = client.Call(method, request, response)
+	var serverError rpc.ServerError
+	if err != nil && !errors.As(err, &serverError) {
+		// the connection is broken, dial again on the next call
+		conn.drop(client)
+	}
+	return err
+}
+
+func (t *TCPTransport) Disconnect(addr string) {
+	t.mutex.Lock()
+	conn, ok := t.conns[addr]
+	delete(t.conns, addr)
+	t.mutex.Unlock()
+	if ok {
+		conn.close()
+	}
+}
+
+func (t *TCPTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.closed {
+		close(t.done)
+	}
+	t.closed = true
+	for addr, conn := range t.conns {
+		conn.close()
+		delete(t.conns, addr)
+	}
+	for conn := range t.accepted {
+		_ = conn.Close()
+		delete(t.accepted, conn)
+	}
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
+
+func (t *TCPTransport) conn(addr string) *tcpConn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	conn, ok := t.conns[addr]
+	if !ok {
+		conn = &tcpConn{}
+		t.conns[addr] = conn
+	}
+	return conn
+}
+
+// track registers a connection accepted from another server, it reports false if the transport was closed meanwhile.
+func (t *TCPTransport) track(conn net.Conn) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return false
+	}
+	t.accepted[conn] = struct{}{}
+	return true
+}
+
+func (t *TCPTransport) untrack(conn net.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.accepted, conn)
+}
+
+func (t *TCPTransport) isClosed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.closed
+}
+
+// dial returns the client of the connection, and connects to the server listening on addr if there is none.
+func (c *tcpConn) dial(addr string) (*rpc.Client, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Reuse the client if it's already connected, otherwise create new one
+	if c.client == nil {
+		client, err := rpc.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to peer %s: %w", addr, err)
+		}
+		c.client = client
+	}
+	return c.client, nil
+}
+
+// drop closes the client if it is still the one of the connection, a concurrent call might have replaced it already.
+func (c *tcpConn) drop(client *rpc.Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_ = client.Close()
+	if c.client == client {
+		c.client = nil
+	}
+}
+
+func (c *tcpConn) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.client != nil {
+		_ = c.client.Close()
+		c.client = nil
+	}
+}
+
+// Group returns the transport of a raft group. Its RPCs share the listener and the connections of t, and are served by
+// the controller of the group on the other servers.
+func (t *TCPTransport) Group(id string) Transport {
+	return &tcpGroup{
+		transport: t,
+		service:   rpcService + "/" + id,
+		done:      make(chan struct{}),
+	}
+}
+
+// tcpGroup is the transport of one of the raft groups of a TCPTransport.
+type tcpGroup struct {
+	transport *TCPTransport
+	service   string
+	done      chan struct{}
+	closed    sync.Once
+}
+
+// Serve registers the controller of the group, the TCPTransport the group belongs to listens for it.
+func (g *tcpGroup) Serve(controller *RpcController) error {
+	if err := g.transport.server.RegisterName(g.service, controller); err != nil {
+		return fmt.Errorf("unable to register rpc controller: %w", err)
+	}
+	select {
+	case <-g.done:
+	case <-g.transport.done:
+	}
+	return nil
+}
+
+func (g *tcpGroup) Call(addr string, method string, request any, response any) error {
+	select {
+	case <-g.done:
+		return rpc.ErrShutdown
+	default:
+	}
+	return g.transport.call(addr, g.service+"."+method, request, response)
+}
+
+// Disconnect is a no-op, the connections are shared with the other groups.
+func (g *tcpGroup) Disconnect(string) {}
+
+// Close stops the group from serving, a controller cannot be unregistered from net/rpc so the RPCs that still reach
+// it are refused by its server.
+func (g *tcpGroup) Close() error {
+	g.closed.Do(func() {
+		close(g.done)
+	})
+	return nil
+}
@@ -0,0 +1,163 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/rpc"
+	"sync"
+)
+
+// InMemoryNetwork connects the in-memory transports of a cluster whose servers all run in the same process.
+type InMemoryNetwork struct {
+	mutex      sync.RWMutex
+	transports map[string]*InMemoryTransport
+}
+
+func NewInMemoryNetwork() *InMemoryNetwork {
+	return &InMemoryNetwork{
+		transports: make(map[string]*InMemoryTransport),
+	}
+}
+
+// Transport creates the transport of the server listening on addr. Calls to it wait until it serves them, like
+// connections wait to be accepted. It replaces the previous transport of that address, so that a server can be
+// restarted on the same network.
+func (n *InMemoryNetwork) Transport(addr string) *InMemoryTransport {
+	t := &InMemoryTransport{
+		addr:    addr,
+		network: n,
+		inbox:   make(chan *inMemoryCall),
+		done:    make(chan struct{}),
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.transports[addr] = t
+	return t
+}
+
+func (n *InMemoryNetwork) lookup(addr string) *InMemoryTransport {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.transports[addr]
+}
+
+// InMemoryTransport is a Transport that passes the RPCs over channels. Requests and responses are copied with gob
+// like on the wire, so the servers never share memory.
+type InMemoryTransport struct {
+	addr    string
+	network *InMemoryNetwork
+	inbox   chan *inMemoryCall
+	done    chan struct{}
+	closed  sync.Once
+}
+
+var _ Multiplexer = (*InMemoryTransport)(nil)
+
+type inMemoryCall struct {
+	method  string
+	request []byte
+	reply   chan inMemoryReply
+}
+
+type inMemoryReply struct {
+	response []byte
+	err      error
+}
+
+func (t *InMemoryTransport) Serve(controller *RpcController) error {
+	for {
+		select {
+		case call := <-t.inbox:
+			go func() {
+				response, err := controller.Handle(call.method, call.request)
+				call.reply <- inMemoryReply{response: response, err: err}
+			}()
+		case <-t.done:
+			return nil
+		}
+	}
+}
+
+func (t *InMemoryTransport) Call(addr string, method string, request any, response any) error {
+	target := t.network.lookup(addr)
+	if target == nil {
+		return fmt.Errorf("unable to connect to peer %s: connection refused", addr)
+	}
+
+	data, err := encode(request)
+	if err != nil {
+		return err
+	}
+	call := &inMemoryCall{method: method, request: data, reply: make(chan inMemoryReply, 1)}
+
+	select {
+	case target.inbox <- call:
+	case <-target.done:
+		return fmt.Errorf("unable to connect to peer %s: connection refused", addr)
+	case <-t.done:
+		return rpc.ErrShutdown
+	}
+
+	select {
+	case reply := <-call.reply:
+		if reply.err != nil {
+			return rpc.ServerError(reply.err.Error())
+		}
+		return decode(reply.response, response)
+	case <-target.done:
+		return fmt.Errorf("connection to peer %s was closed", addr)
+	case <-t.done:
+		return rpc.ErrShutdown
+	}
+}
+
+// Disconnect is a no-op, there are no connections to release.
+func (t *InMemoryTransport) Disconnect(string) {}
+
+func (t *InMemoryTransport) Close() error {
+	t.closed.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
+
+// Group returns the transport of a raft group. It is reachable at the address of t followed by the id of the group,
+// and calls the transports of the same group on the other servers.
+func (t *InMemoryTransport) Group(id string) Transport {
+	return &inMemoryGroup{
+		InMemoryTransport: t.network.Transport(t.addr + "/" + id),
+		id:                id,
+	}
+}
+
+// Listen blocks until the transport is closed, the RPCs of the groups are served by their own transports.
+func (t *InMemoryTransport) Listen() error {
+	<-t.done
+	return nil
+}
+
+// inMemoryGroup is the transport of one of the raft groups of an InMemoryTransport.
+type inMemoryGroup struct {
+	*InMemoryTransport
+	id string
+}
+
+func (g *inMemoryGroup) Call(addr string, method string, request any, response any) error {
+	return g.InMemoryTransport.Call(addr+"/"+g.id, method, request, response)
+}
+
+func encode(value any) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, fmt.Errorf("unable to encode rpc message: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func decode(data []byte, value any) error {
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(value); err != nil {
+		return fmt.Errorf("unable to decode rpc message: %w", err)
+	}
+	return nil
+}
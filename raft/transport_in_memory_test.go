@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"errors"
+	"net/rpc"
+	"testing"
+
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+)
+
+func TestInMemoryTransport(t *testing.T) {
+	types.RegisterDataTypes()
+
+	t.Run("two servers in one process exchange RPCs", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		_, sender := newServingNode(t, network, "9001")
+		receiver, _ := newServingNode(t, network, "9002")
+
+		request := AppendRequest{
+			Term:     3,
+			LeaderId: "leader",
+			Entries: []storage.LogEntry{{
+				Version: storage.EntryVersion,
+				Term:    3,
+				Data:    []byte("value"),
+			}},
+		}
+		if err := sender.Call("127.0.0.1:9002", rpcAppend, request, new(AppendResponse)); err != nil {
+			t.Fatalf("Failed to call Append: %v", err)
+		}
+		if term := receiver.State.Persistent.GetCurrentTerm(); term != 3 {
+			t.Errorf("Expected the receiver to move to term 3, got %d", term)
+		}
+		entry := receiver.State.Persistent.GetEntryOfIndex(1)
+		if entry == nil || string(entry.Data) != "value" {
+			t.Errorf("Expected the entry to be appended on the receiver, got %v", entry)
+		}
+		// the receiver got a copy of the request
+		request.Entries[0].Data[0] = 'V'
+		if entry = receiver.State.Persistent.GetEntryOfIndex(1); string(entry.Data) != "value" {
+			t.Errorf("Expected the receiver not to share memory with the sender")
+		}
+	})
+
+	t.Run("entries of a newer version are refused", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		_, sender := newServingNode(t, network, "9001")
+		receiver, _ := newServingNode(t, network, "9002")
+
+		request := AppendRequest{
+			Term:     1,
+			LeaderId: "leader",
+			Entries:  []storage.LogEntry{{Version: storage.EntryVersion + 1, Term: 1}},
+		}
+		var serverError rpc.ServerError
+		if err := sender.Call("127.0.0.1:9002", rpcAppend, request, new(AppendResponse)); !errors.As(err, &serverError) {
+			t.Errorf("Expected the entry to be refused, got %v", err)
+		}
+		if last := receiver.State.Persistent.LastIndex(); last != 0 {
+			t.Errorf("Expected nothing to be appended, got the last index %d", last)
+		}
+	})
+
+	t.Run("refused requests are server errors", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		_, sender := newServingNode(t, network, "9001")
+		receiver, _ := newServingNode(t, network, "9002")
+		if err := receiver.State.Persistent.SetCurrentTerm(5); err != nil {
+			t.Fatalf("Failed to set term: %v", err)
+		}
+
+		err := sender.Call("127.0.0.1:9002", rpcPing, PingRequest{Term: 4}, new(PingResponse))
+		var serverError rpc.ServerError
+		if !errors.As(err, &serverError) {
+			t.Errorf("Expected a server error for a stale term, got %v", err)
+		}
+	})
+
+	t.Run("calls to unknown or closed servers fail", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		_, sender := newServingNode(t, network, "9001")
+		_, receiver := newServingNode(t, network, "9002")
+
+		err := sender.Call("127.0.0.1:9003", rpcPing, PingRequest{}, new(PingResponse))
+		if err == nil {
+			t.Errorf("Expected the call to an unknown server to fail")
+		}
+
+		_ = receiver.Close()
+		err = sender.Call("127.0.0.1:9002", rpcPing, PingRequest{}, new(PingResponse))
+		var serverError rpc.ServerError
+		if err == nil || errors.As(err, &serverError) {
+			t.Errorf("Expected the call to a closed server to fail to connect, got %v", err)
+		}
+	})
+
+	t.Run("the groups of a transport are served by their own servers", func(t *testing.T) {
+		network := NewInMemoryNetwork()
+		_, sender := newServingNode(t, network, "9001")
+		_, receiver := newServingNode(t, network, "9002")
+
+		transport := receiver.Group("group")
+		group := serve(t, newNode(t, testConfig(t), transport), transport)
+		request := PingRequest{Term: 2, LeaderId: "leader"}
+		if err := sender.Group("group").Call("127.0.0.1:9002", rpcPing, request, new(PingResponse)); err != nil {
+			t.Fatalf("Failed to call the group: %v", err)
+		}
+		if term := group.State.Persistent.GetCurrentTerm(); term != 2 {
+			t.Errorf("Expected the server of the group to move to term 2, got %d", term)
+		}
+		if err := sender.Group("other").Call("127.0.0.1:9002", rpcPing, request, new(PingResponse)); err == nil {
+			t.Errorf("Expected the call to a group that is not served to fail")
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package shard
+
+import (
+	"context"
+	"github.com/MohammedShetaya/kayakdb/raft"
+	guuid "github.com/google/uuid"
+	"go.uber.org/zap"
+	"time"
+)
+
+// balance checks the sizes of the ranges this server leads every range_check_interval, until the store is shut down.
+func (s *Store) balance() {
+	defer s.routines.Done()
+	interval := time.Duration(s.config.RangeCheckInterval) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.rebalance(interval)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// rebalance splits the ranges this server leads that grew larger than range_split_bytes. A range smaller than
+// range_merge_bytes whose left neighbor is small too is sealed, and the leader of the left neighbor merges it once
+// its replica applied the seal. The leaders of the ranges are spread over the servers, so every step is taken by
+// the leader of the range whose log it is written to.
+func (s *Store) rebalance(timeout time.Duration) {
+	replicas := s.snapshot()
+	byStart := make(map[string]*replica)
+	byEnd := make(map[string]*replica)
+	for _, replica := range replicas {
+		if bounds, ok := replica.fsm.Range(); ok {
+			byStart[bounds.Start] = replica
+			byEnd[bounds.End] = replica
+		}
+	}
+
+	for _, replica := range replicas {
+		bounds, ok := replica.fsm.Range()
+		if !ok || !replica.raft.State.IsLeader() || replica.fsm.Sealed() {
+			continue
+		}
+		size := replica.fsm.Size()
+		right := byStart[bounds.End]
+		switch {
+		case size > s.config.RangeSplitBytes:
+			s.proposeSplit(replica, bounds, timeout)
+		case bounds.End != "" && right != nil && right.fsm.Sealed():
+			s.proposeMerge(replica, bounds, right, timeout)
+		case bounds.Start != "" && size < s.config.RangeMergeBytes:
+			if left := byEnd[bounds.Start]; left != nil && !left.fsm.Sealed() && left.fsm.Size() < s.config.RangeMergeBytes {
+				s.propose(replica, bounds, command{Seal: &sealCommand{Id: bounds.Id}}, timeout)
+			}
+		}
+	}
+}
+
+// proposeSplit proposes to cut the range at its median key, the right half becomes a new range with the same
+// members.
+func (s *Store) proposeSplit(replica *replica, bounds Range, timeout time.Duration) {
+	at, ok := replica.fsm.splitKey()
+	if !ok {
+		return
+	}
+	s.propose(replica, bounds, command{Split: &splitCommand{
+		At:       at,
+		Id:       "range-" + guuid.NewString(),
+		Members:  replica.raft.Members(),
+		Learners: replica.raft.Learners(),
+	}}, timeout)
+}
+
+// proposeMerge proposes to extend the range over its sealed right neighbor. No write is applied to a sealed range, so
+// its local replica holds its final state, and the layout the left neighbor takes over.
+func (s *Store) proposeMerge(replica *replica, bounds Range, right *replica, timeout time.Duration) {
+	rightBounds, ok := right.fsm.Range()
+	if !ok {
+		return
+	}
+	s.propose(replica, bounds, command{Merge: &mergeCommand{Right: rightBounds, State: right.fsm.pairs(), Layout: right.fsm.Layout()}}, timeout)
+}
+
+// propose proposes a range command to the raft group of the replica and waits until it is applied. A command that
+// fails is proposed again on one of the next checks if it is still needed.
+func (s *Store) propose(replica *replica, bounds Range, c command, timeout time.Duration) {
+	data, err := encodeCommand(c)
+	if err != nil {
+		s.logger.Error("Failed to encode range command", zap.Error(err))
+		return
+	}
+	proposal, err := replica.raft.Propose(raft.Command{Data: data})
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, err = proposal.Wait(ctx)
+	}
+	if err != nil {
+		s.logger.Debug("Range command failed", zap.Stringer("range", bounds), zap.Error(err))
+	}
+}
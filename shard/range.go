@@ -0,0 +1,423 @@
+package shard
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrKeyOutOfRange is returned for the keys a range does not own, the request has to be routed again
+	ErrKeyOutOfRange = errors.New("the key is not in the range")
+	// ErrRangeSealed is returned for the writes to a range that is being merged into its left neighbor
+	ErrRangeSealed = errors.New("the range is being merged")
+)
+
+// Range is a contiguous part of the keyspace, the keys from Start included to End excluded. Keys are ordered by their
+// bytes, an empty End leaves the range unbounded.
+type Range struct {
+	Id    string
+	Start string
+	End   string
+}
+
+// Contains reports whether the key, given as its bytes, belongs to the range.
+func (r Range) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%s[%q, %q)", r.Id, r.Start, r.End)
+}
+
+// A range is split and merged through commands in the logs of the ranges involved, so that every replica changes its
+// bounds at the same index:
+//   - a split cuts the range in two in its own log. Every replica hands the keys of the right half over to a new raft
+//     group, whose log starts with the same seed entries on all of them.
+//   - a merge starts with a seal in the log of the right range. A sealed range refuses the writes, so the replicas
+//     that applied the seal all hold its final state.
+//   - the left neighbor then takes the final state over in its own log, and every replica removes the right range.
+
+// command is the payload of the entries that change the bounds of a range. Its fields differ from the ones of a
+// raft.KVCommand, so each of them fails to decode as the other.
+type command struct {
+	Seed  *seedCommand
+	Split *splitCommand
+	Seal  *sealCommand
+	Merge *mergeCommand
+}
+
+// seedCommand is the first command in the log of a range created by a split.
+type seedCommand struct {
+	Bounds Range
+	State  map[string]types.Type
+}
+
+// splitCommand moves the keys from At on to a new range. Members and Learners are the membership of its raft group.
+type splitCommand struct {
+	At       string
+	Id       string
+	Members  []string
+	Learners []string
+}
+
+// sealCommand makes range Id refuse the writes until it is merged.
+type sealCommand struct {
+	Id string
+}
+
+// mergeCommand extends the range over its sealed right neighbor, whose final state is State and Layout.
+type mergeCommand struct {
+	Right  Range
+	State  map[string]types.Type
+	Layout layout
+}
+
+// layout is what a range knows of the raft groups around it: the ranges split off it that were not merged back, and
+// the ranges merged into it. A range takes the layout of the ranges merged into it over. The snapshots keep it, so
+// that a replica that installs one opens and removes the ranges whose split and merge commands it never applied.
+type layout struct {
+	Splits map[string]splitCommand
+	Merged map[string]bool
+}
+
+func (l *layout) split(c splitCommand) {
+	if l.Splits == nil {
+		l.Splits = make(map[string]splitCommand)
+	}
+	l.Splits[c.Id] = c
+}
+
+func (l *layout) merge(id string, right layout) {
+	if l.Merged == nil {
+		l.Merged = make(map[string]bool)
+	}
+	for _, c := range right.Splits {
+		l.split(c)
+	}
+	for merged := range right.Merged {
+		l.Merged[merged] = true
+	}
+	l.Merged[id] = true
+	for merged := range l.Merged {
+		delete(l.Splits, merged)
+	}
+}
+
+// copy returns a layout that does not share its maps with l.
+func (l *layout) copy() layout {
+	copied := layout{Splits: make(map[string]splitCommand, len(l.Splits)), Merged: make(map[string]bool, len(l.Merged))}
+	for id, c := range l.Splits {
+		copied.Splits[id] = c
+	}
+	for id := range l.Merged {
+		copied.Merged[id] = true
+	}
+	return copied
+}
+
+func encodeCommand(c command) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(c); err != nil {
+		return nil, fmt.Errorf("unable to encode range command: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func decodeCommand(data []byte) (command, error) {
+	var c command
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&c); err != nil {
+		return c, fmt.Errorf("unable to decode range command: %w", err)
+	}
+	return c, nil
+}
+
+// seedEntries are the first entries of the log of a range created by a split: its membership and its initial state.
+// Every replica starts with the same entries, so they are committed along with the first entry of its first leader.
+func seedEntries(bounds Range, state map[string]types.Type, members, learners []string) ([]storage.LogEntry, error) {
+	data, err := encodeCommand(command{Seed: &seedCommand{Bounds: bounds, State: state}})
+	if err != nil {
+		return nil, err
+	}
+	return []storage.LogEntry{
+		membershipEntry(members, learners),
+		{Version: storage.EntryVersion, Term: 1, Type: storage.EntryCommand, Data: data},
+	}, nil
+}
+
+// membershipEntry is the first of the seed entries. A replica that missed the split starts with it alone, the state
+// of the range at the time of the split is lost and its leader sends the seed command, or a snapshot, over.
+func membershipEntry(members, learners []string) storage.LogEntry {
+	return storage.LogEntry{Version: storage.EntryVersion, Term: 1, Type: storage.EntryConfiguration, Members: members, Learners: learners}
+}
+
+// rangeEvents are told about the ranges the splits create and the ones the merges remove. They are called while the
+// command is applied, or once a snapshot was restored.
+type rangeEvents interface {
+	split(bounds Range, state map[string]types.Type, members, learners []string)
+	merged(right Range)
+	// restored is told the layout of a restored snapshot, the replica might have missed some of its splits and merges
+	restored(l layout)
+}
+
+// rangeFSM is the state machine of a range: the key-value pairs it owns and its bounds. It refuses the writes to the
+// keys outside of its bounds, since they were routed with a stale view of the ranges.
+type rangeFSM struct {
+	mutex sync.RWMutex
+	// nil until the range was seeded
+	bounds  *Range
+	initial *Range
+	sealed  bool
+	layout  layout
+	state   map[string]types.Type
+	// the bytes of the keys and values
+	size   uint
+	events rangeEvents
+}
+
+// snapshot is the serialized state of a rangeFSM.
+type snapshot struct {
+	Bounds *Range
+	Sealed bool
+	Layout layout
+	State  map[string]types.Type
+}
+
+// newRangeFSM creates the state machine of a range, bounds is nil for a range whose seed entries are in its log.
+func newRangeFSM(bounds *Range, events rangeEvents) *rangeFSM {
+	f := &rangeFSM{initial: bounds, events: events}
+	f.reset(bounds, false, nil)
+	return f
+}
+
+func (f *rangeFSM) Apply(entry storage.LogEntry) error {
+	if kv, err := raft.DecodeKVCommand(entry.Data); err == nil {
+		return f.applyKV(kv)
+	}
+	c, err := decodeCommand(entry.Data)
+	if err != nil {
+		// not proposed for this state machine
+		return nil
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch {
+	case c.Seed != nil:
+		f.reset(&c.Seed.Bounds, false, c.Seed.State)
+	case c.Split != nil:
+		return f.split(*c.Split)
+	case c.Seal != nil:
+		return f.seal(*c.Seal)
+	case c.Merge != nil:
+		return f.merge(*c.Merge)
+	}
+	return nil
+}
+
+func (f *rangeFSM) applyKV(kv raft.KVCommand) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, pair := range kv.Pairs {
+		if err := f.check(string(pair.Key.Bytes())); err != nil {
+			return err
+		}
+	}
+	if f.sealed {
+		return fmt.Errorf("%w: %v", ErrRangeSealed, f.bounds)
+	}
+	for _, pair := range kv.Pairs {
+		key := string(pair.Key.Bytes())
+		switch kv.Op {
+		case raft.KVPut:
+			f.put(key, pair.Value)
+		case raft.KVDelete:
+			f.remove(key)
+		}
+	}
+	return nil
+}
+
+func (f *rangeFSM) split(c splitCommand) error {
+	if f.bounds == nil || f.sealed || c.At <= f.bounds.Start || !f.bounds.Contains(c.At) {
+		return fmt.Errorf("unable to split %v at %q", f.bounds, c.At)
+	}
+	right := Range{Id: c.Id, Start: c.At, End: f.bounds.End}
+	moved := make(map[string]types.Type)
+	for key, value := range f.state {
+		if right.Contains(key) {
+			moved[key] = value
+		}
+	}
+	// the new range is created before the keys leave this one, so that a key is always owned by a local range
+	f.events.split(right, moved, c.Members, c.Learners)
+	f.layout.split(c)
+	for key := range moved {
+		f.remove(key)
+	}
+	f.bounds.End = c.At
+	return nil
+}
+
+func (f *rangeFSM) seal(c sealCommand) error {
+	// the first range has no left neighbor to be merged into
+	if f.bounds == nil || f.bounds.Id != c.Id || f.bounds.Start == "" {
+		return fmt.Errorf("unable to seal %v", f.bounds)
+	}
+	f.sealed = true
+	return nil
+}
+
+func (f *rangeFSM) merge(c mergeCommand) error {
+	if f.bounds == nil || f.sealed || f.bounds.End == "" || f.bounds.End != c.Right.Start {
+		return fmt.Errorf("unable to merge %v into %v", c.Right, f.bounds)
+	}
+	for key, value := range c.State {
+		f.put(key, value)
+	}
+	f.bounds.End = c.Right.End
+	f.layout.merge(c.Right.Id, c.Layout)
+	f.events.merged(c.Right)
+	return nil
+}
+
+// check returns ErrKeyOutOfRange if the key is not owned by the range.
+func (f *rangeFSM) check(key string) error {
+	if f.bounds == nil || !f.bounds.Contains(key) {
+		return fmt.Errorf("%w: %q is not in %v", ErrKeyOutOfRange, key, f.bounds)
+	}
+	return nil
+}
+
+func (f *rangeFSM) put(key string, value types.Type) {
+	f.remove(key)
+	f.state[key] = value
+	f.size += uint(len(key)) + valueSize(value)
+}
+
+func (f *rangeFSM) remove(key string) {
+	if value, ok := f.state[key]; ok {
+		f.size -= uint(len(key)) + valueSize(value)
+		delete(f.state, key)
+	}
+}
+
+func valueSize(value types.Type) uint {
+	if value == nil {
+		return 0
+	}
+	return uint(len(value.Bytes()))
+}
+
+// reset replaces the whole state, it is called with the mutex held or before the state machine is shared.
+func (f *rangeFSM) reset(bounds *Range, sealed bool, state map[string]types.Type) {
+	if bounds != nil {
+		copied := *bounds
+		bounds = &copied
+	}
+	f.bounds, f.sealed = bounds, sealed
+	f.state, f.size = make(map[string]types.Type), 0
+	for key, value := range state {
+		f.put(key, value)
+	}
+}
+
+// Get returns the value of the key, or nil if it was never written. It fails with ErrKeyOutOfRange if the range does
+// not own the key.
+func (f *rangeFSM) Get(key types.Type) (types.Type, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if err := f.check(string(key.Bytes())); err != nil {
+		return nil, err
+	}
+	return f.state[string(key.Bytes())], nil
+}
+
+func (f *rangeFSM) Snapshot() ([]byte, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(snapshot{Bounds: f.bounds, Sealed: f.sealed, Layout: f.layout, State: f.state}); err != nil {
+		return nil, fmt.Errorf("unable to encode range: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (f *rangeFSM) Restore(data []byte) error {
+	restored := snapshot{Bounds: f.initial}
+	if len(data) > 0 {
+		restored = snapshot{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&restored); err != nil {
+			return fmt.Errorf("unable to decode range: %w", err)
+		}
+	}
+	f.mutex.Lock()
+	f.reset(restored.Bounds, restored.Sealed, restored.State)
+	f.layout = restored.Layout
+	f.mutex.Unlock()
+	f.events.restored(restored.Layout.copy())
+	return nil
+}
+
+// Range returns the bounds of the range, it reports false until the range was seeded.
+func (f *rangeFSM) Range() (Range, bool) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if f.bounds == nil {
+		return Range{}, false
+	}
+	return *f.bounds, true
+}
+
+// Sealed reports whether the range refuses the writes until it is merged.
+func (f *rangeFSM) Sealed() bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.sealed
+}
+
+// Size returns the bytes of the keys and values of the range.
+func (f *rangeFSM) Size() uint {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.size
+}
+
+// splitKey returns the median key of the range, it reports false if the range holds less than two keys.
+func (f *rangeFSM) splitKey() (string, bool) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if len(f.state) < 2 {
+		return "", false
+	}
+	keys := make([]string, 0, len(f.state))
+	for key := range f.state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys[len(keys)/2], true
+}
+
+// Layout returns a copy of what the range knows of the ranges around it.
+func (f *rangeFSM) Layout() layout {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.layout.copy()
+}
+
+// pairs returns a copy of the key-value pairs of the range.
+func (f *rangeFSM) pairs() map[string]types.Type {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	pairs := make(map[string]types.Type, len(f.state))
+	for key, value := range f.state {
+		pairs[key] = value
+	}
+	return pairs
+}
@@ -0,0 +1,220 @@
+package shard
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+)
+
+// recorder records the ranges the splits create, the ones the merges remove and the layouts of the restored snapshots.
+type recorder struct {
+	splits   []Range
+	states   []map[string]types.Type
+	merges   []Range
+	restores []layout
+}
+
+func (r *recorder) split(bounds Range, state map[string]types.Type, _, _ []string) {
+	r.splits = append(r.splits, bounds)
+	r.states = append(r.states, state)
+}
+
+func (r *recorder) merged(right Range) {
+	r.merges = append(r.merges, right)
+}
+
+func (r *recorder) restored(l layout) {
+	r.restores = append(r.restores, l)
+}
+
+func put(t *testing.T, keys ...string) storage.LogEntry {
+	t.Helper()
+	var pairs []types.KeyValue
+	for _, key := range keys {
+		pairs = append(pairs, types.KeyValue{Key: types.String(key), Value: types.String("value of " + key)})
+	}
+	data, err := raft.EncodeKVCommand(raft.KVCommand{Op: raft.KVPut, Pairs: pairs})
+	if err != nil {
+		t.Fatalf("Failed to encode command: %v", err)
+	}
+	return storage.LogEntry{Term: 1, Data: data}
+}
+
+func rangeCommand(t *testing.T, c command) storage.LogEntry {
+	t.Helper()
+	data, err := encodeCommand(c)
+	if err != nil {
+		t.Fatalf("Failed to encode range command: %v", err)
+	}
+	return storage.LogEntry{Term: 1, Data: data}
+}
+
+func key(value string) string {
+	return string(types.String(value).Bytes())
+}
+
+func TestRangeFSM(t *testing.T) {
+	types.RegisterDataTypes()
+
+	t.Run("the commands of the ranges are not taken for key-value commands", func(t *testing.T) {
+		entry := rangeCommand(t, command{Seal: &sealCommand{Id: "range"}})
+		if _, err := raft.DecodeKVCommand(entry.Data); err == nil {
+			t.Errorf("Expected a range command not to decode as a key-value command")
+		}
+		if _, err := decodeCommand(put(t, "a").Data); err == nil {
+			t.Errorf("Expected a key-value command not to decode as a range command")
+		}
+	})
+
+	t.Run("writes to the keys outside of the range are refused", func(t *testing.T) {
+		fsm := newRangeFSM(&Range{Id: "range", Start: key("b"), End: key("d")}, &recorder{})
+		if err := fsm.Apply(put(t, "b", "e")); !errors.Is(err, ErrKeyOutOfRange) {
+			t.Errorf("Expected the write to fail with %v, got %v", ErrKeyOutOfRange, err)
+		}
+		if fsm.Size() != 0 {
+			t.Errorf("Expected a refused write to leave the range as it was, it holds %d bytes", fsm.Size())
+		}
+		if err := fsm.Apply(put(t, "b", "c")); err != nil {
+			t.Fatalf("Failed to write to the range: %v", err)
+		}
+		if value, err := fsm.Get(types.String("c")); err != nil || value.String() != "value of c" {
+			t.Errorf("Expected to read the value of c, got %v, %v", value, err)
+		}
+		if _, err := fsm.Get(types.String("a")); !errors.Is(err, ErrKeyOutOfRange) {
+			t.Errorf("Expected a read outside of the range to fail with %v, got %v", ErrKeyOutOfRange, err)
+		}
+	})
+
+	t.Run("a split hands the keys of the right half over to a new range", func(t *testing.T) {
+		events := &recorder{}
+		fsm := newRangeFSM(&Range{Id: "left"}, events)
+		if err := fsm.Apply(put(t, "a", "b", "c", "d")); err != nil {
+			t.Fatalf("Failed to write to the range: %v", err)
+		}
+		at, ok := fsm.splitKey()
+		if !ok || at != key("c") {
+			t.Fatalf("Expected to split at the median key c, got %q", at)
+		}
+
+		if err := fsm.Apply(rangeCommand(t, command{Split: &splitCommand{At: at, Id: "right"}})); err != nil {
+			t.Fatalf("Failed to split the range: %v", err)
+		}
+		if bounds, _ := fsm.Range(); bounds != (Range{Id: "left", End: at}) {
+			t.Errorf("Expected the range to end at the split key, got %v", bounds)
+		}
+		if len(events.splits) != 1 || events.splits[0] != (Range{Id: "right", Start: at}) {
+			t.Fatalf("Expected the right half to become a new range, got %v", events.splits)
+		}
+		if state := events.states[0]; len(state) != 2 || state[key("c")] == nil || state[key("d")] == nil {
+			t.Errorf("Expected the keys c and d to move to the new range, got %v", state)
+		}
+		if _, err := fsm.Get(types.String("d")); !errors.Is(err, ErrKeyOutOfRange) {
+			t.Errorf("Expected the moved keys to leave the range, got %v", err)
+		}
+		if err := fsm.Apply(rangeCommand(t, command{Split: &splitCommand{At: key("e"), Id: "other"}})); err == nil {
+			t.Errorf("Expected a split outside of the range to be refused")
+		}
+	})
+
+	t.Run("a sealed range refuses the writes and is merged into its left neighbor", func(t *testing.T) {
+		events := &recorder{}
+		left := newRangeFSM(&Range{Id: "left", End: key("c")}, events)
+		right := newRangeFSM(&Range{Id: "right", Start: key("c")}, events)
+		if err := right.Apply(put(t, "c")); err != nil {
+			t.Fatalf("Failed to write to the range: %v", err)
+		}
+		if err := left.Apply(rangeCommand(t, command{Seal: &sealCommand{Id: "left"}})); err == nil {
+			t.Errorf("Expected the first range not to be sealed")
+		}
+
+		if err := right.Apply(rangeCommand(t, command{Seal: &sealCommand{Id: "right"}})); err != nil {
+			t.Fatalf("Failed to seal the range: %v", err)
+		}
+		if err := right.Apply(put(t, "d")); !errors.Is(err, ErrRangeSealed) {
+			t.Errorf("Expected a write to a sealed range to fail with %v, got %v", ErrRangeSealed, err)
+		}
+
+		bounds, _ := right.Range()
+		merge := command{Merge: &mergeCommand{Right: bounds, State: right.pairs()}}
+		if err := left.Apply(rangeCommand(t, merge)); err != nil {
+			t.Fatalf("Failed to merge the range: %v", err)
+		}
+		if bounds, _ := left.Range(); bounds != (Range{Id: "left"}) {
+			t.Errorf("Expected the left range to own the whole keyspace, got %v", bounds)
+		}
+		if value, err := left.Get(types.String("c")); err != nil || value == nil {
+			t.Errorf("Expected the left range to hold the keys of the right one, got %v, %v", value, err)
+		}
+		if len(events.merges) != 1 || events.merges[0].Id != "right" {
+			t.Errorf("Expected the right range to be removed, got %v", events.merges)
+		}
+		if err := left.Apply(rangeCommand(t, merge)); err == nil {
+			t.Errorf("Expected a merge of a range that is not the right neighbor to be refused")
+		}
+	})
+
+	t.Run("a range is restored from its snapshot", func(t *testing.T) {
+		fsm := newRangeFSM(&Range{Id: "range", Start: key("b")}, &recorder{})
+		if err := fsm.Apply(put(t, "b")); err != nil {
+			t.Fatalf("Failed to write to the range: %v", err)
+		}
+		_ = fsm.Apply(rangeCommand(t, command{Seal: &sealCommand{Id: "range"}}))
+		data, err := fsm.Snapshot()
+		if err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+
+		restored := newRangeFSM(nil, &recorder{})
+		if _, ok := restored.Range(); ok {
+			t.Errorf("Expected a range that was not seeded to own no key")
+		}
+		if err = restored.Restore(data); err != nil {
+			t.Fatalf("Failed to restore snapshot: %v", err)
+		}
+		if bounds, _ := restored.Range(); bounds != (Range{Id: "range", Start: key("b")}) || !restored.Sealed() {
+			t.Errorf("Expected the bounds and the seal to be restored, got %v sealed %v", bounds, restored.Sealed())
+		}
+		if restored.Size() != fsm.Size() {
+			t.Errorf("Expected the restored range to hold %d bytes, got %d", fsm.Size(), restored.Size())
+		}
+	})
+
+	t.Run("a restored snapshot tells the ranges split off and the ones merged away", func(t *testing.T) {
+		fsm := newRangeFSM(&Range{Id: "left"}, &recorder{})
+		if err := fsm.Apply(rangeCommand(t, command{Split: &splitCommand{At: key("c"), Id: "right", Members: []string{"a"}}})); err != nil {
+			t.Fatalf("Failed to split the range: %v", err)
+		}
+		if err := fsm.Apply(rangeCommand(t, command{Split: &splitCommand{At: key("b"), Id: "middle"}})); err != nil {
+			t.Fatalf("Failed to split the range: %v", err)
+		}
+		// the middle range split a range off before it was merged back, the left range takes it over
+		var middle layout
+		middle.split(splitCommand{Id: "other"})
+		merge := command{Merge: &mergeCommand{Right: Range{Id: "middle", Start: key("b"), End: key("c")}, Layout: middle}}
+		if err := fsm.Apply(rangeCommand(t, merge)); err != nil {
+			t.Fatalf("Failed to merge the range: %v", err)
+		}
+		data, err := fsm.Snapshot()
+		if err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+
+		events := &recorder{}
+		if err = newRangeFSM(nil, events).Restore(data); err != nil {
+			t.Fatalf("Failed to restore snapshot: %v", err)
+		}
+		if len(events.restores) != 1 {
+			t.Fatalf("Expected the layout of the snapshot to be told once, got %v", events.restores)
+		}
+		restored := events.restores[0]
+		if len(restored.Splits) != 2 || restored.Splits["right"].Members[0] != "a" || restored.Splits["other"].Id != "other" {
+			t.Errorf("Expected the ranges split off and the ones inherited from the merge, got %v", restored.Splits)
+		}
+		if len(restored.Merged) != 1 || !restored.Merged["middle"] {
+			t.Errorf("Expected the merged range to be told, got %v", restored.Merged)
+		}
+	})
+}
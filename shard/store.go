@@ -0,0 +1,455 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/MohammedShetaya/kayakdb/config"
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FirstRange is the id of the range that owns the whole keyspace when a store starts for the first time.
+const FirstRange = "range-0"
+
+// removeTimeout bounds how long a range that was merged away takes to shut down
+const removeTimeout = 5 * time.Second
+
+// removedSuffix marks the ranges that were merged away in the storage
+const removedSuffix = ".removed"
+
+// ErrNoRange is returned for the keys no local range owns, while a split or a merge is being applied.
+var ErrNoRange = errors.New("no range owns the key")
+
+// Store hosts the replicas of the ranges of the keyspace that are on this server. Every range is a raft group of its
+// own, with its own log and leader, and all the groups share the raft port. The ranges this server leads are split
+// once they grew larger than range_split_bytes, and merged into their left neighbor once both are smaller than
+// range_merge_bytes.
+type Store struct {
+	config    *config.Configuration
+	logger    *zap.Logger
+	transport raft.Multiplexer
+	drivers   drivers
+
+	mutex    sync.RWMutex
+	replicas map[string]*replica
+	// the ranges that were merged away, they are never opened again
+	removed  map[string]bool
+	started  bool
+	stopping bool
+
+	// closed when the background goroutines have to return
+	done chan struct{}
+	// the ranges that are served and the background goroutines, Shutdown waits for them
+	routines sync.WaitGroup
+}
+
+// replica is the replica of a range on this server.
+type replica struct {
+	raft *raft.Raft
+	fsm  *rangeFSM
+}
+
+// StoreOptions replaces the dependencies NewStore builds from the configuration, the zero value of a field keeps the
+// default.
+type StoreOptions struct {
+	// Transport defaults to TCP on the raft port
+	Transport raft.Multiplexer
+}
+
+// NewStore creates the replicas of the ranges found in the storage, or the first range if there are none.
+func NewStore(config *config.Configuration, logger *zap.Logger, options StoreOptions) (*Store, error) {
+	if options.Transport == nil {
+		options.Transport = raft.NewTCPTransport(":"+config.RaftPort, logger)
+	}
+	d, err := newDrivers(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		config:    config,
+		logger:    logger,
+		transport: options.Transport,
+		drivers:   d,
+		replicas:  make(map[string]*replica),
+		removed:   make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+
+	removed, err := s.drivers.removed()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range removed {
+		s.removed[id] = true
+	}
+	ids, err := s.drivers.list()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		ids = []string{FirstRange}
+	}
+	for _, id := range ids {
+		// a range that is already open is kept, the snapshot of a range restored before might have opened it
+		if s.known(id) {
+			continue
+		}
+		// the other ranges start with their bounds in their logs
+		var bounds *Range
+		if id == FirstRange {
+			bounds = &Range{Id: FirstRange}
+		}
+		if err = s.open(id, bounds, nil); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// open creates the replica of a range, its log starts with seed if it is new. The mutex must not be held.
+func (s *Store) open(id string, bounds *Range, seed []storage.LogEntry) error {
+	if s.known(id) {
+		return nil
+	}
+	driver, err := s.drivers.open(id)
+	if err != nil {
+		return err
+	}
+	if driver.LastIndex() == 0 && len(seed) > 0 {
+		if err = driver.AppendMany(1, seed); err == nil {
+			err = driver.SetCurrentTerm(seed[len(seed)-1].Term)
+		}
+		if err != nil {
+			_ = driver.Close()
+			return fmt.Errorf("unable to seed range %v: %w", id, err)
+		}
+	}
+
+	fsm := newRangeFSM(bounds, s)
+	r, err := raft.NewRaftWithOptions(s.config, s.logger.With(zap.String("range", id)), raft.Options{
+		Transport: s.transport.Group(id),
+		Driver:    driver,
+		FSM:       fsm,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to open range %v: %w", id, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopping {
+		// the raft server was not started, it shuts down right away
+		return r.Shutdown(context.Background())
+	}
+	replica := &replica{raft: r, fsm: fsm}
+	s.replicas[id] = replica
+	if s.started {
+		s.serve(replica)
+	}
+	return nil
+}
+
+// replica returns the replica of the range, or nil if there is none on this server.
+func (s *Store) replica(id string) *replica {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.replicas[id]
+}
+
+// known reports whether the range is open on this server or was merged away.
+func (s *Store) known(id string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.replicas[id] != nil || s.removed[id]
+}
+
+// serve starts the raft server of a replica, it is called with the mutex held.
+func (s *Store) serve(replica *replica) {
+	s.routines.Add(1)
+	go func() {
+		defer s.routines.Done()
+		if err := replica.raft.Start(); err != nil {
+			s.logger.Error("Range stopped serving", zap.Error(err))
+		}
+	}()
+}
+
+// Start serves the RPCs of all the ranges and splits and merges the ranges this server leads. It blocks until the
+// store is shut down.
+func (s *Store) Start() error {
+	s.mutex.Lock()
+	if s.stopping {
+		s.mutex.Unlock()
+		return raft.ErrShutdown
+	}
+	s.started = true
+	for _, replica := range s.replicas {
+		s.serve(replica)
+	}
+	s.routines.Add(1)
+	go s.balance()
+	s.mutex.Unlock()
+
+	if err := s.transport.Listen(); err != nil {
+		return fmt.Errorf("unable to serve the raft rpcs: %w", err)
+	}
+	return nil
+}
+
+// Shutdown shuts the replicas of all the ranges down, see raft.Raft.Shutdown.
+func (s *Store) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.stopping {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.stopping = true
+	close(s.done)
+	replicas := make([]*replica, 0, len(s.replicas))
+	for _, replica := range s.replicas {
+		replicas = append(replicas, replica)
+	}
+	s.mutex.Unlock()
+
+	errs := make([]error, len(replicas))
+	var shutdowns sync.WaitGroup
+	for i, replica := range replicas {
+		shutdowns.Add(1)
+		go func() {
+			defer shutdowns.Done()
+			errs[i] = replica.raft.Shutdown(ctx)
+		}()
+	}
+	shutdowns.Wait()
+	errs = append(errs, s.transport.Close())
+
+	stopped := make(chan struct{})
+	go func() {
+		s.routines.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("the ranges did not stop in time: %w", ctx.Err()))
+	}
+	return errors.Join(errs...)
+}
+
+// Route returns the raft group of the local range that owns the key. The ranges might have changed by the time the
+// request is applied, the group then refuses it with ErrKeyOutOfRange.
+func (s *Store) Route(key types.Type) (*raft.Raft, error) {
+	replica := s.lookup(string(key.Bytes()))
+	if replica == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoRange, key)
+	}
+	return replica.raft, nil
+}
+
+// lookup returns the replica of the range that owns the key. While a split is applied the new range owns the keys of
+// both, the one that starts last is picked. While a merge is applied the sealed right range still claims the keys the
+// left one took over, a range that is not sealed is picked first.
+func (s *Store) lookup(key string) *replica {
+	var owner *replica
+	var start string
+	var sealed bool
+	for _, replica := range s.snapshot() {
+		bounds, ok := replica.fsm.Range()
+		if !ok || !bounds.Contains(key) {
+			continue
+		}
+		isSealed := replica.fsm.Sealed()
+		if owner == nil || (sealed && !isSealed) || (sealed == isSealed && bounds.Start > start) {
+			owner, start, sealed = replica, bounds.Start, isSealed
+		}
+	}
+	return owner
+}
+
+// Ranges returns the bounds of the local ranges ordered by their start.
+func (s *Store) Ranges() []Range {
+	var ranges []Range
+	for _, replica := range s.snapshot() {
+		if bounds, ok := replica.fsm.Range(); ok {
+			ranges = append(ranges, bounds)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	return ranges
+}
+
+// snapshot returns the current replicas. The state machines take the mutex when they apply a split or a merge, so it
+// is never held while calling them.
+func (s *Store) snapshot() []*replica {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	replicas := make([]*replica, 0, len(s.replicas))
+	for _, replica := range s.replicas {
+		replicas = append(replicas, replica)
+	}
+	return replicas
+}
+
+// split creates the range a split of one of the local ranges handed its keys over to. It is called when the split
+// is applied, also when the log is applied again after a restart, so a range that exists already or was merged away
+// is kept as it is. Only the range that was split creates it, its replicas are never opened twice.
+func (s *Store) split(bounds Range, state map[string]types.Type, members, learners []string) {
+	if s.known(bounds.Id) {
+		return
+	}
+	seed, err := seedEntries(bounds, state, members, learners)
+	if err == nil {
+		err = s.open(bounds.Id, &bounds, seed)
+	}
+	if err != nil {
+		// the other replicas keep the quorum of the new range
+		s.logger.Error("Failed to create the range of a split", zap.Stringer("range", bounds), zap.Error(err))
+		return
+	}
+	s.logger.Info("Range split off", zap.Stringer("range", bounds))
+}
+
+// merged removes the replica of a range that was merged into its left neighbor.
+func (s *Store) merged(right Range) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removed[right.Id] = true
+	replica, ok := s.replicas[right.Id]
+	if !ok {
+		return
+	}
+	delete(s.replicas, right.Id)
+	s.logger.Info("Range merged", zap.Stringer("range", right))
+	if s.stopping {
+		return
+	}
+
+	s.routines.Add(1)
+	go func() {
+		defer s.routines.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+		defer cancel()
+		if err := replica.raft.Shutdown(ctx); err != nil {
+			s.logger.Warn("Failed to shut a merged range down", zap.String("range", right.Id), zap.Error(err))
+		}
+		if err := s.drivers.remove(right.Id); err != nil {
+			s.logger.Warn("Failed to remove the storage of a merged range", zap.String("range", right.Id), zap.Error(err))
+		}
+	}()
+}
+
+// restored opens the ranges a restored snapshot of a local range split off, and removes the ones merged into it,
+// while this replica was behind. A range that is missing starts with its membership alone.
+func (s *Store) restored(l layout) {
+	for id := range l.Merged {
+		s.merged(Range{Id: id})
+	}
+	for id, c := range l.Splits {
+		if err := s.open(id, nil, []storage.LogEntry{membershipEntry(c.Members, c.Learners)}); err != nil {
+			s.logger.Error("Failed to open a range split off while this replica was behind", zap.String("range", id), zap.Error(err))
+		}
+	}
+}
+
+// drivers opens the storage of the ranges.
+type drivers interface {
+	// list returns the ids of the ranges that have a storage
+	list() ([]string, error)
+	open(id string) (storage.Driver, error)
+	// remove discards the storage of a range that was closed, and remembers that it was removed
+	remove(id string) error
+	// removed returns the ids of the ranges whose storage was removed
+	removed() ([]string, error)
+}
+
+func newDrivers(config *config.Configuration) (drivers, error) {
+	switch config.StorageDriver {
+	case "", "memory":
+		return memoryDrivers{}, nil
+	case "file":
+		return fileDrivers{dir: filepath.Join(config.DataDir, "ranges"), segmentSize: config.WalSegmentSize}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %v", config.StorageDriver)
+	}
+}
+
+// memoryDrivers keeps the ranges in memory, they are lost with the process.
+type memoryDrivers struct{}
+
+func (memoryDrivers) list() ([]string, error) {
+	return nil, nil
+}
+
+func (memoryDrivers) open(string) (storage.Driver, error) {
+	return storage.NewInMemoryDriver(), nil
+}
+
+func (memoryDrivers) remove(string) error {
+	return nil
+}
+
+func (memoryDrivers) removed() ([]string, error) {
+	return nil, nil
+}
+
+// fileDrivers keeps every range in a directory of its own under data_dir/ranges. A range that was removed leaves an
+// empty file named after it with the removedSuffix.
+type fileDrivers struct {
+	dir         string
+	segmentSize uint
+}
+
+func (d fileDrivers) list() ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to list the ranges in %s: %w", d.dir, err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (d fileDrivers) open(id string) (storage.Driver, error) {
+	dir := filepath.Join(d.dir, id)
+	driver, err := storage.NewFileDriver(dir, d.segmentSize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open storage in %s: %w", dir, err)
+	}
+	return driver, nil
+}
+
+func (d fileDrivers) remove(id string) error {
+	if err := os.WriteFile(filepath.Join(d.dir, id+removedSuffix), nil, 0644); err != nil {
+		return fmt.Errorf("unable to mark range %v as removed: %w", id, err)
+	}
+	return os.RemoveAll(filepath.Join(d.dir, id))
+}
+
+func (d fileDrivers) removed() ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to list the ranges in %s: %w", d.dir, err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), removedSuffix); ok && !entry.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,289 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/config"
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"github.com/MohammedShetaya/kayakdb/utils"
+	"go.uber.org/zap"
+)
+
+// startStores starts a cluster of stores on an in-memory network. A range holding more than 400 bytes is split, and two
+// neighbors holding less than 100 bytes each are merged.
+func startStores(t *testing.T, size int) []*Store {
+	types.RegisterDataTypes()
+	network := raft.NewInMemoryNetwork()
+
+	var addrs []string
+	for i := 0; i < size; i++ {
+		addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", 9001+i))
+	}
+	var stores []*Store
+	for i, addr := range addrs {
+		cfg := storeConfig(t, 9001+i)
+		for _, peer := range addrs {
+			if peer != addr {
+				cfg.SeedPeers = append(cfg.SeedPeers, peer)
+			}
+		}
+		stores = append(stores, startStore(t, network, cfg))
+	}
+	return stores
+}
+
+func storeConfig(t *testing.T, port int) *config.Configuration {
+	result, err := utils.LoadConfigurations(&config.Configuration{})
+	if err != nil {
+		t.Fatalf("Failed to load configurations: %v", err)
+	}
+	cfg := result.(*config.Configuration)
+	cfg.RaftPort = fmt.Sprint(port)
+	cfg.Sharding = true
+	cfg.RangeSplitBytes = 400
+	cfg.RangeMergeBytes = 100
+	cfg.RangeCheckInterval = 20
+	return cfg
+}
+
+// startStore starts a store on the network, it is shut down at the end of the test.
+func startStore(t *testing.T, network *raft.InMemoryNetwork, cfg *config.Configuration) *Store {
+	addr := "127.0.0.1:" + cfg.RaftPort
+	store, err := NewStore(cfg, zap.NewNop(), StoreOptions{Transport: network.Transport(addr)})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	go store.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := store.Shutdown(ctx); err != nil {
+			t.Errorf("Failed to shut down %v: %v", addr, err)
+		}
+	})
+	return store
+}
+
+// putKeys writes 40 keys with values of 20 bytes, they do not fit in one range.
+func putKeys(t *testing.T, stores []*Store) ([]types.Type, types.Type) {
+	var keys []types.Type
+	for i := 0; i < 40; i++ {
+		keys = append(keys, types.String(fmt.Sprintf("key-%02d", i)))
+	}
+	value := types.String(strings.Repeat("v", 20))
+	for _, key := range keys {
+		eventually(t, stores, key, func(ctx context.Context, r *raft.Raft) error {
+			return r.Put(ctx, []types.Type{types.KeyValue{Key: key, Value: value}})
+		})
+	}
+	return keys, value
+}
+
+// readKeys reads the keys through the leaders of their ranges and checks their values.
+func readKeys(t *testing.T, stores []*Store, keys []types.Type, value types.Type) {
+	for _, key := range keys {
+		eventually(t, stores, key, func(ctx context.Context, r *raft.Raft) error {
+			read, err := r.Get(ctx, key, raft.ReadLinearizable)
+			if err == nil && fmt.Sprint(read) != fmt.Sprint(value) {
+				t.Fatalf("Expected to read %v of %v, got %v", value, key, read)
+			}
+			return err
+		})
+	}
+}
+
+// eventually calls f on the leader of the range that owns the key until it succeeds, the leaders move and the ranges
+// change meanwhile.
+func eventually(t *testing.T, stores []*Store, key types.Type, f func(ctx context.Context, r *raft.Raft) error) {
+	t.Helper()
+	var err error
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, store := range stores {
+			var r *raft.Raft
+			if r, err = store.Route(key); err != nil || !r.State.IsLeader() {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			err = f(ctx, r)
+			cancel()
+			if err == nil {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("No leader of the range of %v served the request: %v", key, err)
+}
+
+// waitForRanges waits until every store holds a replica of each range and the ranges cover the keyspace. It returns
+// the ranges.
+func waitForRanges(t *testing.T, stores []*Store, done func(ranges []Range) bool) []Range {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		ranges := stores[0].Ranges()
+		same := covers(ranges)
+		for _, store := range stores[1:] {
+			same = same && fmt.Sprint(store.Ranges()) == fmt.Sprint(ranges)
+		}
+		if same && done(ranges) {
+			return ranges
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, store := range stores {
+		t.Logf("Ranges: %v", store.Ranges())
+	}
+	t.Fatalf("The ranges did not settle")
+	return nil
+}
+
+// balanced reports whether none of the ranges of the store is large enough to be split. A range split off is seeded
+// through its log, its size is only known once its replica applied what its leader committed.
+func balanced(store *Store) bool {
+	for _, replica := range store.snapshot() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := replica.raft.ReadBarrier(ctx, raft.ReadLinearizable)
+		cancel()
+		if err != nil || replica.fsm.Size() > store.config.RangeSplitBytes {
+			return false
+		}
+	}
+	return true
+}
+
+// covers reports whether the ranges, ordered by their start, cover the whole keyspace without overlapping.
+func covers(ranges []Range) bool {
+	end := ""
+	for i, r := range ranges {
+		if r.Start != end || (r.End == "") != (i == len(ranges)-1) {
+			return false
+		}
+		end = r.End
+	}
+	return len(ranges) > 0
+}
+
+func TestStoreSplitsAndMerges(t *testing.T) {
+	stores := startStores(t, 3)
+	keys, value := putKeys(t, stores)
+
+	// 40 pairs of 26 bytes are split until no range holds more than 400 bytes
+	ranges := waitForRanges(t, stores, func(ranges []Range) bool {
+		return len(ranges) >= 3
+	})
+	t.Logf("Ranges after the writes: %v", ranges)
+	readKeys(t, stores, keys, value)
+
+	for _, key := range keys {
+		eventually(t, stores, key, func(ctx context.Context, r *raft.Raft) error {
+			return r.Delete(ctx, []types.Type{key})
+		})
+	}
+	// the empty ranges are merged back into one
+	waitForRanges(t, stores, func(ranges []Range) bool {
+		return len(ranges) == 1
+	})
+	readKeys(t, stores, keys[:5], nil)
+}
+
+func TestStoreRestartsItsRanges(t *testing.T) {
+	types.RegisterDataTypes()
+	network := raft.NewInMemoryNetwork()
+	cfg := storeConfig(t, 9001)
+	cfg.StorageDriver = "file"
+	cfg.DataDir = t.TempDir()
+
+	stores := []*Store{startStore(t, network, cfg)}
+	keys, value := putKeys(t, stores)
+	// the restarted store would go on splitting the ranges that are still too large, or split while they were checked
+	ranges := waitForRanges(t, stores, func(ranges []Range) bool {
+		return len(ranges) >= 3 && balanced(stores[0]) && fmt.Sprint(stores[0].Ranges()) == fmt.Sprint(ranges)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := stores[0].Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down the store: %v", err)
+	}
+
+	// the logs of the ranges are applied again once their leaders committed an entry
+	restarted := startStore(t, network, cfg)
+	waitForRanges(t, []*Store{restarted}, func(got []Range) bool {
+		return fmt.Sprint(got) == fmt.Sprint(ranges)
+	})
+	readKeys(t, []*Store{restarted}, keys, value)
+}
+
+func TestStoreLookup(t *testing.T) {
+	types.RegisterDataTypes()
+	sealed := newRangeFSM(&Range{Id: "sealed", Start: key("c"), End: key("e")}, &recorder{})
+	if err := sealed.Apply(rangeCommand(t, command{Seal: &sealCommand{Id: "sealed"}})); err != nil {
+		t.Fatalf("Failed to seal the range: %v", err)
+	}
+	// the first range merged the sealed one and was split at e since, the replicas of the others are not removed yet
+	s := &Store{replicas: map[string]*replica{
+		"first":  {fsm: newRangeFSM(&Range{Id: "first"}, &recorder{})},
+		"sealed": {fsm: sealed},
+		"split":  {fsm: newRangeFSM(&Range{Id: "split", Start: key("e")}, &recorder{})},
+	}}
+
+	for k, expected := range map[string]string{"a": "first", "d": "first", "f": "split"} {
+		owner := s.lookup(key(k))
+		if bounds, _ := owner.fsm.Range(); bounds.Id != expected {
+			t.Errorf("Expected %v to own %v, got %v", expected, k, bounds)
+		}
+	}
+}
+
+func TestStoreReconcilesTheLayoutOfASnapshot(t *testing.T) {
+	types.RegisterDataTypes()
+	network := raft.NewInMemoryNetwork()
+	cfg := storeConfig(t, 9001)
+	cfg.StorageDriver = "file"
+	cfg.DataDir = t.TempDir()
+	open := func() *Store {
+		store, err := NewStore(cfg, zap.NewNop(), StoreOptions{Transport: network.Transport("127.0.0.1:9001")})
+		if err != nil {
+			t.Fatalf("Failed to create store: %v", err)
+		}
+		return store
+	}
+	shutdown := func(store *Store) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := store.Shutdown(ctx); err != nil {
+			t.Fatalf("Failed to shut down the store: %v", err)
+		}
+	}
+
+	store := open()
+	var l layout
+	l.split(splitCommand{Id: "missed", Members: []string{"127.0.0.1:9001"}})
+	store.restored(l)
+	if store.replica("missed") == nil {
+		t.Fatalf("Expected the range split off while the replica was behind to be opened")
+	}
+
+	// a snapshot taken before the range was merged away does not open it again
+	merged := l.copy()
+	merged.merge("missed", layout{})
+	store.restored(merged)
+	store.restored(l)
+	if store.replica("missed") != nil {
+		t.Errorf("Expected the range merged away to be removed")
+	}
+	shutdown(store)
+
+	restarted := open()
+	defer shutdown(restarted)
+	restarted.restored(l)
+	if restarted.replica("missed") != nil {
+		t.Errorf("Expected the range merged away not to be opened after a restart")
+	}
+}
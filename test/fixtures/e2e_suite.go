@@ -1,6 +1,7 @@
 package fixtures
 
 import (
+	"context"
 	"github.com/MohammedShetaya/kayakdb/api"
 	"github.com/MohammedShetaya/kayakdb/config"
 	. "github.com/MohammedShetaya/kayakdb/test/fixtures/test_data"
@@ -23,16 +24,20 @@ func (s *E2ESuite) SetupSuite() {
 		_ = logger.Sync()
 	}()
 	// Start the server in a separate goroutine
-	go func() {
-		cfg := &config.Configuration{KayakPort: KayakdbPort}
-		s.Common.server = api.NewServer(cfg, logger)
-		s.Common.server.Start()
-	}()
+	cfg := &config.Configuration{KayakPort: KayakdbPort}
+	s.Common.server = api.NewServer(cfg, logger)
+	go s.Common.server.Start()
 
 	// wait for the server to start
 	// TODO: replace this with a better way to wait for the server after implementing responses from the server
-	for s.Common.server == nil {
-		time.Sleep(time.Second)
+	time.Sleep(time.Second)
+}
+
+func (s *E2ESuite) TearDownSuite() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Common.server.Shutdown(ctx); err != nil {
+		s.T().Errorf("Failed to shut down the server: %v", err)
 	}
 }
 
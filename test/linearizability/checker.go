@@ -0,0 +1,249 @@
+package linearizability
+
+import (
+	"sort"
+	"time"
+)
+
+// Result is the outcome of checking a history.
+type Result struct {
+	Linearizable bool
+	// set when the check ran out of time before it could tell whether the history is linearizable, Linearizable is
+	// false then and there is no counterexample
+	TimedOut bool
+	// a non-linearizable sub-history from which no operation can be removed without making it linearizable, set when
+	// the history is not linearizable. It might not be minimal if the check ran out of time while minimizing it.
+	Counterexample History
+}
+
+// Check reports whether the history is linearizable with respect to the model, however long it takes.
+func Check(model Model, history History) Result {
+	return CheckTimeout(model, history, 0)
+}
+
+// CheckTimeout reports whether the history is linearizable with respect to the model, it gives up once timeout has
+// elapsed unless timeout is 0. Every partition of the history is checked separately with the algorithm of Wing and
+// Gong improved by Lowe, the one Porcupine implements: operations are linearized one by one in an order their
+// invocation and completion times allow, backtracking when the model rejects one, and configurations that were
+// already explored are cached. The search may take exponential time, the puts whose outcome is unknown can be
+// linearized at any time after their invocation and widen it the most.
+func CheckTimeout(model Model, history History, timeout time.Duration) Result {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	partitions := []History{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+	for _, partition := range partitions {
+		ok, decided := linearizable(model, partition, deadline)
+		if !decided {
+			return Result{TimedOut: true}
+		}
+		if !ok {
+			return Result{Counterexample: minimize(model, partition, deadline)}
+		}
+	}
+	return Result{Linearizable: true}
+}
+
+// minimize removes operations from a non-linearizable history as long as the rest is still not linearizable. It
+// first removes large chunks and then narrows them down to single operations. Removing an operation may allow
+// removing one that was kept before, the single operations are tried again until none of them can be removed.
+func minimize(model Model, history History, deadline time.Time) History {
+	for size := len(history) / 2; size >= 1; {
+		removed := false
+		for start := 0; start < len(history); {
+			end := min(start+size, len(history))
+			rest := append(append(History(nil), history[:start]...), history[end:]...)
+			// an operation whose removal could not be checked in time is kept
+			if ok, decided := linearizable(model, rest, deadline); len(rest) > 0 && decided && !ok {
+				history = rest
+				removed = true
+				continue
+			}
+			start = end
+		}
+		if size > 1 {
+			size /= 2
+		} else if !removed {
+			break
+		}
+	}
+	return history
+}
+
+// event is the invocation or the completion of an operation in the doubly linked list the algorithm walks through.
+type event struct {
+	op   int
+	call bool
+	time int64
+	// the completion of the operation, set on invocations
+	match      *event
+	prev, next *event
+}
+
+// deadlineCheckInterval is the number of steps of the search between two checks of its deadline
+const deadlineCheckInterval = 1024
+
+// linearizable reports whether the history is linearizable, decided is false if the deadline passed before the
+// search ended. A zero deadline never passes.
+func linearizable(model Model, history History, deadline time.Time) (ok bool, decided bool) {
+	head := buildEvents(history)
+
+	type frame struct {
+		call  *event
+		state any
+	}
+	var stack []frame
+	linearized := newBitset(len(history))
+	seen := make(cache)
+	state := model.Init()
+
+	e := head.next
+	for steps := 1; head.next != nil; steps++ {
+		if steps%deadlineCheckInterval == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			return false, false
+		}
+		if e.call {
+			ok, next := model.Step(state, history[e.op])
+			if ok {
+				candidate := linearized.clone().set(e.op)
+				if !seen.contains(model, candidate, next) {
+					seen.add(candidate, next)
+					stack = append(stack, frame{call: e, state: state})
+					state = next
+					linearized = candidate
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+			continue
+		}
+
+		// the earliest completion was reached without linearizing its operation, backtrack
+		if len(stack) == 0 {
+			return false, true
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.call.op)
+		unlift(top.call)
+		e = top.call.next
+	}
+	return true, true
+}
+
+// buildEvents returns the head of the list of the invocations and completions ordered by time. An invocation is
+// ordered before a completion of the same time, which treats the two operations as concurrent.
+func buildEvents(history History) *event {
+	events := make([]*event, 0, 2*len(history))
+	for i, op := range history {
+		complete := &event{op: i, time: int64(op.Complete)}
+		events = append(events, &event{op: i, call: true, time: int64(op.Invoke), match: complete}, complete)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &event{}
+	prev := head
+	for _, e := range events {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+	return head
+}
+
+// lift removes the invocation and the completion of an operation from the list.
+func lift(call *event) {
+	call.prev.next = call.next
+	if call.next != nil {
+		call.next.prev = call.prev
+	}
+	complete := call.match
+	complete.prev.next = complete.next
+	if complete.next != nil {
+		complete.next.prev = complete.prev
+	}
+}
+
+// unlift puts back an operation removed by lift, in the reverse order.
+func unlift(call *event) {
+	complete := call.match
+	complete.prev.next = complete
+	if complete.next != nil {
+		complete.next.prev = complete
+	}
+	call.prev.next = call
+	if call.next != nil {
+		call.next.prev = call
+	}
+}
+
+type cached struct {
+	linearized bitset
+	state      any
+}
+
+type cache map[uint64][]cached
+
+func (c cache) contains(model Model, linearized bitset, state any) bool {
+	for _, entry := range c[linearized.hash()] {
+		if entry.linearized.equals(linearized) && model.Equal(entry.state, state) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c cache) add(linearized bitset, state any) {
+	hash := linearized.hash()
+	c[hash] = append(c[hash], cached{linearized: linearized.clone(), state: state})
+}
+
+// bitset is the set of the operations that are linearized.
+type bitset []uint64
+
+func newBitset(size int) bitset {
+	return make(bitset, (size+63)/64)
+}
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << (i % 64)
+	return b
+}
+
+func (b bitset) clear(i int) {
+	b[i/64] &^= 1 << (i % 64)
+}
+
+func (b bitset) equals(other bitset) bool {
+	for i := range b {
+		if b[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	var hash uint64 = 14695981039346656037
+	for _, word := range b {
+		hash ^= word
+		hash *= 1099511628211
+	}
+	return hash
+}
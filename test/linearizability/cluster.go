@@ -0,0 +1,138 @@
+package linearizability
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/api"
+	"github.com/MohammedShetaya/kayakdb/config"
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"github.com/MohammedShetaya/kayakdb/utils"
+	"go.uber.org/zap"
+)
+
+// Cluster is a cluster of API servers on local ports whose raft servers talk over an in-memory network.
+type Cluster struct {
+	t        *testing.T
+	servers  []*raft.Raft
+	apiPorts []string
+}
+
+// NewCluster starts a cluster of size servers and waits until one of them is elected leader.
+func NewCluster(t *testing.T, size int) *Cluster {
+	types.RegisterDataTypes()
+	network := raft.NewInMemoryNetwork()
+
+	c := &Cluster{t: t}
+	var raftAddrs []string
+	for i := 0; i < size; i++ {
+		c.apiPorts = append(c.apiPorts, freePort(t))
+		raftAddrs = append(raftAddrs, "127.0.0.1:"+freePort(t))
+	}
+
+	for i := 0; i < size; i++ {
+		result, err := utils.LoadConfigurations(&config.Configuration{})
+		if err != nil {
+			t.Fatalf("Failed to load configurations: %v", err)
+		}
+		cfg := result.(*config.Configuration)
+		cfg.KayakPort = c.apiPorts[i]
+		cfg.RaftPort = raftAddrs[i][strings.LastIndex(raftAddrs[i], ":")+1:]
+		for j, addr := range raftAddrs {
+			if j != i {
+				cfg.SeedPeers = append(cfg.SeedPeers, addr)
+			}
+		}
+
+		server, err := raft.NewRaftWithOptions(cfg, zap.NewNop(), raft.Options{Transport: network.Transport(raftAddrs[i])})
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		c.servers = append(c.servers, server)
+		apiServer := api.NewServerWithRaft(cfg, zap.NewNop(), server)
+		go apiServer.Start()
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = apiServer.Shutdown(ctx)
+		})
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !c.hasLeader() {
+		if time.Now().After(deadline) {
+			t.Fatalf("No leader was elected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c
+}
+
+func (c *Cluster) hasLeader() bool {
+	for _, server := range c.servers {
+		if isLeader, _ := server.State.Leadership(); isLeader {
+			return true
+		}
+	}
+	return false
+}
+
+// Client returns a client that sends its requests to the server at index and records them.
+func (c *Cluster) Client(id int, index int, recorder *Recorder) *Client {
+	return &Client{
+		id:       id,
+		client:   api.NewClient("127.0.0.1", c.apiPorts[index], zap.NewNop()),
+		recorder: recorder,
+	}
+}
+
+// Client is an api.Client that records the operations it sends.
+type Client struct {
+	id       int
+	client   *api.Client
+	recorder *Recorder
+}
+
+func (c *Client) Put(key string, value string) {
+	id := c.recorder.Invoke(c.id, OpPut, key, value)
+	_, err := c.client.SendRequest(types.Payload{
+		Headers: types.Headers{Path: "/put"},
+		Data:    []types.Type{types.KeyValue{Key: types.String(key), Value: types.String(value)}},
+	})
+	if err != nil {
+		c.recorder.Fail(id)
+		return
+	}
+	c.recorder.Ok(id, "")
+}
+
+func (c *Client) Get(key string) {
+	id := c.recorder.Invoke(c.id, OpGet, key, "")
+	resp, err := c.client.SendRequest(types.Payload{
+		Headers: types.Headers{Path: "/get", Consistency: "linearizable"},
+		Data:    []types.Type{types.String(key)},
+	})
+	switch {
+	case err == nil && len(resp.Data) == 1:
+		c.recorder.Ok(id, resp.Data[0].(types.KeyValue).Value.String())
+	case resp != nil && strings.HasPrefix(resp.Headers.Error.String(), "key not found"):
+		c.recorder.NotFound(id)
+	default:
+		c.recorder.Fail(id)
+	}
+}
+
+// freePort returns a local port that nothing listens on.
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
@@ -0,0 +1,142 @@
+package linearizability
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpKind is the kind of a key-value operation.
+type OpKind uint8
+
+const (
+	OpGet OpKind = iota
+	OpPut
+)
+
+// Unknown is the completion time of an operation whose outcome the client never learned, for example a put that
+// timed out. It might take effect at any time after it was invoked.
+const Unknown = time.Duration(math.MaxInt64)
+
+// Operation is one call of a client, with the times it was invoked and completed relative to the start of the
+// history.
+type Operation struct {
+	ClientId int
+	Kind     OpKind
+	Key      string
+	// the value written by a put
+	Value string
+	// the value returned by a get, Found is false if the key did not exist
+	Output string
+	Found  bool
+
+	Invoke   time.Duration
+	Complete time.Duration
+
+	// set on failed gets, they are left out of the history
+	discarded bool
+}
+
+func (o Operation) String() string {
+	complete := "?"
+	if o.Complete != Unknown {
+		complete = o.Complete.String()
+	}
+	switch o.Kind {
+	case OpPut:
+		return fmt.Sprintf("client %d: put(%v, %v) [%v, %v]", o.ClientId, o.Key, o.Value, o.Invoke, complete)
+	default:
+		output := "<not found>"
+		if o.Found {
+			output = o.Output
+		}
+		return fmt.Sprintf("client %d: get(%v) -> %v [%v, %v]", o.ClientId, o.Key, output, o.Invoke, complete)
+	}
+}
+
+// History is a list of operations, it is printed ordered by invocation time.
+type History []Operation
+
+func (h History) String() string {
+	sorted := append(History(nil), h...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Invoke < sorted[j].Invoke
+	})
+	var b strings.Builder
+	for _, op := range sorted {
+		b.WriteString(op.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Recorder records the operations of concurrent clients. An operation is recorded with Invoke right before the
+// request is sent and finished with one of Ok, NotFound or Fail once the answer arrived.
+type Recorder struct {
+	mutex      sync.Mutex
+	start      time.Time
+	operations []Operation
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// Invoke records the invocation of an operation and returns its id.
+func (r *Recorder) Invoke(clientId int, kind OpKind, key string, value string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.operations = append(r.operations, Operation{
+		ClientId: clientId,
+		Kind:     kind,
+		Key:      key,
+		Value:    value,
+		Invoke:   time.Since(r.start),
+		Complete: Unknown,
+	})
+	return len(r.operations) - 1
+}
+
+// Ok records that the operation succeeded, output is the value returned by a get.
+func (r *Recorder) Ok(id int, output string) {
+	r.complete(id, output, true)
+}
+
+// NotFound records that a get did not find its key.
+func (r *Recorder) NotFound(id int) {
+	r.complete(id, "", false)
+}
+
+// Fail records that the outcome of the operation is unknown. A failed get did not change anything and is left out of
+// the history, a failed put might still take effect.
+func (r *Recorder) Fail(id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.operations[id].discarded = r.operations[id].Kind == OpGet
+}
+
+func (r *Recorder) complete(id int, output string, found bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	op := &r.operations[id]
+	op.Output = output
+	op.Found = found
+	op.Complete = time.Since(r.start)
+}
+
+// History returns the recorded operations. Operations that did not complete yet have an unknown outcome.
+func (r *Recorder) History() History {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var history History
+	for _, op := range r.operations {
+		if op.discarded || (op.Kind == OpGet && op.Complete == Unknown) {
+			continue
+		}
+		history = append(history, op)
+	}
+	return history
+}
@@ -0,0 +1,131 @@
+package linearizability
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func put(client int, key string, value string, invoke, complete time.Duration) Operation {
+	return Operation{ClientId: client, Kind: OpPut, Key: key, Value: value, Invoke: invoke, Complete: complete}
+}
+
+func get(client int, key string, output string, invoke, complete time.Duration) Operation {
+	return Operation{ClientId: client, Kind: OpGet, Key: key, Output: output, Found: output != "", Invoke: invoke, Complete: complete}
+}
+
+func TestCheck(t *testing.T) {
+	t.Run("concurrent operations may take effect in any order", func(t *testing.T) {
+		history := History{
+			put(0, "x", "1", 0, 10),
+			put(1, "x", "2", 5, 15),
+			get(2, "x", "1", 12, 20),
+			get(3, "x", "1", 21, 22),
+			get(4, "y", "", 0, 30),
+		}
+		if result := Check(KVModel, history); !result.Linearizable {
+			t.Errorf("Expected the history to be linearizable, got the counterexample:\n%v", result.Counterexample)
+		}
+	})
+
+	t.Run("a put with an unknown outcome may take effect later", func(t *testing.T) {
+		history := History{
+			put(0, "x", "1", 0, Unknown),
+			get(1, "x", "", 1, 2),
+			get(1, "x", "1", 100, 101),
+		}
+		if result := Check(KVModel, history); !result.Linearizable {
+			t.Errorf("Expected the history to be linearizable, got the counterexample:\n%v", result.Counterexample)
+		}
+	})
+
+	t.Run("a stale read is reported with a minimal counterexample", func(t *testing.T) {
+		history := History{
+			get(0, "x", "", 0, 5),
+			put(1, "y", "1", 0, 10),
+			put(0, "x", "1", 10, 20),
+			get(2, "y", "1", 12, 25),
+			get(2, "x", "", 31, 35),
+		}
+		result := Check(KVModel, history)
+		if result.Linearizable {
+			t.Fatalf("Expected the stale read not to be linearizable")
+		}
+		expected := History{history[2], history[4]}
+		if fmt.Sprint(result.Counterexample) != fmt.Sprint(expected) {
+			t.Errorf("Expected the counterexample:\n%vgot:\n%v", expected, result.Counterexample)
+		}
+	})
+
+	t.Run("a check that runs out of time reports an unknown result", func(t *testing.T) {
+		// the concurrent puts may take effect in any order, the search tries all of them before it finds that no
+		// put wrote the value the get read
+		var history History
+		for client := 0; client < 20; client++ {
+			history = append(history, put(client, "x", fmt.Sprint(client), 0, 10))
+		}
+		history = append(history, get(20, "x", "never written", 20, 30))
+
+		result := CheckTimeout(KVModel, history, time.Nanosecond)
+		if !result.TimedOut || result.Linearizable || result.Counterexample != nil {
+			t.Errorf("Expected the check to time out without a result, got %+v", result)
+		}
+	})
+}
+
+// checkTimeout bounds the check of the history recorded on the cluster, it is slower with -race
+const checkTimeout = 30 * time.Second
+
+func TestClusterHistoryIsLinearizable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("cluster tests are skipped in short mode")
+	}
+
+	cluster := NewCluster(t, 3)
+	recorder := NewRecorder()
+	// enough keys and few enough operations that the partition of every key is checked quickly
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+
+	var wg sync.WaitGroup
+	for id := 0; id < 6; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(id)))
+			client := cluster.Client(id, id%3, recorder)
+			for i := 0; i < 20; i++ {
+				key := keys[random.Intn(len(keys))]
+				if random.Intn(2) == 0 {
+					client.Put(key, fmt.Sprintf("%d-%d", id, i))
+				} else {
+					client.Get(key)
+				}
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	history := recorder.History()
+	t.Logf("%d operations, %d completed", len(history), completed(history))
+	result := CheckTimeout(KVModel, history, checkTimeout)
+	if result.TimedOut {
+		t.Skipf("Could not tell within %v whether the history of %d operations is linearizable", checkTimeout,
+			len(history))
+	}
+	if !result.Linearizable {
+		t.Fatalf("The history of %d operations is not linearizable, minimal non-linearizable sub-history:\n%v",
+			len(history), result.Counterexample)
+	}
+}
+
+func completed(history History) int {
+	count := 0
+	for _, op := range history {
+		if op.Complete != Unknown {
+			count++
+		}
+	}
+	return count
+}
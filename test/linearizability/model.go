@@ -0,0 +1,52 @@
+package linearizability
+
+// Model is the sequential specification the history is checked against.
+type Model struct {
+	// Partition splits the history in independent histories that are checked separately, nil checks it as a whole
+	Partition func(history History) []History
+	// Init returns the initial state
+	Init func() any
+	// Step applies the operation to the state. It returns false if the operation could not have returned its output
+	// in that state
+	Step func(state any, op Operation) (bool, any)
+	// Equal compares two states
+	Equal func(a any, b any) bool
+}
+
+// kvState is the value of a single key, the KV model checks every key separately.
+type kvState struct {
+	value string
+	found bool
+}
+
+// KVModel is a key-value store where a get returns the value of the latest put on its key.
+var KVModel = Model{
+	Partition: func(history History) []History {
+		var keys []string
+		byKey := make(map[string]History)
+		for _, op := range history {
+			if _, ok := byKey[op.Key]; !ok {
+				keys = append(keys, op.Key)
+			}
+			byKey[op.Key] = append(byKey[op.Key], op)
+		}
+		partitions := make([]History, 0, len(keys))
+		for _, key := range keys {
+			partitions = append(partitions, byKey[key])
+		}
+		return partitions
+	},
+	Init: func() any {
+		return kvState{}
+	},
+	Step: func(state any, op Operation) (bool, any) {
+		s := state.(kvState)
+		if op.Kind == OpPut {
+			return true, kvState{value: op.Value, found: true}
+		}
+		return op.Found == s.found && op.Output == s.value, s
+	},
+	Equal: func(a any, b any) bool {
+		return a.(kvState) == b.(kvState)
+	},
+}
@@ -0,0 +1,269 @@
+package simulation
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+)
+
+// logCheckInterval is how many steps pass between two checks of the logs, comparing the logs of all the servers is
+// the expensive part of a step
+const logCheckInterval = 10
+
+// Checker verifies the safety properties of section 5.2 to 5.4 of the Raft paper on a running cluster:
+//
+//   - election safety: at most one leader is elected in a term
+//   - log matching: two logs that have an entry with the same index and term are identical up to that index
+//   - leader completeness: a committed entry is in the log of the leaders of all the following terms
+//   - state machine safety: no two servers commit a different entry at the same index, and no two state machines
+//     hold a different state after applying the same index
+//   - witnesses: a witness never becomes the leader and never stores a command
+//
+// A witness holds the entries without their commands, its entries are compared to the others without them. The
+// entries a server compacted into its snapshot are no longer compared, the state of its state machine still is.
+//
+// The servers are observed while they run, so the checker only sees the states they pass through at the time of a
+// step. It reports the first violation with the seed of the cluster.
+type Checker struct {
+	cluster *Cluster
+	steps   int
+	// the server that was seen leading each term
+	leaders map[uint]string
+	// the entries seen committed, and the highest term known to any server when each was first seen
+	committed      map[uint]storage.LogEntry
+	committedTerms map[uint]uint
+	// the committed entries that were only seen in the log of a witness so far
+	committedByWitness map[uint]bool
+	// the highest index each server was seen committing, a restarted server starts over
+	checkedCommit map[*raft.Raft]uint
+	// the leaders whose log was checked for the committed entries
+	checkedLeaders map[*raft.Raft]uint
+	// the digest of the first state machine seen applying each index, and the server it belongs to
+	digests       map[uint]uint64
+	digestServers map[uint]string
+}
+
+func NewChecker(cluster *Cluster) *Checker {
+	return &Checker{
+		cluster:            cluster,
+		leaders:            make(map[uint]string),
+		committed:          make(map[uint]storage.LogEntry),
+		committedTerms:     make(map[uint]uint),
+		committedByWitness: make(map[uint]bool),
+		checkedCommit:      make(map[*raft.Raft]uint),
+		checkedLeaders:     make(map[*raft.Raft]uint),
+		digests:            make(map[uint]uint64),
+		digestServers:      make(map[uint]string),
+	}
+}
+
+// Check verifies the properties on the current state of the running servers.
+func (c *Checker) Check() {
+	servers := c.cluster.running()
+	c.checkElectionSafety(servers)
+
+	c.steps++
+	if c.steps%logCheckInterval != 0 {
+		return
+	}
+	logs := make(map[*raft.Raft]serverLog)
+	commitIndexes := make(map[*raft.Raft]uint)
+	for _, r := range servers {
+		// committed entries never change, the log read afterward has them
+		commitIndex := r.State.CommitIndex()
+		if log, ok := readLog(r); ok {
+			logs[r] = log
+			commitIndexes[r] = min(commitIndex, log.last())
+		}
+	}
+	c.checkWitnesses(logs)
+	c.checkLogMatching(logs)
+	c.checkStateMachineSafety(servers, logs, commitIndexes)
+	c.checkStateMachines(servers)
+	c.checkLeaderCompleteness(servers, logs)
+}
+
+func (c *Checker) checkElectionSafety(servers []*raft.Raft) {
+	for _, r := range servers {
+		isLeader, term := r.State.Leadership()
+		if !isLeader {
+			continue
+		}
+		if c.cluster.isWitness(r) {
+			c.fail("witnesses: the witness %v is the leader of term %d", c.cluster.name(r), term)
+		}
+		if leader, ok := c.leaders[term]; ok && leader != c.cluster.name(r) {
+			c.fail("election safety: servers %v and %v are both leaders of term %d", leader, c.cluster.name(r), term)
+		}
+		c.leaders[term] = c.cluster.name(r)
+	}
+}
+
+func (c *Checker) checkWitnesses(logs map[*raft.Raft]serverLog) {
+	for r, log := range logs {
+		if !c.cluster.isWitness(r) {
+			continue
+		}
+		for i, entry := range log.entries {
+			if entry.Type == storage.EntryCommand && entry.Data != nil {
+				c.fail("witnesses: the witness %v stores the command of the entry at index %d", c.cluster.name(r), log.first+uint(i))
+			}
+		}
+	}
+}
+
+func (c *Checker) checkLogMatching(logs map[*raft.Raft]serverLog) {
+	for a, logA := range logs {
+		for b, logB := range logs {
+			if a.State.ServerId >= b.State.ServerId {
+				continue
+			}
+			witness := c.cluster.isWitness(a) || c.cluster.isWitness(b)
+			// the highest index at which both logs have an entry of the same term, the entries before the first one
+			// both logs hold were compacted by one of them
+			first := max(logA.first, logB.first)
+			match := min(logA.last(), logB.last())
+			for match >= first && logA.entry(match).Term != logB.entry(match).Term {
+				match--
+			}
+			for idx := first; idx <= match; idx++ {
+				if !sameEntry(logA.entry(idx), logB.entry(idx), witness) {
+					c.fail("log matching: servers %v and %v have the same entry at index %d of term %d but differ at index %d: %+v and %+v",
+						c.cluster.name(a), c.cluster.name(b), match, logA.entry(match).Term, idx, logA.entry(idx), logB.entry(idx))
+				}
+			}
+		}
+	}
+}
+
+func (c *Checker) checkStateMachineSafety(servers []*raft.Raft, logs map[*raft.Raft]serverLog, commitIndexes map[*raft.Raft]uint) {
+	var highestTerm uint
+	for _, r := range servers {
+		highestTerm = max(highestTerm, r.State.Persistent.GetCurrentTerm())
+	}
+
+	for r, log := range logs {
+		commitIndex := commitIndexes[r]
+		witness := c.cluster.isWitness(r)
+		for idx := max(c.checkedCommit[r]+1, log.first); idx <= commitIndex; idx++ {
+			entry := log.entry(idx)
+			if committed, ok := c.committed[idx]; !ok {
+				c.committed[idx] = entry
+				c.committedTerms[idx] = highestTerm
+				c.committedByWitness[idx] = witness
+			} else if !sameEntry(committed, entry, witness || c.committedByWitness[idx]) {
+				c.fail("state machine safety: server %v committed %+v at index %d, another server committed %+v",
+					c.cluster.name(r), entry, idx, committed)
+			} else if c.committedByWitness[idx] && !witness {
+				// the entry with its command is compared to the logs of the other servers from now on
+				c.committed[idx] = entry
+				c.committedByWitness[idx] = false
+			}
+		}
+		c.checkedCommit[r] = max(c.checkedCommit[r], commitIndex)
+	}
+}
+
+// checkStateMachines compares the state of the state machines after each index they applied. Witnesses apply no
+// command, their state machines stay empty.
+func (c *Checker) checkStateMachines(servers []*raft.Raft) {
+	for _, r := range servers {
+		fsm := c.cluster.stateMachine(r)
+		if fsm == nil || c.cluster.isWitness(r) {
+			continue
+		}
+		for idx, digest := range fsm.applied() {
+			if first, ok := c.digests[idx]; !ok {
+				c.digests[idx] = digest
+				c.digestServers[idx] = c.cluster.name(r)
+			} else if first != digest {
+				c.fail("state machine safety: the state machine of %v differs from the one of %v after applying index %d",
+					c.cluster.name(r), c.digestServers[idx], idx)
+			}
+		}
+	}
+}
+
+func (c *Checker) checkLeaderCompleteness(servers []*raft.Raft, logs map[*raft.Raft]serverLog) {
+	for _, r := range servers {
+		isLeader, term := r.State.Leadership()
+		log, ok := logs[r]
+		if !isLeader || !ok || c.checkedLeaders[r] == term {
+			continue
+		}
+		c.checkedLeaders[r] = term
+		for idx, entry := range c.committed {
+			// the entries the leader compacted are in its snapshot
+			if c.committedTerms[idx] >= term || idx < log.first {
+				continue
+			}
+			if idx > log.last() || !sameEntry(log.entry(idx), entry, c.committedByWitness[idx]) {
+				c.fail("leader completeness: the leader %v of term %d does not have the entry %+v committed at index %d",
+					c.cluster.name(r), term, entry, idx)
+			}
+		}
+	}
+}
+
+// sameEntry reports whether two entries are the same, without their commands if one of them is held by a witness.
+func sameEntry(a, b storage.LogEntry, witness bool) bool {
+	if witness {
+		a.Data, b.Data = nil, nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (c *Checker) fail(format string, args ...any) {
+	c.cluster.t.Helper()
+	c.cluster.t.Fatalf("seed %d: %v", c.cluster.seed, fmt.Sprintf(format, args...))
+}
+
+// serverLog is a copy of the entries of a server that follow its snapshot.
+type serverLog struct {
+	// the index of the first entry
+	first   uint
+	entries []storage.LogEntry
+}
+
+// last returns the index of the last entry, first-1 if there is none.
+func (l serverLog) last() uint {
+	return l.first + uint(len(l.entries)) - 1
+}
+
+// entry returns the entry at idx, which must be between first and last.
+func (l serverLog) entry(idx uint) storage.LogEntry {
+	return l.entries[idx-l.first]
+}
+
+// readLog returns a consistent copy of the log of the server. The log is read twice and the read is given up if the
+// server compacted or changed the entries of the first read meanwhile, appending new ones is fine.
+func readLog(r *raft.Raft) (serverLog, bool) {
+	snapshot, err := r.State.Persistent.LoadSnapshot()
+	if err != nil {
+		return serverLog{}, false
+	}
+	log := serverLog{first: 1}
+	if snapshot != nil {
+		log.first = snapshot.LastIncludedIndex + 1
+	}
+	read := func() ([]storage.LogEntry, bool) {
+		var entries []storage.LogEntry
+		for idx := log.first; idx <= r.State.Persistent.LastIndex(); idx++ {
+			entry := r.State.Persistent.GetEntryOfIndex(idx)
+			if entry == nil {
+				return nil, false
+			}
+			entries = append(entries, *entry)
+		}
+		return entries, true
+	}
+	first, ok := read()
+	second, ok2 := read()
+	if !ok || !ok2 || len(second) < len(first) || !reflect.DeepEqual(first, second[:len(first)]) {
+		return serverLog{}, false
+	}
+	log.entries = first
+	return log, true
+}
@@ -0,0 +1,154 @@
+package simulation
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/raft"
+)
+
+// Clock is a raft.Clock whose time only moves when the simulation advances it.
+type Clock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers map[*timer]struct{}
+	// number of timers created so far, the timers that expire at the same time fire in the order they were created
+	created uint64
+	// timers fired by the last advance
+	fired []*timer
+}
+
+func NewClock() *Clock {
+	return &Clock{
+		now:    time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		timers: make(map[*timer]struct{}),
+	}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *Clock) NewTimer(d time.Duration) raft.Timer {
+	t := c.newTimer()
+	t.Reset(d)
+	return t
+}
+
+func (c *Clock) NewTicker(d time.Duration) raft.Ticker {
+	t := &ticker{timer: c.newTimer()}
+	t.Reset(d)
+	return t
+}
+
+func (c *Clock) newTimer() *timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.created++
+	return &timer{clock: c, c: make(chan time.Time, 1), seq: c.created}
+}
+
+// Advance moves the time forward and fires the timers that expired meanwhile, in the order of their deadlines.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	c.fired = c.fired[:0]
+	for t := range c.timers {
+		if !t.deadline.After(c.now) {
+			c.fired = append(c.fired, t)
+		}
+	}
+	sort.Slice(c.fired, func(i, j int) bool {
+		a, b := c.fired[i], c.fired[j]
+		if !a.deadline.Equal(b.deadline) {
+			return a.deadline.Before(b.deadline)
+		}
+		return a.seq < b.seq
+	})
+	for _, t := range c.fired {
+		if t.period > 0 {
+			// like a time.Ticker, the ticks that were missed meanwhile are dropped
+			for !t.deadline.After(c.now) {
+				t.deadline = t.deadline.Add(t.period)
+			}
+		} else {
+			delete(c.timers, t)
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+}
+
+// pending reports whether a timer fired by the last advance was not received yet.
+func (c *Clock) pending() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, t := range c.fired {
+		if len(t.c) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// timer behaves like a time.Timer of Go 1.23, a Reset or a Stop discards a value that was not received yet.
+type timer struct {
+	clock    *Clock
+	c        chan time.Time
+	deadline time.Time
+	// set for the timers of a ticker, which fire again every period
+	period time.Duration
+	seq    uint64
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	_, active := t.clock.timers[t]
+	t.drain()
+	t.deadline = t.clock.now.Add(d)
+	t.clock.timers[t] = struct{}{}
+	return active
+}
+
+func (t *timer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	t.drain()
+	return active
+}
+
+func (t *timer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
+
+// ticker behaves like a time.Ticker of Go 1.23, a Reset or a Stop discards a tick that was not received yet.
+type ticker struct {
+	*timer
+}
+
+func (t *ticker) Reset(d time.Duration) {
+	t.clock.mutex.Lock()
+	t.period = d
+	t.clock.mutex.Unlock()
+	t.timer.Reset(d)
+}
+
+func (t *ticker) Stop() {
+	t.timer.Stop()
+}
@@ -0,0 +1,374 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/config"
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+	"github.com/MohammedShetaya/kayakdb/types"
+	"github.com/MohammedShetaya/kayakdb/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// tick is how far the simulated time moves in one step
+	tick = time.Millisecond
+	// settleTimeout bounds the real time the servers get to receive the timers and the responses of one step
+	settleTimeout = 5 * time.Millisecond
+	// writeInterval is how often a write is proposed to the server that believes it is the leader
+	writeInterval = 20 * time.Millisecond
+	// snapshotThreshold is how many entries a server applies before it compacts its log
+	snapshotThreshold = 40
+)
+
+// Cluster runs the servers of a Raft cluster in one process, on a simulated network and a simulated clock. Every
+// random decision of the simulation and of the servers is derived from the seed. A run is not reproducible though:
+// the servers send their requests from goroutines scheduled by the Go runtime, and get a bounded amount of real time
+// to do so in every step, so the same seed may deliver different messages and find a different outcome.
+type Cluster struct {
+	t       *testing.T
+	seed    int64
+	random  *rand.Rand
+	clock   *Clock
+	network *Network
+	nodes   []*node
+	checker *Checker
+	// number of writes proposed so far, every write has a unique key
+	writes int
+}
+
+type node struct {
+	addr      string
+	raft      *raft.Raft
+	transport *Transport
+	fsm       *StateMachine
+	// the persistent state of the server as of its crash
+	disk storage.Driver
+	// incremented on every restart, together with the seed it derives the seed of the server
+	incarnation int64
+	crashed     bool
+	// a witness votes but is not sent the commands
+	witness bool
+	mutex   sync.Mutex
+}
+
+// NewCluster starts a cluster of size servers that all know each other as seed peers.
+func NewCluster(t *testing.T, size int, seed int64, faults Faults) *Cluster {
+	return NewClusterWithWitnesses(t, size, 0, seed, faults)
+}
+
+// NewClusterWithWitnesses starts a cluster of size servers of which the last witnesses ones are witnesses.
+func NewClusterWithWitnesses(t *testing.T, size int, witnesses int, seed int64, faults Faults) *Cluster {
+	types.RegisterDataTypes()
+
+	clock := NewClock()
+	c := &Cluster{
+		t:       t,
+		seed:    seed,
+		random:  rand.New(rand.NewSource(seed)),
+		clock:   clock,
+		network: NewNetwork(clock, seed, faults),
+	}
+	c.checker = NewChecker(c)
+
+	for i := 0; i < size; i++ {
+		c.nodes = append(c.nodes, &node{addr: fmt.Sprintf("node-%d:9090", i), witness: i >= size-witnesses})
+	}
+	for _, n := range c.nodes {
+		c.start(n, storage.NewInMemoryDriver())
+	}
+	return c
+}
+
+// start creates a server of the node on top of the driver and starts it.
+func (c *Cluster) start(n *node, driver storage.Driver) {
+	var peers, witnesses []string
+	for _, other := range c.nodes {
+		if other != n {
+			peers = append(peers, other.addr)
+		}
+		if other.witness {
+			witnesses = append(witnesses, other.addr)
+		}
+	}
+
+	result, err := utils.LoadConfigurations(&config.Configuration{})
+	if err != nil {
+		c.t.Fatalf("seed %d: failed to load configurations: %v", c.seed, err)
+	}
+	cfg := result.(*config.Configuration)
+	cfg.AdvertiseHost = n.addr[:len(n.addr)-len(":9090")]
+	cfg.SeedPeers = peers
+	cfg.Witnesses = witnesses
+	// the logs are compacted every few seconds of writes, the lagging servers catch up with a snapshot
+	cfg.SnapshotThreshold = snapshotThreshold
+
+	transport := c.network.Transport(n.addr)
+	fsm := NewStateMachine()
+	r, err := raft.NewRaftWithOptions(cfg, zap.NewNop(), raft.Options{
+		Transport: transport,
+		Driver:    driver,
+		FSM:       fsm,
+		Clock:     c.clock,
+		Seed:      c.seed*1000 + int64(c.index(n))*10 + n.incarnation + 1,
+	})
+	if err != nil {
+		c.t.Fatalf("seed %d: failed to create server %v: %v", c.seed, n.addr, err)
+	}
+	fsm.raft = r
+
+	n.mutex.Lock()
+	n.raft = r
+	n.transport = transport
+	n.fsm = fsm
+	n.crashed = false
+	n.disk = nil
+	n.mutex.Unlock()
+	go r.Start()
+}
+
+func (c *Cluster) index(n *node) int {
+	for i, other := range c.nodes {
+		if other == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// Run advances the simulation by d, delivering the messages that are due and proposing writes along the way. The
+// safety properties are checked after every step.
+func (c *Cluster) Run(d time.Duration) {
+	for elapsed := time.Duration(0); elapsed < d; elapsed += tick {
+		c.clock.Advance(tick)
+		c.network.Step()
+		if elapsed%writeInterval == 0 {
+			c.write()
+		}
+		c.settle()
+		c.checker.Check()
+	}
+}
+
+// settle waits until the servers received the timers that fired and the responses that were delivered in this step,
+// or until settleTimeout passed, and then yields to them. The servers react to them in goroutines of their own,
+// settling lets them catch up with the simulated time before it moves on.
+func (c *Cluster) settle() {
+	deadline := time.Now().Add(settleTimeout)
+	for (c.clock.pending() || c.network.pending()) && time.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+	runtime.Gosched()
+}
+
+// write proposes a new key to every running server that believes it is the leader. The proposals are not waited for,
+// the checker finds out which ones were committed.
+func (c *Cluster) write() {
+	for _, r := range c.running() {
+		if !r.State.IsLeader() {
+			continue
+		}
+		c.writes++
+		pair := types.KeyValue{
+			Key:   types.String(fmt.Sprintf("key-%d", c.writes)),
+			Value: types.String(fmt.Sprintf("value-%d", c.writes)),
+		}
+		data, _ := raft.EncodeKVCommand(raft.KVCommand{Op: raft.KVPut, Pairs: []types.KeyValue{pair}})
+		_, _ = r.Propose(raft.Command{Data: data})
+	}
+}
+
+// Partition splits the servers with the given indexes from the rest of the cluster.
+func (c *Cluster) Partition(indexes ...int) {
+	var group []string
+	for _, i := range indexes {
+		group = append(group, c.nodes[i].addr)
+	}
+	c.network.Partition(group)
+}
+
+// Heal reconnects all the servers.
+func (c *Cluster) Heal() {
+	c.network.Heal()
+}
+
+// Crash stops the server at index. It keeps a copy of the persistent state of the server, like a disk would, for
+// when it is restarted.
+//
+// The transport is closed before the server is shut down, and the shutdown is given a context that is already done,
+// so a crashed leader does not get to hand its leadership over.
+func (c *Cluster) Crash(i int) {
+	n := c.nodes[i]
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.crashed {
+		return
+	}
+	n.crashed = true
+	_ = n.transport.Close()
+	disk, err := cloneDriver(n.raft.State.Persistent)
+	if err != nil {
+		c.t.Fatalf("seed %d: failed to copy the storage of %v: %v", c.seed, n.addr, err)
+	}
+	n.disk = disk
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	go func(r *raft.Raft) {
+		_ = r.Shutdown(ctx)
+	}(n.raft)
+}
+
+// Restart starts the crashed server at index again from its persistent state.
+func (c *Cluster) Restart(i int) {
+	n := c.nodes[i]
+	n.mutex.Lock()
+	if !n.crashed {
+		n.mutex.Unlock()
+		return
+	}
+	driver := n.disk
+	n.incarnation++
+	n.mutex.Unlock()
+	c.start(n, driver)
+}
+
+// Nemesis injects a random fault every interval for the duration d: it partitions a minority or a majority of the
+// servers, crashes a server, restarts the crashed ones or heals the network.
+func (c *Cluster) Nemesis(d time.Duration, interval time.Duration) {
+	for elapsed := time.Duration(0); elapsed < d; elapsed += interval {
+		switch c.random.Intn(4) {
+		case 0:
+			size := 1 + c.random.Intn(len(c.nodes)-1)
+			c.Partition(c.random.Perm(len(c.nodes))[:size]...)
+		case 1:
+			c.Crash(c.random.Intn(len(c.nodes)))
+		case 2:
+			for i := range c.nodes {
+				c.Restart(i)
+			}
+		case 3:
+			c.Heal()
+		}
+		c.Run(interval)
+	}
+	c.Heal()
+	for i := range c.nodes {
+		c.Restart(i)
+	}
+}
+
+// running returns the servers that were not crashed.
+func (c *Cluster) running() []*raft.Raft {
+	var servers []*raft.Raft
+	for _, n := range c.nodes {
+		n.mutex.Lock()
+		if !n.crashed {
+			servers = append(servers, n.raft)
+		}
+		n.mutex.Unlock()
+	}
+	return servers
+}
+
+// name returns the address of the server followed by its incarnation.
+func (c *Cluster) name(r *raft.Raft) string {
+	for _, n := range c.nodes {
+		n.mutex.Lock()
+		current, incarnation := n.raft, n.incarnation
+		n.mutex.Unlock()
+		if current == r {
+			return fmt.Sprintf("%v#%d", n.addr, incarnation)
+		}
+	}
+	return r.State.ServerId
+}
+
+// stateMachine returns the state machine of the server.
+func (c *Cluster) stateMachine(r *raft.Raft) *StateMachine {
+	for _, n := range c.nodes {
+		n.mutex.Lock()
+		current, fsm := n.raft, n.fsm
+		n.mutex.Unlock()
+		if current == r {
+			return fsm
+		}
+	}
+	return nil
+}
+
+// isWitness reports whether the server is a witness.
+func (c *Cluster) isWitness(r *raft.Raft) bool {
+	for _, n := range c.nodes {
+		n.mutex.Lock()
+		current := n.raft
+		n.mutex.Unlock()
+		if current == r {
+			return n.witness
+		}
+	}
+	return false
+}
+
+// Leader returns the running server that believes it is the leader of the highest term, or nil if there is none.
+func (c *Cluster) Leader() *raft.Raft {
+	var leader *raft.Raft
+	var leaderTerm uint
+	for _, r := range c.running() {
+		if isLeader, term := r.State.Leadership(); isLeader && term > leaderTerm {
+			leader, leaderTerm = r, term
+		}
+	}
+	return leader
+}
+
+// Close crashes all the servers.
+func (c *Cluster) Close() {
+	for i := range c.nodes {
+		c.Crash(i)
+	}
+}
+
+// cloneDriver copies the persistent state of a server to a new in-memory driver.
+func cloneDriver(driver storage.Driver) (storage.Driver, error) {
+	clone := storage.NewInMemoryDriver()
+	if err := clone.SetCurrentTerm(driver.GetCurrentTerm()); err != nil {
+		return nil, err
+	}
+	if err := clone.SetVotedFor(driver.GetVotedFor()); err != nil {
+		return nil, err
+	}
+	if err := clone.SetIdentity(driver.GetIdentity()); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := driver.LoadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	var first uint = 1
+	if snapshot != nil {
+		if err = clone.SaveSnapshot(snapshot); err != nil {
+			return nil, err
+		}
+		first = snapshot.LastIncludedIndex + 1
+	}
+
+	var entries []storage.LogEntry
+	for idx := first; idx <= driver.LastIndex(); idx++ {
+		if entry := driver.GetEntryOfIndex(idx); entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	if err = clone.AppendMany(first, entries); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
@@ -0,0 +1,83 @@
+package simulation
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/raft/storage"
+)
+
+// StateMachine is the state machine of a simulated server: a raft.KVStore that also keeps a digest of the commands it
+// applied, each one chained to the digest before it. Two servers that applied the same commands up to an index have
+// the same digest there, whether they applied them one by one or restored some of them from a snapshot.
+type StateMachine struct {
+	*raft.KVStore
+	mutex sync.Mutex
+	// the server the state machine belongs to, it is set before the server starts applying entries
+	raft   *raft.Raft
+	digest uint64
+	// the digest after each index applied since the checker last read them
+	digests map[uint]uint64
+}
+
+// stateMachineSnapshot is the serialized state of a StateMachine.
+type stateMachineSnapshot struct {
+	Digest uint64
+	Store  []byte
+}
+
+func NewStateMachine() *StateMachine {
+	return &StateMachine{KVStore: raft.NewKVStore(), digests: make(map[uint]uint64)}
+}
+
+func (m *StateMachine) Apply(entry storage.LogEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%d:", m.digest)
+	_, _ = h.Write(entry.Data)
+	m.digest = h.Sum64()
+	// the entries are applied in order, the last applied one is the one before
+	m.digests[m.raft.State.LastApplied()+1] = m.digest
+	return m.KVStore.Apply(entry)
+}
+
+func (m *StateMachine) Snapshot() ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	store, err := m.KVStore.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err = gob.NewEncoder(&buffer).Encode(stateMachineSnapshot{Digest: m.digest, Store: store}); err != nil {
+		return nil, fmt.Errorf("unable to encode state machine: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func (m *StateMachine) Restore(data []byte) error {
+	var snapshot stateMachineSnapshot
+	if len(data) > 0 {
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+			return fmt.Errorf("unable to decode state machine: %w", err)
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.digest = snapshot.Digest
+	return m.KVStore.Restore(snapshot.Store)
+}
+
+// applied returns the digests of the indexes applied since the last call.
+func (m *StateMachine) applied() map[uint]uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	digests := m.digests
+	m.digests = make(map[uint]uint64)
+	return digests
+}
@@ -0,0 +1,312 @@
+package simulation
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/raft"
+)
+
+// Faults are applied to every message the network carries, requests and responses alike.
+type Faults struct {
+	// probability that a message is lost, the sender sees an error once it would have arrived
+	DropRate float64
+	// probability that a request is delivered twice
+	DuplicateRate float64
+	// probability that a message is held back long enough to be overtaken by the following ones
+	ReorderRate float64
+	// every message is delayed by a duration in [MinDelay, MaxDelay]
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+// Network carries the RPCs between the servers of a simulated cluster. Messages are queued and only delivered when
+// the simulation steps the network, at the simulated time they are due. Every decision about a message is derived
+// from the seed, the link it travels on and its position on that link.
+type Network struct {
+	mutex      sync.Mutex
+	clock      *Clock
+	seed       uint64
+	faults     Faults
+	transports map[string]*Transport
+	// servers in different groups cannot reach each other, servers that are not in the map are in group 0
+	groups map[string]int
+	// number of messages sent on each link so far
+	sent map[string]uint64
+	// messages ordered by delivery time, messages due at the same time keep the order they were sent in
+	queue []*message
+	// responses delivered by the last step
+	delivered []delivery
+}
+
+// delivery is a response waiting in the reply channel of the sender.
+type delivery struct {
+	sender *Transport
+	reply  chan result
+}
+
+type message struct {
+	deliverAt time.Time
+	deliver   func()
+}
+
+type result struct {
+	response []byte
+	err      error
+}
+
+func NewNetwork(clock *Clock, seed int64, faults Faults) *Network {
+	return &Network{
+		clock:      clock,
+		seed:       uint64(seed),
+		faults:     faults,
+		transports: make(map[string]*Transport),
+		groups:     make(map[string]int),
+		sent:       make(map[string]uint64),
+	}
+}
+
+// Transport creates the transport of the server listening on addr, replacing the one of a previous incarnation.
+func (n *Network) Transport(addr string) *Transport {
+	t := &Transport{addr: addr, network: n, done: make(chan struct{})}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.transports[addr] = t
+	return t
+}
+
+// Partition splits the servers in the given groups, the servers that are not listed form one more group.
+func (n *Network) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.groups[addr] = i + 1
+		}
+	}
+}
+
+// Heal reconnects all the servers.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// Step delivers the messages that are due at the current simulated time one at a time, in the order of their
+// delivery times and then of the order they were sent in. A request is handled by its receiver before the next
+// message is delivered, so the response is scheduled at a time that only depends on the seed.
+func (n *Network) Step() {
+	now := n.clock.Now()
+	n.mutex.Lock()
+	n.delivered = n.delivered[:0]
+	n.mutex.Unlock()
+	for {
+		n.mutex.Lock()
+		if len(n.queue) == 0 || n.queue[0].deliverAt.After(now) {
+			n.mutex.Unlock()
+			return
+		}
+		m := n.queue[0]
+		n.queue = n.queue[1:]
+		n.mutex.Unlock()
+		m.deliver()
+	}
+}
+
+// send schedules a request and the delivery of its response back to the sender.
+func (n *Network) send(from *Transport, to string, method string, request []byte, reply chan result) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	random := n.random(from.addr, to)
+	if random.chance(n.faults.DropRate) {
+		n.schedule(random, func() {
+			n.respond(from, reply, fmt.Errorf("request to %v was lost", to))
+		})
+		return
+	}
+
+	copies := 1
+	if random.chance(n.faults.DuplicateRate) {
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		n.schedule(random, func() {
+			n.deliver(from, to, method, request, reply)
+		})
+	}
+}
+
+// deliver has the receiver handle the request and schedules its response.
+func (n *Network) deliver(from *Transport, to string, method string, request []byte, reply chan result) {
+	n.mutex.Lock()
+	receiver := n.transports[to]
+	reachable := receiver != nil && receiver.controller != nil && n.connected(from.addr, to) && !from.isClosed() && !receiver.isClosed()
+	n.mutex.Unlock()
+	if !reachable {
+		n.respond(from, reply, fmt.Errorf("unable to connect to peer %s: connection refused", to))
+		return
+	}
+
+	response, err := receiver.controller.Handle(method, request)
+	if err != nil {
+		err = rpc.ServerError(err.Error())
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	random := n.random(to, from.addr)
+	if random.chance(n.faults.DropRate) {
+		err = fmt.Errorf("response from %v was lost", to)
+	}
+	n.schedule(random, func() {
+		n.mutex.Lock()
+		connected := n.connected(from.addr, to)
+		n.mutex.Unlock()
+		if !connected {
+			err = fmt.Errorf("connection to peer %s was lost", to)
+		}
+		n.respond(from, reply, err, response)
+	})
+}
+
+// respond sends the result to the sender without blocking, a duplicated request has its second response discarded.
+func (n *Network) respond(sender *Transport, reply chan result, err error, response ...[]byte) {
+	res := result{err: err}
+	if err == nil && len(response) > 0 {
+		res.response = response[0]
+	}
+	select {
+	case reply <- res:
+		n.mutex.Lock()
+		n.delivered = append(n.delivered, delivery{sender: sender, reply: reply})
+		n.mutex.Unlock()
+	default:
+	}
+}
+
+// pending reports whether a server that is still running did not receive a response delivered by the last step yet.
+func (n *Network) pending() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for _, d := range n.delivered {
+		if len(d.reply) > 0 && !d.sender.isClosed() {
+			return true
+		}
+	}
+	return false
+}
+
+// schedule queues a delivery at the current time plus a random delay. It must be called with the mutex held.
+func (n *Network) schedule(random *random, deliver func()) {
+	delay := n.faults.MinDelay
+	if spread := n.faults.MaxDelay - n.faults.MinDelay; spread > 0 {
+		delay += time.Duration(random.next() % uint64(spread))
+	}
+	if random.chance(n.faults.ReorderRate) {
+		delay += 5 * n.faults.MaxDelay
+	}
+
+	m := &message{deliverAt: n.clock.Now().Add(delay), deliver: deliver}
+	i := sort.Search(len(n.queue), func(i int) bool {
+		return n.queue[i].deliverAt.After(m.deliverAt)
+	})
+	n.queue = append(n.queue, nil)
+	copy(n.queue[i+1:], n.queue[i:])
+	n.queue[i] = m
+}
+
+// connected reports whether the two servers are on the same side of the partition. It must be called with the mutex
+// held.
+func (n *Network) connected(a string, b string) bool {
+	return n.groups[a] == n.groups[b]
+}
+
+// random returns the source of the decisions about the next message on the link from a to b. It must be called with
+// the mutex held.
+func (n *Network) random(a string, b string) *random {
+	link := a + "->" + b
+	n.sent[link]++
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(link))
+	return &random{state: n.seed ^ h.Sum64() ^ (n.sent[link] * 0x9e3779b97f4a7c15)}
+}
+
+// random is a splitmix64 generator, cheap enough to create one per message.
+type random struct {
+	state uint64
+}
+
+func (r *random) next() uint64 {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (r *random) chance(probability float64) bool {
+	return float64(r.next()>>11)/float64(1<<53) < probability
+}
+
+// Transport is the raft.Transport of one server on the simulated network.
+type Transport struct {
+	addr       string
+	network    *Network
+	controller *raft.RpcController
+	done       chan struct{}
+	closed     sync.Once
+}
+
+func (t *Transport) Serve(controller *raft.RpcController) error {
+	t.network.mutex.Lock()
+	t.controller = controller
+	t.network.mutex.Unlock()
+	<-t.done
+	return nil
+}
+
+func (t *Transport) Call(addr string, method string, request any, response any) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(request); err != nil {
+		return err
+	}
+	reply := make(chan result, 1)
+	t.network.send(t, addr, method, buffer.Bytes(), reply)
+
+	select {
+	case res := <-reply:
+		if res.err != nil {
+			return res.err
+		}
+		return gob.NewDecoder(bytes.NewReader(res.response)).Decode(response)
+	case <-t.done:
+		return rpc.ErrShutdown
+	}
+}
+
+func (t *Transport) Disconnect(string) {}
+
+func (t *Transport) Close() error {
+	t.closed.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
+
+func (t *Transport) isClosed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+var _ raft.Transport = (*Transport)(nil)
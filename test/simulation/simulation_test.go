@@ -0,0 +1,131 @@
+package simulation
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MohammedShetaya/kayakdb/raft"
+	"github.com/MohammedShetaya/kayakdb/types"
+)
+
+var seedFlag = flag.Int64("simulation.seed", 0, "run the simulations with this seed only")
+
+// seeds returns the seeds every scenario runs with.
+func seeds() []int64 {
+	if *seedFlag != 0 {
+		return []int64{*seedFlag}
+	}
+	return []int64{1, 2, 3}
+}
+
+// simulate runs the scenario once per seed, a failure names the seed to pass to -simulation.seed to run it again. The
+// run injects the same faults but may not fail again, the servers are not scheduled the same way.
+func simulate(t *testing.T, scenario func(t *testing.T, seed int64)) {
+	for _, seed := range seeds() {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			scenario(t, seed)
+		})
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulations are skipped in short mode")
+	}
+
+	t.Run("healthy network", func(t *testing.T) {
+		simulate(t, func(t *testing.T, seed int64) {
+			cluster := NewCluster(t, 3, seed, Faults{MinDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond})
+			defer cluster.Close()
+
+			cluster.Run(2 * time.Second)
+			leader := cluster.Leader()
+			if leader == nil {
+				t.Fatalf("seed %d: no leader was elected", seed)
+			}
+			if leader.State.CommitIndex() == 0 {
+				t.Fatalf("seed %d: no write was committed", seed)
+			}
+		})
+	})
+
+	t.Run("unreliable network", func(t *testing.T) {
+		simulate(t, func(t *testing.T, seed int64) {
+			cluster := NewCluster(t, 5, seed, Faults{
+				DropRate:      0.05,
+				DuplicateRate: 0.05,
+				ReorderRate:   0.05,
+				MinDelay:      time.Millisecond,
+				MaxDelay:      10 * time.Millisecond,
+			})
+			defer cluster.Close()
+
+			cluster.Run(4 * time.Second)
+		})
+	})
+
+	t.Run("partitions and crashes", func(t *testing.T) {
+		simulate(t, func(t *testing.T, seed int64) {
+			cluster := NewCluster(t, 5, seed, Faults{
+				DropRate: 0.02,
+				MinDelay: time.Millisecond,
+				MaxDelay: 10 * time.Millisecond,
+			})
+			defer cluster.Close()
+
+			cluster.Nemesis(6*time.Second, 500*time.Millisecond)
+			// the cluster recovers once the network is healed and all the servers are back
+			cluster.Run(2 * time.Second)
+			if cluster.Leader() == nil {
+				t.Fatalf("seed %d: no leader was elected after the faults stopped", seed)
+			}
+		})
+	})
+
+	t.Run("witness", func(t *testing.T) {
+		simulate(t, func(t *testing.T, seed int64) {
+			// two servers and a witness that breaks the tie between them
+			cluster := NewClusterWithWitnesses(t, 3, 1, seed, Faults{MinDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond})
+			defer cluster.Close()
+
+			cluster.Run(2 * time.Second)
+			leader := cluster.Leader()
+			if leader == nil {
+				t.Fatalf("seed %d: no leader was elected", seed)
+			}
+			if leader.State.CommitIndex() == 0 {
+				t.Fatalf("seed %d: no write was committed", seed)
+			}
+			for _, r := range cluster.running() {
+				if !cluster.isWitness(r) {
+					continue
+				}
+				if _, err := r.Get(context.Background(), types.String("key-1"), raft.ReadStale); !errors.Is(err, raft.ErrWitness) {
+					t.Fatalf("seed %d: expected the witness to refuse the read, got %v", seed, err)
+				}
+			}
+		})
+	})
+
+	t.Run("witnesses with partitions and crashes", func(t *testing.T) {
+		simulate(t, func(t *testing.T, seed int64) {
+			// two datacenters of two servers each and a witness in a third one
+			cluster := NewClusterWithWitnesses(t, 5, 1, seed, Faults{
+				DropRate: 0.02,
+				MinDelay: time.Millisecond,
+				MaxDelay: 10 * time.Millisecond,
+			})
+			defer cluster.Close()
+
+			cluster.Nemesis(6*time.Second, 500*time.Millisecond)
+			cluster.Run(2 * time.Second)
+			if cluster.Leader() == nil {
+				t.Fatalf("seed %d: no leader was elected after the faults stopped", seed)
+			}
+		})
+	})
+}
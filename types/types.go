@@ -71,10 +71,27 @@ func (s String) Bytes() []byte {
 
 type Headers struct {
 	Path String
+	// Consistency is the consistency level a read is served with: linearizable (the default), lease or stale
+	Consistency String
+	// Error is set on responses to requests that failed
+	Error String
+	// Redirect is set on responses from a server that cannot serve the request, it holds the address of the
+	// server the request should be sent to instead
+	Redirect String
 }
 
 func (h Headers) String() string {
-	return fmt.Sprintf("Path: %s (Length: %d)", h.Path, len(h.Path))
+	s := fmt.Sprintf("Path: %s (Length: %d)", h.Path, len(h.Path))
+	if h.Consistency != "" {
+		s += fmt.Sprintf(", Consistency: %s", h.Consistency)
+	}
+	if h.Error != "" {
+		s += fmt.Sprintf(", Error: %s", h.Error)
+	}
+	if h.Redirect != "" {
+		s += fmt.Sprintf(", Redirect: %s", h.Redirect)
+	}
+	return s
 }
 
 func (h Headers) Bytes() []byte {
@@ -14,6 +14,7 @@ import (
 // NOTE: this implementation assumes that anything can be configuration in json, but some of the configs can be set using env variables
 // NOTE: the env vars can only set primitive values string, int, float, etc.
 // Priority: default < json < env
+// NOTE: an object that has a Validate() error method is validated once everything was loaded
 func LoadConfigurations(configObject any) (any, error) {
 
 	if reflect.TypeOf(configObject).Kind() != reflect.Ptr {
@@ -32,12 +33,19 @@ func LoadConfigurations(configObject any) (any, error) {
 		return nil, err
 	}
 
-	// Finally, read from environment variables (will override JSON)
+	// Then, read from environment variables (will override JSON)
 	err = readConfigFromEnvironmentVars(configObject)
 	if err != nil {
 		return nil, err
 	}
 
+	// Finally, check that the values work together
+	if validator, ok := configObject.(interface{ Validate() error }); ok {
+		if err = validator.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration: %w", err)
+		}
+	}
+
 	return configObject, nil
 }
 
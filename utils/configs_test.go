@@ -45,6 +45,12 @@ func TestLoadConfigurations(t *testing.T) {
 		if config.ServiceName != "kayakdb" {
 			t.Errorf("Expected default ServiceName to be kayakdb, got %s", config.ServiceName)
 		}
+		if config.StorageDriver != "memory" {
+			t.Errorf("Expected default StorageDriver to be memory, got %s", config.StorageDriver)
+		}
+		if config.DataDir != "data" {
+			t.Errorf("Expected default DataDir to be data, got %s", config.DataDir)
+		}
 		// SeedPeers doesn't have a default tag, so it should remain nil/empty
 		if config.SeedPeers != nil && len(config.SeedPeers) > 0 {
 			t.Errorf("Expected SeedPeers to be nil or empty (no default), got %v", config.SeedPeers)
@@ -206,6 +212,32 @@ func TestLoadConfigurations(t *testing.T) {
 		}
 	})
 
+	t.Run("invalid election timing", func(t *testing.T) {
+		os.Remove("raft.json")
+
+		tests := []struct {
+			name string
+			env  map[string]string
+		}{
+			{"heartbeat too close to the election timeout", map[string]string{"HEARTBEAT_INTERVAL": "100"}},
+			{"maximum below the minimum election timeout", map[string]string{"ELECTION_TIMEOUT_MIN": "400"}},
+			{"zero heartbeat interval", map[string]string{"HEARTBEAT_INTERVAL": "0"}},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				for key, value := range test.env {
+					os.Setenv(key, value)
+					defer os.Unsetenv(key)
+				}
+
+				cfg := &config.Configuration{}
+				if _, err := LoadConfigurations(cfg); err == nil {
+					t.Error("Expected error for invalid election timing, got nil")
+				}
+			})
+		}
+	})
+
 	t.Run("non-pointer config object", func(t *testing.T) {
 		cfg := config.Configuration{}
 		_, err := LoadConfigurations(cfg)
@@ -117,11 +117,11 @@ func (p *WorkerPool) Start() {
 
 }
 
+// Stop makes the workers exit once they finished the job they are running, the jobs left in the queue are dropped.
+// It does not wait for the workers and must be called only once.
 func (p *WorkerPool) Stop() {
-	// send a signal to all go routines to exit
-	for i := uint(0); i < p.Size; i++ {
-		p.ExitSignal <- struct{}{}
-	}
+	// signal all go routines to exit, this does not block even if the pool was never started
+	close(p.ExitSignal)
 }
 
 func (p *WorkerPool) Enqueue(job *Job) error {